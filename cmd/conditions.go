@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// unmetCondition returns why the machine shouldn't be upgraded right
+// now, or "" when every enabled condition is met.
+func (h *host) unmetCondition(ctx context.Context, conf config.ConditionsConfig) (string, error) {
+	if conf.ACPower {
+		ac, err := system.OnACPower(h.powerSupplyDir)
+		if err != nil {
+			return "", err
+		}
+		if !ac {
+			return "on battery power", nil
+		}
+	}
+
+	if conf.NoSessions {
+		sessions, err := system.Sessions(ctx)
+		if err != nil {
+			return "", err
+		}
+		active := []string{}
+		for _, s := range sessions {
+			if s.Interactive() {
+				kind := s.Type
+				if s.Remote || s.Service == "sshd" {
+					kind = "remote"
+				}
+				active = append(active, fmt.Sprintf("%s (%s)", s.User, kind))
+			}
+		}
+		if len(active) > 0 {
+			return "sessions logged in: " + strings.Join(active, ", "), nil
+		}
+	}
+
+	if conf.MaxLoad > 0 {
+		load, err := system.LoadAverage(h.loadAvgFile)
+		if err != nil {
+			return "", err
+		}
+		if load >= conf.MaxLoad {
+			return fmt.Sprintf("load average %.2f, max %.2f", load, conf.MaxLoad), nil
+		}
+	}
+
+	if conf.Unmetered {
+		metered, err := system.Metered(ctx)
+		if err != nil {
+			return "", err
+		}
+		if metered {
+			return "network connection is metered", nil
+		}
+	}
+
+	return "", nil
+}
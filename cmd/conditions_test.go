@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// fakeConditions replaces the power supplies and load average h reads
+// for run conditions.
+func fakeConditions(t *testing.T, h *host, mainsOnline, loadavg string) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "power_supply", "AC"), 0755)
+	os.MkdirAll(filepath.Join(dir, "power_supply", "BAT0"), 0755)
+	os.WriteFile(filepath.Join(dir, "power_supply", "AC", "type"), []byte("Mains\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "power_supply", "AC", "online"), []byte(mainsOnline+"\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "power_supply", "BAT0", "type"), []byte("Battery\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "loadavg"), []byte(loadavg+" 0.50 0.25 1/200 1234\n"), 0644)
+
+	h.powerSupplyDir = filepath.Join(dir, "power_supply")
+	h.loadAvgFile = filepath.Join(dir, "loadavg")
+}
+
+func TestConditions(t *testing.T) {
+	t.Run("met conditions upgrade", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		fake.Handle(testSwitch)
+		fakeConditions(t, h, "1", "0.75")
+		conf := testConfig(t, server)
+		conf.Conditions.ACPower = true
+		conf.Conditions.MaxLoad = 2
+
+		err := h.runUpgrade(context.Background(), conf)
+
+		assert.Equal(t, err, nil)
+		assert.Equal(t, fake.Ran(testSwitch+" boot"), true)
+	})
+
+	t.Run("on battery skips the upgrade without failing", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		fakeConditions(t, h, "0", "0.75")
+		conf := testConfig(t, server)
+		conf.Conditions.ACPower = true
+
+		reason, err := h.unmetCondition(context.Background(), conf.Conditions)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, reason, "on battery power")
+
+		err = h.runUpgrade(context.Background(), conf)
+
+		assert.Equal(t, err, nil)
+		assert.Equal(t, len(fake.Commands()), 0)
+	})
+
+	t.Run("high load skips the upgrade without failing", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		fakeConditions(t, h, "1", "3.20")
+		conf := testConfig(t, server)
+		conf.Conditions.MaxLoad = 2
+
+		reason, err := h.unmetCondition(context.Background(), conf.Conditions)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, reason, "load average 3.20, max 2.00")
+
+		err = h.runUpgrade(context.Background(), conf)
+
+		assert.Equal(t, err, nil)
+		assert.Equal(t, len(fake.Commands()), 0)
+	})
+
+	t.Run("logged in users skip the upgrade", func(t *testing.T) {
+		h, server, _ := newUpgradeTest(t)
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "loginctl"), []byte(`#!/bin/sh
+case "$1" in
+list-sessions) echo '4 1000 alice - pts/0' ;;
+show-session) printf 'Name=alice\nType=tty\nClass=user\nService=sshd\nState=active\nRemote=yes\n' ;;
+esac
+`), 0755)
+		t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+		conf := testConfig(t, server)
+		conf.Conditions.NoSessions = true
+
+		reason, err := h.unmetCondition(context.Background(), conf.Conditions)
+
+		assert.Equal(t, err, nil)
+		assert.Equal(t, reason, "sessions logged in: alice (remote)")
+	})
+
+	t.Run("unknown conditions retry the upgrade later", func(t *testing.T) {
+		// test hosts have no load average
+		h, server, fake := newUpgradeTest(t)
+		conf := testConfig(t, server)
+		conf.Conditions.MaxLoad = 2
+
+		_, err := h.unmetCondition(context.Background(), conf.Conditions)
+		assert.Equal(t, errors.Is(err, system.ErrCondition), true)
+
+		err = h.runUpgrade(context.Background(), conf)
+
+		assert.Equal(t, errors.Is(err, errRetryLater), true)
+		assert.Equal(t, errors.Is(err, system.ErrCondition), true)
+		assert.Equal(t, len(fake.Commands()), 0)
+	})
+}
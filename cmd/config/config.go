@@ -1,16 +1,74 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+// defaults for canary hosts and ping checks, see healthcheck.PingCheck
+type PingConfig struct {
+	Count    int           `validate:"min=1"`
+	Interval time.Duration `validate:"gt=0s"`
+	// 0 waits Count * Interval + 1s
+	Timeout time.Duration `validate:"gte=0s"`
+	// percent of echo requests that may be lost
+	MaxLoss float64 `mapstructure:"max_loss" validate:"gte=0,lte=100"`
+	// maximum average round trip time, 0 disables
+	MaxRTT     time.Duration `mapstructure:"max_rtt" validate:"gte=0s"`
+	Privileged bool
+	// 4 or 6, 0 uses either
+	IPVersion int `mapstructure:"ip_version" validate:"oneof=0 4 6"`
+}
+
 type HealthCheckConfig struct {
+	// shorthand for ping checks
 	CanaryHosts []string `validate:"required,dive,min=1"`
+	Ping        PingConfig
+	// timeout for checks without their own
+	Timeout time.Duration `validate:"gt=0s"`
+	// failed checks without their own deadline are retried until this
+	// long after their first attempt, 0 disables retries
+	Deadline   time.Duration `validate:"gte=0s"`
+	Backoff    time.Duration `validate:"gte=0s"`
+	MaxBackoff time.Duration `mapstructure:"max_backoff" validate:"omitempty,gtefield=Backoff"`
+	// checks of any registered kind, run concurrently
+	Checks []healthcheck.Spec `validate:"unique=Name,dive"`
+	// quorums for checks by group, canary hosts are in group "canary"
+	Groups []healthcheck.Group `validate:"unique=Name,dive"`
+	// systemd units failed before an upgrade abort it, or are ignored by
+	// later checks with continue
+	FailedUnits string `mapstructure:"failed_units" validate:"oneof=off abort continue"`
+}
+
+type HydraAuthConfig struct {
+	Method string `validate:"omitempty,oneof=none basic bearer header session"`
+	User   string `validate:"required_if=Method basic,required_if=Method session"`
+	Header string `validate:"required_if=Method header"`
+	// secret sources, exactly one is required unless Method is none
+	SecretFile string `mapstructure:"secret_file" validate:"excluded_with=Credential"`
+	Credential string
+}
+
+// pins an upgrade to a specific build, at most one may be set
+type HydraPinConfig struct {
+	BuildID int    `mapstructure:"build_id" validate:"min=0,excluded_with=EvalID Rev"`
+	EvalID  int    `mapstructure:"eval_id" validate:"min=0,excluded_with=Rev"`
+	Rev     string `validate:"omitempty,min=7,max=40,hexadecimal"`
+	// allow a pinned build older than the running system
+	AllowDowngrade bool `mapstructure:"allow_downgrade"`
+}
+
+// Pinned reports whether any pin is set.
+func (pin HydraPinConfig) Pinned() bool {
+	return pin.BuildID != 0 || pin.EvalID != 0 || pin.Rev != ""
 }
 
 type HydraConfig struct {
@@ -18,47 +76,224 @@ type HydraConfig struct {
 	JobSet   string `validate:"min=1"`
 	Job      string `validate:"min=1"`
 	Project  string `validate:"min=1"`
+	Auth     HydraAuthConfig
+	Pin      HydraPinConfig
+	// latest, latest-finished, or latest-successful
+	Selection string `validate:"oneof=latest latest-finished latest-successful"`
+	// number of recent builds searched by latest-successful
+	SearchDepth int `mapstructure:"search_depth" validate:"min=1"`
+	// jobs in the same evaluation that must also succeed
+	RequiredJobs []string `mapstructure:"required_jobs" validate:"dive,min=1"`
+	// aggregate job in the same evaluation whose constituents must succeed
+	AggregateJob string `mapstructure:"aggregate_job"`
+	// hydra.BuildStatus name -> alert, retry, or skip
+	StatusPolicy map[string]string `mapstructure:"status_policy" validate:"dive,keys,oneof=unfinished failed dependency-failed aborted cancelled failed-with-output timed-out cached-failure unsupported-system log-limit-exceeded output-limit-exceeded non-deterministic,endkeys,oneof=alert retry skip"`
+	// per request timeout, 0 disables
+	Timeout time.Duration `validate:"gte=0s"`
+	// overall deadline for all hydra requests, 0 disables
+	Deadline   time.Duration `validate:"gte=0s"`
+	Retries    int           `validate:"min=0"`
+	Backoff    time.Duration `validate:"gte=0s"`
+	MaxBackoff time.Duration `mapstructure:"max_backoff" validate:"omitempty,gtefield=Backoff"`
 }
 
 type NixBuildConfig struct {
-	Operation string   `validate:"oneof=boot check dry-activate switch test"`
-	Host      string   `validate:"min=1"`
-	Args      []string `validate:"required,dive,min=1"`
+	Operation string `validate:"oneof=boot check dry-activate switch test"`
+	// eval builds the flake toplevel locally, substitute realises the
+	// hydra build output directly
+	Mode string `validate:"oneof=eval substitute"`
+	// compare eval mode results with the hydra build output
+	VerifyOutput string `mapstructure:"verify_output" validate:"oneof=off warn fail"`
+	// abort if anything would be built locally, and disable local builds
+	SubstituteOnly bool     `mapstructure:"substitute_only"`
+	Host           string   `validate:"min=1"`
+	Args           []string `validate:"required,dive,min=1"`
+}
+
+// post-activation health checks and rollback, for the switch and test
+// operations
+type RollbackConfig struct {
+	Enable bool
+	// health checks are repeated for this long after activation, 0 checks once
+	Window time.Duration `validate:"gte=0s"`
+	// delay between post-activation health checks
+	Interval time.Duration `validate:"gt=0s"`
+}
+
+type RebootPolicyConfig struct {
+	// required reboots only when boot components changed, always
+	// reboots after every upgrade
+	When string `validate:"oneof=required always"`
+	// records why a reboot is required when reboot is disabled
+	Marker string `validate:"min=1"`
+	// daily HH:MM local time window reboots may start in, reboots
+	// outside it are deferred until it opens. An empty window would
+	// never open.
+	WindowStart string `mapstructure:"window_start" validate:"required_with=WindowEnd,omitempty,datetime=15:04"`
+	WindowEnd   string `mapstructure:"window_end" validate:"required_with=WindowStart,omitempty,datetime=15:04,nefield=WindowStart"`
+	// delay before rebooting, broadcast to logged in users with Message
+	Delay   time.Duration `validate:"gte=0s"`
+	Message string
+}
+
+// fleet-wide reboot coordination, a slot is held from reboot until
+// `verify` passes on the next boot
+type RebootLockConfig struct {
+	Backend string `validate:"oneof=none http file"`
+	// lease server url, for the http backend
+	URL string `validate:"required_if=Backend http,omitempty,url"`
+	// directory on a shared mount, for the file backend
+	Path string `validate:"required_if=Backend file"`
+	// concurrent reboots, for the file backend. The lease server
+	// configures its own.
+	Slots int `validate:"min=1"`
+	// file backend slots held longer than this are expired, 0 never
+	// expires them
+	TTL time.Duration `validate:"gte=0s"`
+	// identifies this host to the lock, defaults to the hostname
+	Holder string
+}
+
+// conditions the machine must meet for upgrades to run, runs that
+// don't meet them end without upgrading
+type ConditionsConfig struct {
+	// on mains power, systems without a battery always are
+	ACPower bool `mapstructure:"ac_power"`
+	// no active graphical or remote (e.g. ssh) logind sessions
+	NoSessions bool `mapstructure:"no_sessions"`
+	// 1 minute load average must be below this, 0 disables
+	MaxLoad float64 `mapstructure:"max_load" validate:"gte=0"`
+	// NetworkManager doesn't consider the connection metered
+	Unmetered bool
 }
 
 // command config
 type Config struct {
-	Debug       bool
-	HealthCheck HealthCheckConfig `validate:"required"`
-	Hydra       HydraConfig       `validate:"required"`
-	NixBuild    NixBuildConfig    `mapstructure:"nix_build" validate:"required"`
-	Reboot      bool
+	Debug        bool
+	Conditions   ConditionsConfig
+	HealthCheck  HealthCheckConfig `validate:"required"`
+	Hydra        HydraConfig       `validate:"required"`
+	NixBuild     NixBuildConfig    `mapstructure:"nix_build" validate:"required"`
+	Rollback     RollbackConfig
+	Reboot       bool
+	RebootPolicy RebootPolicyConfig `mapstructure:"reboot_policy"`
+	RebootLock   RebootLockConfig   `mapstructure:"reboot_lock"`
+	// boot the new generation once with systemd-boot, and only make it
+	// the default after `verify` passes. Implies reboot.
+	TrialBoot bool `mapstructure:"trial_boot"`
+	// persistent state, e.g. trial boot markers
+	StateDir string `mapstructure:"state_dir" validate:"min=1"`
 }
 
 // cobra and viper key constants, matching the command structure
+type ConditionsConfigKeys struct {
+	ACPower    string
+	NoSessions string
+	MaxLoad    string
+	Unmetered  string
+}
+
+type PingConfigKeys struct {
+	Count      string
+	Interval   string
+	Timeout    string
+	MaxLoss    string
+	MaxRTT     string
+	Privileged string
+	IPVersion  string
+}
+
 type HealthCheckConfigKeys struct {
 	CanaryHosts string
+	Ping        PingConfigKeys
+	Timeout     string
+	Deadline    string
+	Backoff     string
+	MaxBackoff  string
+	Checks      string
+	Groups      string
+	FailedUnits string
+}
+
+type HydraAuthConfigKeys struct {
+	Method     string
+	User       string
+	Header     string
+	SecretFile string
+	Credential string
+}
+
+type HydraPinConfigKeys struct {
+	BuildID        string
+	EvalID         string
+	Rev            string
+	AllowDowngrade string
 }
 
 type HydraConfigKeys struct {
-	Instance string
-	JobSet   string
-	Job      string
-	Project  string
+	Instance     string
+	JobSet       string
+	Job          string
+	Project      string
+	Auth         HydraAuthConfigKeys
+	Pin          HydraPinConfigKeys
+	Selection    string
+	SearchDepth  string
+	RequiredJobs string
+	AggregateJob string
+	StatusPolicy string
+	Timeout      string
+	Deadline     string
+	Retries      string
+	Backoff      string
+	MaxBackoff   string
 }
 
 type NixBuildConfigKeys struct {
-	Operation string
-	Host      string
-	Args      string
+	Operation      string
+	Mode           string
+	VerifyOutput   string
+	SubstituteOnly string
+	Host           string
+	Args           string
+}
+
+type RollbackConfigKeys struct {
+	Enable   string
+	Window   string
+	Interval string
+}
+
+type RebootPolicyConfigKeys struct {
+	When        string
+	Marker      string
+	WindowStart string
+	WindowEnd   string
+	Delay       string
+	Message     string
+}
+
+type RebootLockConfigKeys struct {
+	Backend string
+	URL     string
+	Path    string
+	Slots   string
+	TTL     string
+	Holder  string
 }
 
 type ConfigKeys struct {
-	Debug       string
-	HealthCheck HealthCheckConfigKeys
-	Hydra       HydraConfigKeys
-	NixBuild    NixBuildConfigKeys
-	Reboot      string
+	Debug        string
+	Conditions   ConditionsConfigKeys
+	HealthCheck  HealthCheckConfigKeys
+	Hydra        HydraConfigKeys
+	NixBuild     NixBuildConfigKeys
+	Rollback     RollbackConfigKeys
+	Reboot       string
+	RebootPolicy RebootPolicyConfigKeys
+	RebootLock   RebootLockConfigKeys
+	TrialBoot    string
+	StateDir     string
 }
 
 var (
@@ -66,39 +301,181 @@ var (
 	envKeyReplacer = strings.NewReplacer(".", "_", "-", "_")
 	CobraKeys      = ConfigKeys{
 		Debug: "debug",
+		Conditions: ConditionsConfigKeys{
+			ACPower:    "condition-ac-power",
+			NoSessions: "condition-no-sessions",
+			MaxLoad:    "condition-max-load",
+			Unmetered:  "condition-unmetered",
+		},
 		HealthCheck: HealthCheckConfigKeys{
 			CanaryHosts: "canary",
+			Ping: PingConfigKeys{
+				Count:      "ping-count",
+				Interval:   "ping-interval",
+				Timeout:    "ping-timeout",
+				MaxLoss:    "ping-max-loss",
+				MaxRTT:     "ping-max-rtt",
+				Privileged: "ping-privileged",
+				IPVersion:  "ping-ip-version",
+			},
+			Timeout:     "healthcheck-timeout",
+			Deadline:    "healthcheck-deadline",
+			Backoff:     "healthcheck-backoff",
+			MaxBackoff:  "healthcheck-max-backoff",
+			Checks:      "N/A",
+			Groups:      "N/A",
+			FailedUnits: "failed-units",
 		},
 		Hydra: HydraConfigKeys{
 			Instance: "instance",
 			JobSet:   "jobset",
 			Job:      "job",
 			Project:  "project",
+			Auth: HydraAuthConfigKeys{
+				Method:     "hydra-auth",
+				User:       "hydra-user",
+				Header:     "hydra-header",
+				SecretFile: "hydra-secret-file",
+				Credential: "hydra-credential",
+			},
+			Pin: HydraPinConfigKeys{
+				BuildID:        "build-id",
+				EvalID:         "eval-id",
+				Rev:            "rev",
+				AllowDowngrade: "allow-downgrade",
+			},
+			Selection:    "hydra-selection",
+			SearchDepth:  "hydra-search-depth",
+			RequiredJobs: "required-job",
+			AggregateJob: "aggregate-job",
+			StatusPolicy: "N/A",
+			Timeout:      "hydra-timeout",
+			Deadline:     "hydra-deadline",
+			Retries:      "hydra-retries",
+			Backoff:      "hydra-backoff",
+			MaxBackoff:   "hydra-max-backoff",
 		},
 		NixBuild: NixBuildConfigKeys{
-			Operation: "N/A",
-			Host:      "host",
-			Args:      "passthru-args",
+			Operation:      "N/A",
+			Mode:           "mode",
+			VerifyOutput:   "verify-output",
+			SubstituteOnly: "substitute-only",
+			Host:           "host",
+			Args:           "passthru-args",
+		},
+		Rollback: RollbackConfigKeys{
+			Enable:   "rollback",
+			Window:   "rollback-window",
+			Interval: "rollback-interval",
 		},
 		Reboot: "reboot",
+		RebootPolicy: RebootPolicyConfigKeys{
+			When:        "reboot-when",
+			Marker:      "reboot-marker",
+			WindowStart: "reboot-window-start",
+			WindowEnd:   "reboot-window-end",
+			Delay:       "reboot-delay",
+			Message:     "reboot-message",
+		},
+		RebootLock: RebootLockConfigKeys{
+			Backend: "reboot-lock-backend",
+			URL:     "reboot-lock-url",
+			Path:    "reboot-lock-path",
+			Slots:   "reboot-lock-slots",
+			TTL:     "reboot-lock-ttl",
+			Holder:  "reboot-lock-holder",
+		},
+		TrialBoot: "trial-boot",
+		StateDir:  "state-dir",
 	}
 	ViperKeys = ConfigKeys{
 		Debug: "debug",
+		Conditions: ConditionsConfigKeys{
+			ACPower:    "conditions.ac_power",
+			NoSessions: "conditions.no_sessions",
+			MaxLoad:    "conditions.max_load",
+			Unmetered:  "conditions.unmetered",
+		},
 		HealthCheck: HealthCheckConfigKeys{
 			CanaryHosts: "healthcheck.canaryhosts",
+			Ping: PingConfigKeys{
+				Count:      "healthcheck.ping.count",
+				Interval:   "healthcheck.ping.interval",
+				Timeout:    "healthcheck.ping.timeout",
+				MaxLoss:    "healthcheck.ping.max_loss",
+				MaxRTT:     "healthcheck.ping.max_rtt",
+				Privileged: "healthcheck.ping.privileged",
+				IPVersion:  "healthcheck.ping.ip_version",
+			},
+			Timeout:     "healthcheck.timeout",
+			Deadline:    "healthcheck.deadline",
+			Backoff:     "healthcheck.backoff",
+			MaxBackoff:  "healthcheck.max_backoff",
+			Checks:      "healthcheck.checks",
+			Groups:      "healthcheck.groups",
+			FailedUnits: "healthcheck.failed_units",
 		},
 		Hydra: HydraConfigKeys{
 			Instance: "hydra.instance",
 			JobSet:   "hydra.jobset",
 			Job:      "hydra.job",
 			Project:  "hydra.project",
+			Auth: HydraAuthConfigKeys{
+				Method:     "hydra.auth.method",
+				User:       "hydra.auth.user",
+				Header:     "hydra.auth.header",
+				SecretFile: "hydra.auth.secret_file",
+				Credential: "hydra.auth.credential",
+			},
+			Pin: HydraPinConfigKeys{
+				BuildID:        "hydra.pin.build_id",
+				EvalID:         "hydra.pin.eval_id",
+				Rev:            "hydra.pin.rev",
+				AllowDowngrade: "hydra.pin.allow_downgrade",
+			},
+			Selection:    "hydra.selection",
+			SearchDepth:  "hydra.search_depth",
+			RequiredJobs: "hydra.required_jobs",
+			AggregateJob: "hydra.aggregate_job",
+			StatusPolicy: "hydra.status_policy",
+			Timeout:      "hydra.timeout",
+			Deadline:     "hydra.deadline",
+			Retries:      "hydra.retries",
+			Backoff:      "hydra.backoff",
+			MaxBackoff:   "hydra.max_backoff",
 		},
 		NixBuild: NixBuildConfigKeys{
-			Operation: "nix_build.operation",
-			Host:      "nix_build.host",
-			Args:      "nix_build.args",
+			Operation:      "nix_build.operation",
+			Mode:           "nix_build.mode",
+			VerifyOutput:   "nix_build.verify_output",
+			SubstituteOnly: "nix_build.substitute_only",
+			Host:           "nix_build.host",
+			Args:           "nix_build.args",
+		},
+		Rollback: RollbackConfigKeys{
+			Enable:   "rollback.enable",
+			Window:   "rollback.window",
+			Interval: "rollback.interval",
 		},
 		Reboot: "reboot",
+		RebootPolicy: RebootPolicyConfigKeys{
+			When:        "reboot_policy.when",
+			Marker:      "reboot_policy.marker",
+			WindowStart: "reboot_policy.window_start",
+			WindowEnd:   "reboot_policy.window_end",
+			Delay:       "reboot_policy.delay",
+			Message:     "reboot_policy.message",
+		},
+		RebootLock: RebootLockConfigKeys{
+			Backend: "reboot_lock.backend",
+			URL:     "reboot_lock.url",
+			Path:    "reboot_lock.path",
+			Slots:   "reboot_lock.slots",
+			TTL:     "reboot_lock.ttl",
+			Holder:  "reboot_lock.holder",
+		},
+		TrialBoot: "trial_boot",
+		StateDir:  "state_dir",
 	}
 )
 
@@ -116,32 +493,184 @@ func InitializeConfig(rootCmd *cobra.Command, args []string) (Config, error) {
 
 	// manually bind so environment variables function without config file unmarshalling
 	v.BindEnv(ViperKeys.Debug)
+	v.BindEnv(ViperKeys.Conditions.ACPower)
+	v.BindEnv(ViperKeys.Conditions.NoSessions)
+	v.BindEnv(ViperKeys.Conditions.MaxLoad)
+	v.BindEnv(ViperKeys.Conditions.Unmetered)
 	v.BindEnv(ViperKeys.HealthCheck.CanaryHosts)
+	v.BindEnv(ViperKeys.HealthCheck.Ping.Count)
+	v.BindEnv(ViperKeys.HealthCheck.Ping.Interval)
+	v.BindEnv(ViperKeys.HealthCheck.Ping.Timeout)
+	v.BindEnv(ViperKeys.HealthCheck.Ping.MaxLoss)
+	v.BindEnv(ViperKeys.HealthCheck.Ping.MaxRTT)
+	v.BindEnv(ViperKeys.HealthCheck.Ping.Privileged)
+	v.BindEnv(ViperKeys.HealthCheck.Ping.IPVersion)
+	v.BindEnv(ViperKeys.HealthCheck.Timeout)
+	v.BindEnv(ViperKeys.HealthCheck.Deadline)
+	v.BindEnv(ViperKeys.HealthCheck.Backoff)
+	v.BindEnv(ViperKeys.HealthCheck.MaxBackoff)
+	v.BindEnv(ViperKeys.HealthCheck.FailedUnits)
 	v.BindEnv(ViperKeys.Hydra.Instance)
 	v.BindEnv(ViperKeys.Hydra.JobSet)
 	v.BindEnv(ViperKeys.Hydra.Job)
 	v.BindEnv(ViperKeys.Hydra.Project)
+	v.BindEnv(ViperKeys.Hydra.Auth.Method)
+	v.BindEnv(ViperKeys.Hydra.Auth.User)
+	v.BindEnv(ViperKeys.Hydra.Auth.Header)
+	v.BindEnv(ViperKeys.Hydra.Auth.SecretFile)
+	v.BindEnv(ViperKeys.Hydra.Auth.Credential)
+	v.BindEnv(ViperKeys.Hydra.Pin.BuildID)
+	v.BindEnv(ViperKeys.Hydra.Pin.EvalID)
+	v.BindEnv(ViperKeys.Hydra.Pin.Rev)
+	v.BindEnv(ViperKeys.Hydra.Pin.AllowDowngrade)
+	v.BindEnv(ViperKeys.Hydra.Selection)
+	v.BindEnv(ViperKeys.Hydra.SearchDepth)
+	v.BindEnv(ViperKeys.Hydra.RequiredJobs)
+	v.BindEnv(ViperKeys.Hydra.AggregateJob)
+	v.BindEnv(ViperKeys.Hydra.Timeout)
+	v.BindEnv(ViperKeys.Hydra.Deadline)
+	v.BindEnv(ViperKeys.Hydra.Retries)
+	v.BindEnv(ViperKeys.Hydra.Backoff)
+	v.BindEnv(ViperKeys.Hydra.MaxBackoff)
 	v.BindEnv(ViperKeys.NixBuild.Operation)
+	v.BindEnv(ViperKeys.NixBuild.Mode)
+	v.BindEnv(ViperKeys.NixBuild.VerifyOutput)
+	v.BindEnv(ViperKeys.NixBuild.SubstituteOnly)
 	v.BindEnv(ViperKeys.NixBuild.Host)
 	v.BindEnv(ViperKeys.NixBuild.Args)
+	v.BindEnv(ViperKeys.Rollback.Enable)
+	v.BindEnv(ViperKeys.Rollback.Window)
+	v.BindEnv(ViperKeys.Rollback.Interval)
 	v.BindEnv(ViperKeys.Reboot)
+	v.BindEnv(ViperKeys.RebootPolicy.When)
+	v.BindEnv(ViperKeys.RebootPolicy.Marker)
+	v.BindEnv(ViperKeys.RebootPolicy.WindowStart)
+	v.BindEnv(ViperKeys.RebootPolicy.WindowEnd)
+	v.BindEnv(ViperKeys.RebootPolicy.Delay)
+	v.BindEnv(ViperKeys.RebootPolicy.Message)
+	v.BindEnv(ViperKeys.RebootLock.Backend)
+	v.BindEnv(ViperKeys.RebootLock.URL)
+	v.BindEnv(ViperKeys.RebootLock.Path)
+	v.BindEnv(ViperKeys.RebootLock.Slots)
+	v.BindEnv(ViperKeys.RebootLock.TTL)
+	v.BindEnv(ViperKeys.RebootLock.Holder)
+	v.BindEnv(ViperKeys.TrialBoot)
+	v.BindEnv(ViperKeys.StateDir)
 
 	v.BindPFlag(ViperKeys.Debug, rootCmd.PersistentFlags().Lookup(CobraKeys.Debug))
+	v.BindPFlag(ViperKeys.Conditions.ACPower, rootCmd.PersistentFlags().Lookup(CobraKeys.Conditions.ACPower))
+	v.BindPFlag(ViperKeys.Conditions.NoSessions, rootCmd.PersistentFlags().Lookup(CobraKeys.Conditions.NoSessions))
+	v.BindPFlag(ViperKeys.Conditions.MaxLoad, rootCmd.PersistentFlags().Lookup(CobraKeys.Conditions.MaxLoad))
+	v.BindPFlag(ViperKeys.Conditions.Unmetered, rootCmd.PersistentFlags().Lookup(CobraKeys.Conditions.Unmetered))
 	v.BindPFlag(ViperKeys.HealthCheck.CanaryHosts, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.CanaryHosts))
+	v.BindPFlag(ViperKeys.HealthCheck.Ping.Count, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Ping.Count))
+	v.BindPFlag(ViperKeys.HealthCheck.Ping.Interval, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Ping.Interval))
+	v.BindPFlag(ViperKeys.HealthCheck.Ping.Timeout, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Ping.Timeout))
+	v.BindPFlag(ViperKeys.HealthCheck.Ping.MaxLoss, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Ping.MaxLoss))
+	v.BindPFlag(ViperKeys.HealthCheck.Ping.MaxRTT, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Ping.MaxRTT))
+	v.BindPFlag(ViperKeys.HealthCheck.Ping.Privileged, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Ping.Privileged))
+	v.BindPFlag(ViperKeys.HealthCheck.Ping.IPVersion, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Ping.IPVersion))
+	v.BindPFlag(ViperKeys.HealthCheck.Timeout, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Timeout))
+	v.BindPFlag(ViperKeys.HealthCheck.Deadline, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Deadline))
+	v.BindPFlag(ViperKeys.HealthCheck.Backoff, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.Backoff))
+	v.BindPFlag(ViperKeys.HealthCheck.MaxBackoff, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.MaxBackoff))
+	v.BindPFlag(ViperKeys.HealthCheck.FailedUnits, rootCmd.PersistentFlags().Lookup(CobraKeys.HealthCheck.FailedUnits))
 	v.BindPFlag(ViperKeys.Hydra.Instance, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Instance))
 	v.BindPFlag(ViperKeys.Hydra.JobSet, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.JobSet))
 	v.BindPFlag(ViperKeys.Hydra.Job, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Job))
 	v.BindPFlag(ViperKeys.Hydra.Project, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Project))
+	v.BindPFlag(ViperKeys.Hydra.Auth.Method, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Auth.Method))
+	v.BindPFlag(ViperKeys.Hydra.Auth.User, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Auth.User))
+	v.BindPFlag(ViperKeys.Hydra.Auth.Header, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Auth.Header))
+	v.BindPFlag(ViperKeys.Hydra.Auth.SecretFile, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Auth.SecretFile))
+	v.BindPFlag(ViperKeys.Hydra.Auth.Credential, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Auth.Credential))
+	v.BindPFlag(ViperKeys.Hydra.Pin.BuildID, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Pin.BuildID))
+	v.BindPFlag(ViperKeys.Hydra.Pin.EvalID, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Pin.EvalID))
+	v.BindPFlag(ViperKeys.Hydra.Pin.Rev, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Pin.Rev))
+	v.BindPFlag(ViperKeys.Hydra.Pin.AllowDowngrade, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Pin.AllowDowngrade))
+	v.BindPFlag(ViperKeys.Hydra.Selection, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Selection))
+	v.BindPFlag(ViperKeys.Hydra.SearchDepth, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.SearchDepth))
+	v.BindPFlag(ViperKeys.Hydra.RequiredJobs, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.RequiredJobs))
+	v.BindPFlag(ViperKeys.Hydra.AggregateJob, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.AggregateJob))
+	v.BindPFlag(ViperKeys.Hydra.Timeout, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Timeout))
+	v.BindPFlag(ViperKeys.Hydra.Deadline, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Deadline))
+	v.BindPFlag(ViperKeys.Hydra.Retries, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Retries))
+	v.BindPFlag(ViperKeys.Hydra.Backoff, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.Backoff))
+	v.BindPFlag(ViperKeys.Hydra.MaxBackoff, rootCmd.PersistentFlags().Lookup(CobraKeys.Hydra.MaxBackoff))
 	v.BindPFlag(ViperKeys.NixBuild.Operation, rootCmd.PersistentFlags().Lookup(CobraKeys.NixBuild.Operation))
+	v.BindPFlag(ViperKeys.NixBuild.Mode, rootCmd.PersistentFlags().Lookup(CobraKeys.NixBuild.Mode))
+	v.BindPFlag(ViperKeys.NixBuild.VerifyOutput, rootCmd.PersistentFlags().Lookup(CobraKeys.NixBuild.VerifyOutput))
+	v.BindPFlag(ViperKeys.NixBuild.SubstituteOnly, rootCmd.PersistentFlags().Lookup(CobraKeys.NixBuild.SubstituteOnly))
 	v.BindPFlag(ViperKeys.NixBuild.Host, rootCmd.PersistentFlags().Lookup(CobraKeys.NixBuild.Host))
 	v.BindPFlag(ViperKeys.NixBuild.Args, rootCmd.PersistentFlags().Lookup(CobraKeys.NixBuild.Args))
+	v.BindPFlag(ViperKeys.Rollback.Enable, rootCmd.PersistentFlags().Lookup(CobraKeys.Rollback.Enable))
+	v.BindPFlag(ViperKeys.Rollback.Window, rootCmd.PersistentFlags().Lookup(CobraKeys.Rollback.Window))
+	v.BindPFlag(ViperKeys.Rollback.Interval, rootCmd.PersistentFlags().Lookup(CobraKeys.Rollback.Interval))
 	v.BindPFlag(ViperKeys.Reboot, rootCmd.PersistentFlags().Lookup(CobraKeys.Reboot))
+	v.BindPFlag(ViperKeys.RebootPolicy.When, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootPolicy.When))
+	v.BindPFlag(ViperKeys.RebootPolicy.Marker, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootPolicy.Marker))
+	v.BindPFlag(ViperKeys.RebootPolicy.WindowStart, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootPolicy.WindowStart))
+	v.BindPFlag(ViperKeys.RebootPolicy.WindowEnd, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootPolicy.WindowEnd))
+	v.BindPFlag(ViperKeys.RebootPolicy.Delay, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootPolicy.Delay))
+	v.BindPFlag(ViperKeys.RebootPolicy.Message, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootPolicy.Message))
+	v.BindPFlag(ViperKeys.RebootLock.Backend, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootLock.Backend))
+	v.BindPFlag(ViperKeys.RebootLock.URL, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootLock.URL))
+	v.BindPFlag(ViperKeys.RebootLock.Path, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootLock.Path))
+	v.BindPFlag(ViperKeys.RebootLock.Slots, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootLock.Slots))
+	v.BindPFlag(ViperKeys.RebootLock.TTL, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootLock.TTL))
+	v.BindPFlag(ViperKeys.RebootLock.Holder, rootCmd.PersistentFlags().Lookup(CobraKeys.RebootLock.Holder))
+	v.BindPFlag(ViperKeys.TrialBoot, rootCmd.PersistentFlags().Lookup(CobraKeys.TrialBoot))
+	v.BindPFlag(ViperKeys.StateDir, rootCmd.PersistentFlags().Lookup(CobraKeys.StateDir))
 
 	config := Config{}
 	// defaults
 	config.Debug = false
+	config.Conditions.ACPower = false
+	config.Conditions.NoSessions = false
+	config.Conditions.MaxLoad = 0
+	config.Conditions.Unmetered = false
+	config.HealthCheck.Ping.Count = 3
+	config.HealthCheck.Ping.Interval = time.Second
+	config.HealthCheck.Ping.Timeout = 0
+	config.HealthCheck.Ping.MaxLoss = 100
+	config.HealthCheck.Ping.MaxRTT = 0
+	config.HealthCheck.Ping.Privileged = false
+	config.HealthCheck.Ping.IPVersion = 0
+	config.HealthCheck.Timeout = 30 * time.Second
+	config.HealthCheck.Deadline = 0
+	config.HealthCheck.Backoff = time.Second
+	config.HealthCheck.MaxBackoff = 30 * time.Second
+	config.HealthCheck.FailedUnits = "off"
+	config.Hydra.Auth.Method = "none"
+	config.Hydra.Selection = "latest"
+	config.Hydra.SearchDepth = 10
+	config.Hydra.StatusPolicy = map[string]string{
+		"unfinished": "skip",
+		"aborted":    "retry",
+		"cancelled":  "skip",
+	}
+	config.Hydra.Timeout = 30 * time.Second
+	config.Hydra.Deadline = 5 * time.Minute
+	config.Hydra.Retries = 3
+	config.Hydra.Backoff = time.Second
+	config.Hydra.MaxBackoff = 30 * time.Second
 	config.NixBuild.Operation = "boot"
+	config.NixBuild.Mode = "eval"
+	config.NixBuild.VerifyOutput = "off"
+	config.NixBuild.SubstituteOnly = false
+	config.Rollback.Enable = false
+	config.Rollback.Window = time.Minute
+	config.Rollback.Interval = 10 * time.Second
 	config.Reboot = false
+	config.RebootPolicy.When = "required"
+	config.RebootPolicy.Marker = "/run/reboot-required"
+	config.RebootPolicy.Delay = 0
+	config.RebootPolicy.Message = "nixos-hydra-upgrade: rebooting into the upgraded system"
+	config.RebootLock.Backend = "none"
+	config.RebootLock.Slots = 1
+	config.RebootLock.TTL = 0
+	config.TrialBoot = false
+	config.StateDir = "/var/lib/nixos-hydra-upgrade"
 
 	err := v.ReadInConfig()
 	if err != nil {
@@ -164,6 +693,10 @@ func InitializeConfig(rootCmd *cobra.Command, args []string) (Config, error) {
 // as long as all validators are valid.
 func (config Config) Validate() error {
 	validate := validator.New(validator.WithRequiredStructEnabled())
+	validate.RegisterStructValidation(validateHydraAuth, HydraAuthConfig{})
+	validate.RegisterStructValidation(validateTrialBoot, Config{})
+	validate.RegisterStructValidation(validateHealthCheckSpec, healthcheck.Spec{})
+	validate.RegisterStructValidation(validateHealthCheckGroups, HealthCheckConfig{})
 	err := validate.Struct(config)
 	if err != nil {
 		return err
@@ -172,6 +705,62 @@ func (config Config) Validate() error {
 	return nil
 }
 
+// Authenticated methods need a secret from either a file or a systemd credential.
+func validateHydraAuth(sl validator.StructLevel) {
+	auth := sl.Current().Interface().(HydraAuthConfig)
+	if auth.Method != "" && auth.Method != "none" && auth.SecretFile == "" && auth.Credential == "" {
+		sl.ReportError(auth.SecretFile, "SecretFile", "SecretFile", "required_without", "Credential")
+	}
+}
+
+// Trial boots set boot loader entries, so only the boot operation may
+// be used.
+func validateTrialBoot(sl validator.StructLevel) {
+	config := sl.Current().Interface().(Config)
+	if config.TrialBoot && config.NixBuild.Operation != "boot" {
+		sl.ReportError(config.TrialBoot, "TrialBoot", "TrialBoot", "excluded_unless", "Operation boot")
+	}
+}
+
+// Health checks must be a registered kind, with valid settings for it.
+func validateHealthCheckSpec(sl validator.StructLevel) {
+	spec := sl.Current().Interface().(healthcheck.Spec)
+	if spec.Kind == "" {
+		return
+	}
+	_, err := healthcheck.New(spec)
+	if errors.Is(err, healthcheck.ErrUnknownKind) {
+		sl.ReportError(spec.Kind, "Kind", "Kind", "oneof", strings.Join(healthcheck.Kinds(), " "))
+	} else if err != nil {
+		sl.ReportError(spec.Settings, "Settings", "Settings", "healthcheck", err.Error())
+	}
+}
+
+// Health check groups must have checks, at least MinPass of them.
+// Canary hosts are checks in group "canary".
+func validateHealthCheckGroups(sl validator.StructLevel) {
+	config := sl.Current().Interface().(HealthCheckConfig)
+	for _, group := range config.Groups {
+		if group.Name == "" {
+			continue
+		}
+		size := 0
+		if group.Name == "canary" {
+			size = len(config.CanaryHosts)
+		}
+		for _, spec := range config.Checks {
+			if spec.Group == group.Name {
+				size++
+			}
+		}
+		if size == 0 {
+			sl.ReportError(group.Name, "Groups", "Groups", "required_checks", group.Name)
+		} else if group.MinPass > size {
+			sl.ReportError(group.MinPass, "Groups", "Groups", "lte", strconv.Itoa(size))
+		}
+	}
+}
+
 // Helper. Transforms a config.ViperKey.* into its corresponding environment variable
 func GetEnv(viperKey string) string {
 	return fmt.Sprintf(
@@ -5,64 +5,252 @@ import (
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd"
 	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
 	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
 )
 
 var (
 	cyaml = []byte(`debug: true
+conditions:
+  ac_power: true
+  no_sessions: true
+  max_load: 2.5
+  unmetered: true
 healthcheck:
   canaryHosts:
     - www.example.com
+  timeout: 10s
+  deadline: 2m
+  backoff: 2s
+  max_backoff: 20s
+  failed_units: abort
+  groups:
+    - name: canary
+      min_pass: 1
+  ping:
+    count: 5
+    interval: 200ms
+    timeout: 3s
+    max_loss: 20
+    max_rtt: 150ms
+    privileged: true
+    ip_version: 6
+  checks:
+    - name: gateway
+      kind: ping
+      timeout: 5s
+      deadline: 1m
+      group: gateways
+      host: 10.0.0.1
 hydra:
   instance: https://hydra.example.com
   project: yaml-config
   jobset: yaml-branch
   job: hosts.yaml
+  auth:
+    method: basic
+    user: yaml-user
+    secret_file: /run/secrets/yaml
+  pin:
+    rev: c717fb0d
+    allow_downgrade: true
+  selection: latest-successful
+  search_depth: 5
+  required_jobs:
+    - tests.yaml
+  aggregate_job: release.yaml
+  status_policy:
+    timed-out: retry
+    cancelled: alert
+  timeout: 15s
+  retries: 0
 nix_build:
   host: yaml
   operation: switch
+  mode: substitute
+  verify_output: warn
+  substitute_only: true
   args:
     - --yaml
-reboot: true`)
+rollback:
+  enable: true
+  window: 5m
+  interval: 30s
+reboot: true
+reboot_policy:
+  when: always
+  marker: /run/yaml-reboot-required
+  window_start: "02:00"
+  window_end: "05:00"
+  delay: 5m
+  message: yaml reboot
+reboot_lock:
+  backend: file
+  path: /mnt/yaml-locks
+  slots: 2
+  ttl: 6h
+  holder: yaml-host
+trial_boot: true
+state_dir: /var/lib/yaml`)
 	cenv = config.Config{
 		Debug: true,
+		Conditions: config.ConditionsConfig{
+			ACPower:    true,
+			NoSessions: false,
+			MaxLoad:    4,
+			Unmetered:  true,
+		},
 		HealthCheck: config.HealthCheckConfig{
 			CanaryHosts: []string{"env-canary1.example.com", "env-canary2.example.com"},
+			Ping: config.PingConfig{
+				Count:      4,
+				Interval:   500 * time.Millisecond,
+				Timeout:    5 * time.Second,
+				MaxLoss:    25,
+				MaxRTT:     100 * time.Millisecond,
+				Privileged: true,
+				IPVersion:  4,
+			},
+			Timeout:     20 * time.Second,
+			Deadline:    time.Minute,
+			Backoff:     500 * time.Millisecond,
+			MaxBackoff:  10 * time.Second,
+			FailedUnits: "continue",
+			Checks: []healthcheck.Spec{
+				{Name: "gateway", Kind: "ping", Settings: map[string]any{"host": "10.0.0.1"}},
+			},
+			Groups: []healthcheck.Group{
+				{Name: "canary", MinPass: 1},
+			},
 		},
 		Hydra: config.HydraConfig{
 			Instance: "https://env-hydra.example.com",
 			JobSet:   "env-branch",
 			Job:      "hosts.env",
 			Project:  "env-config",
+			Auth: config.HydraAuthConfig{
+				Method:     "session",
+				User:       "env-user",
+				Credential: "env-credential",
+			},
+			Selection:    "latest-successful",
+			SearchDepth:  20,
+			RequiredJobs: []string{"tests.env1", "tests.env2"},
+			AggregateJob: "release.env",
+			Timeout:      10 * time.Second,
+			Deadline:     time.Minute,
+			Retries:      5,
+			Backoff:      2 * time.Second,
+			MaxBackoff:   20 * time.Second,
 		},
 		NixBuild: config.NixBuildConfig{
-			Args:      []string{"--env1", "--env2"},
-			Host:      "env",
-			Operation: "switch",
+			Args:           []string{"--env1", "--env2"},
+			Host:           "env",
+			Operation:      "switch",
+			Mode:           "substitute",
+			VerifyOutput:   "off",
+			SubstituteOnly: true,
+		},
+		Rollback: config.RollbackConfig{
+			Enable:   true,
+			Window:   2 * time.Minute,
+			Interval: 5 * time.Second,
 		},
 		Reboot: true,
+		RebootPolicy: config.RebootPolicyConfig{
+			When:        "always",
+			Marker:      "/run/env-reboot-required",
+			WindowStart: "22:00",
+			WindowEnd:   "04:00",
+			Delay:       10 * time.Minute,
+			Message:     "env reboot",
+		},
+		RebootLock: config.RebootLockConfig{
+			Backend: "http",
+			URL:     "https://env-leases.example.com",
+			Slots:   3,
+			TTL:     time.Hour,
+			Holder:  "env-host",
+		},
+		StateDir: "/var/lib/env",
 	}
 	cflag = config.Config{
 		Debug: true,
+		Conditions: config.ConditionsConfig{
+			ACPower:    true,
+			NoSessions: true,
+			MaxLoad:    1.5,
+			Unmetered:  false,
+		},
 		HealthCheck: config.HealthCheckConfig{
 			CanaryHosts: []string{"flag-canary1.example.com", "flag-canary2.example.com"},
+			Ping: config.PingConfig{
+				Count:      2,
+				Interval:   250 * time.Millisecond,
+				Timeout:    2 * time.Second,
+				MaxLoss:    50,
+				MaxRTT:     80 * time.Millisecond,
+				Privileged: true,
+				IPVersion:  6,
+			},
+			Timeout:     15 * time.Second,
+			Deadline:    3 * time.Minute,
+			Backoff:     250 * time.Millisecond,
+			MaxBackoff:  5 * time.Second,
+			FailedUnits: "abort",
 		},
 		Hydra: config.HydraConfig{
 			Instance: "https://flag-hydra.example.com",
 			JobSet:   "flag-branch",
 			Job:      "hosts.flag",
 			Project:  "flag-config",
+			Auth: config.HydraAuthConfig{
+				Method:     "header",
+				Header:     "X-Flag-Token",
+				SecretFile: "/run/secrets/flag",
+			},
+			Pin: config.HydraPinConfig{
+				BuildID:        1234,
+				AllowDowngrade: true,
+			},
+			Selection:   "latest-finished",
+			SearchDepth: 10,
 		},
 		NixBuild: config.NixBuildConfig{
-			Args:      []string{"--flag1", "--flag2"},
-			Host:      "flag",
-			Operation: "switch",
+			Args:           []string{"--flag1", "--flag2"},
+			Host:           "flag",
+			Operation:      "switch",
+			Mode:           "eval",
+			VerifyOutput:   "fail",
+			SubstituteOnly: true,
+		},
+		Rollback: config.RollbackConfig{
+			Enable:   true,
+			Window:   0,
+			Interval: 10 * time.Second,
 		},
 		Reboot: true,
+		RebootPolicy: config.RebootPolicyConfig{
+			When:        "always",
+			Marker:      "/run/flag-reboot-required",
+			WindowStart: "01:00",
+			WindowEnd:   "03:30",
+			Delay:       time.Minute,
+			Message:     "flag reboot",
+		},
+		RebootLock: config.RebootLockConfig{
+			Backend: "file",
+			Path:    "/mnt/flag-locks",
+			Slots:   4,
+			TTL:     30 * time.Minute,
+			Holder:  "flag-host",
+		},
+		StateDir: "/var/lib/flag",
 	}
 )
 
@@ -75,8 +263,58 @@ func TestInitializeConfig(t *testing.T) {
 		}
 
 		assert.Equal(t, c.Debug, false)
+		assert.Equal(t, c.Conditions.ACPower, false)
+		assert.Equal(t, c.Conditions.NoSessions, false)
+		assert.Equal(t, c.Conditions.MaxLoad, 0)
+		assert.Equal(t, c.Conditions.Unmetered, false)
+		assert.Equal(t, c.HealthCheck.Ping.Count, 3)
+		assert.Equal(t, c.HealthCheck.Ping.Interval, time.Second)
+		assert.Equal(t, c.HealthCheck.Ping.Timeout, 0)
+		assert.Equal(t, c.HealthCheck.Ping.MaxLoss, 100)
+		assert.Equal(t, c.HealthCheck.Ping.MaxRTT, 0)
+		assert.Equal(t, c.HealthCheck.Ping.Privileged, false)
+		assert.Equal(t, c.HealthCheck.Ping.IPVersion, 0)
+		assert.Equal(t, c.HealthCheck.Timeout, 30*time.Second)
+		assert.Equal(t, c.HealthCheck.Deadline, 0)
+		assert.Equal(t, c.HealthCheck.Backoff, time.Second)
+		assert.Equal(t, c.HealthCheck.MaxBackoff, 30*time.Second)
+		assert.Equal(t, len(c.HealthCheck.Groups), 0)
+		assert.Equal(t, c.HealthCheck.FailedUnits, "off")
+		assert.Equal(t, len(c.HealthCheck.Checks), 0)
+		assert.Equal(t, c.Hydra.Auth.Method, "none")
+		assert.Equal(t, c.Hydra.Selection, "latest")
+		assert.Equal(t, c.Hydra.SearchDepth, 10)
+		assert.Equal(t, len(c.Hydra.StatusPolicy), 3)
+		assert.Equal(t, c.Hydra.StatusPolicy["unfinished"], "skip")
+		assert.Equal(t, c.Hydra.StatusPolicy["aborted"], "retry")
+		assert.Equal(t, c.Hydra.StatusPolicy["cancelled"], "skip")
+		assert.Equal(t, c.Hydra.Timeout, 30*time.Second)
+		assert.Equal(t, c.Hydra.Deadline, 5*time.Minute)
+		assert.Equal(t, c.Hydra.Retries, 3)
+		assert.Equal(t, c.Hydra.Backoff, time.Second)
+		assert.Equal(t, c.Hydra.MaxBackoff, 30*time.Second)
 		assert.Equal(t, c.NixBuild.Operation, "boot")
+		assert.Equal(t, c.NixBuild.Mode, "eval")
+		assert.Equal(t, c.NixBuild.VerifyOutput, "off")
+		assert.Equal(t, c.NixBuild.SubstituteOnly, false)
+		assert.Equal(t, c.Rollback.Enable, false)
+		assert.Equal(t, c.Rollback.Window, time.Minute)
+		assert.Equal(t, c.Rollback.Interval, 10*time.Second)
 		assert.Equal(t, c.Reboot, false)
+		assert.Equal(t, c.RebootPolicy.When, "required")
+		assert.Equal(t, c.RebootPolicy.Marker, "/run/reboot-required")
+		assert.Equal(t, c.RebootPolicy.WindowStart, "")
+		assert.Equal(t, c.RebootPolicy.WindowEnd, "")
+		assert.Equal(t, c.RebootPolicy.Delay, time.Duration(0))
+		assert.Equal(t, c.RebootPolicy.Message, "nixos-hydra-upgrade: rebooting into the upgraded system")
+		assert.Equal(t, c.RebootLock.Backend, "none")
+		assert.Equal(t, c.RebootLock.URL, "")
+		assert.Equal(t, c.RebootLock.Path, "")
+		assert.Equal(t, c.RebootLock.Slots, 1)
+		assert.Equal(t, c.RebootLock.TTL, time.Duration(0))
+		assert.Equal(t, c.RebootLock.Holder, "")
+		assert.Equal(t, c.TrialBoot, false)
+		assert.Equal(t, c.StateDir, "/var/lib/nixos-hydra-upgrade")
 	})
 
 	t.Run("initialize config from yaml file", func(t *testing.T) {
@@ -98,28 +336,133 @@ func TestInitializeConfig(t *testing.T) {
 		}
 
 		assert.Equal(t, c.Debug, true)
+		assert.Equal(t, c.Conditions.ACPower, true)
+		assert.Equal(t, c.Conditions.NoSessions, true)
+		assert.Equal(t, c.Conditions.MaxLoad, 2.5)
+		assert.Equal(t, c.Conditions.Unmetered, true)
 		assert.ArrayEqual(t, c.HealthCheck.CanaryHosts, []string{"www.example.com"})
+		assert.Equal(t, c.HealthCheck.Ping.Count, 5)
+		assert.Equal(t, c.HealthCheck.Ping.Interval, 200*time.Millisecond)
+		assert.Equal(t, c.HealthCheck.Ping.Timeout, 3*time.Second)
+		assert.Equal(t, c.HealthCheck.Ping.MaxLoss, 20)
+		assert.Equal(t, c.HealthCheck.Ping.MaxRTT, 150*time.Millisecond)
+		assert.Equal(t, c.HealthCheck.Ping.Privileged, true)
+		assert.Equal(t, c.HealthCheck.Ping.IPVersion, 6)
+		assert.Equal(t, c.HealthCheck.Timeout, 10*time.Second)
+		assert.Equal(t, c.HealthCheck.Deadline, 2*time.Minute)
+		assert.Equal(t, c.HealthCheck.Backoff, 2*time.Second)
+		assert.Equal(t, c.HealthCheck.MaxBackoff, 20*time.Second)
+		assert.Equal(t, c.HealthCheck.FailedUnits, "abort")
+		assert.ArrayEqual(t, c.HealthCheck.Groups, []healthcheck.Group{{Name: "canary", MinPass: 1}})
+		assert.Equal(t, len(c.HealthCheck.Checks), 1)
+		assert.Equal(t, c.HealthCheck.Checks[0].Name, "gateway")
+		assert.Equal(t, c.HealthCheck.Checks[0].Kind, "ping")
+		assert.Equal(t, c.HealthCheck.Checks[0].Timeout, 5*time.Second)
+		assert.Equal(t, c.HealthCheck.Checks[0].Deadline, time.Minute)
+		assert.Equal(t, c.HealthCheck.Checks[0].Group, "gateways")
+		assert.Equal(t, len(c.HealthCheck.Checks[0].Settings), 1)
+		assert.Equal(t, c.HealthCheck.Checks[0].Settings["host"], any("10.0.0.1"))
 		assert.Equal(t, c.Hydra.Instance, "https://hydra.example.com")
 		assert.Equal(t, c.Hydra.Job, "hosts.yaml")
 		assert.Equal(t, c.Hydra.JobSet, "yaml-branch")
 		assert.Equal(t, c.Hydra.Project, "yaml-config")
+		assert.Equal(t, c.Hydra.Auth.Method, "basic")
+		assert.Equal(t, c.Hydra.Auth.User, "yaml-user")
+		assert.Equal(t, c.Hydra.Auth.SecretFile, "/run/secrets/yaml")
+		assert.Equal(t, c.Hydra.Pin.Rev, "c717fb0d")
+		assert.Equal(t, c.Hydra.Pin.AllowDowngrade, true)
+		assert.Equal(t, c.Hydra.Selection, "latest-successful")
+		assert.Equal(t, c.Hydra.SearchDepth, 5)
+		assert.ArrayEqual(t, c.Hydra.RequiredJobs, []string{"tests.yaml"})
+		assert.Equal(t, c.Hydra.AggregateJob, "release.yaml")
+		assert.Equal(t, c.Hydra.StatusPolicy["timed-out"], "retry")
+		assert.Equal(t, c.Hydra.StatusPolicy["cancelled"], "alert")
+		assert.Equal(t, c.Hydra.StatusPolicy["unfinished"], "skip")
+		assert.Equal(t, c.Hydra.Timeout, 15*time.Second)
+		assert.Equal(t, c.Hydra.Retries, 0)
 		assert.ArrayEqual(t, c.NixBuild.Args, []string{"--yaml"})
 		assert.Equal(t, c.NixBuild.Host, "yaml")
 		assert.Equal(t, c.NixBuild.Operation, "switch")
+		assert.Equal(t, c.NixBuild.Mode, "substitute")
+		assert.Equal(t, c.NixBuild.VerifyOutput, "warn")
+		assert.Equal(t, c.NixBuild.SubstituteOnly, true)
+		assert.Equal(t, c.Rollback.Enable, true)
+		assert.Equal(t, c.Rollback.Window, 5*time.Minute)
+		assert.Equal(t, c.Rollback.Interval, 30*time.Second)
 		assert.Equal(t, c.Reboot, true)
+		assert.Equal(t, c.RebootPolicy.When, "always")
+		assert.Equal(t, c.RebootPolicy.Marker, "/run/yaml-reboot-required")
+		assert.Equal(t, c.RebootPolicy.WindowStart, "02:00")
+		assert.Equal(t, c.RebootPolicy.WindowEnd, "05:00")
+		assert.Equal(t, c.RebootPolicy.Delay, 5*time.Minute)
+		assert.Equal(t, c.RebootPolicy.Message, "yaml reboot")
+		assert.Equal(t, c.RebootLock.Backend, "file")
+		assert.Equal(t, c.RebootLock.Path, "/mnt/yaml-locks")
+		assert.Equal(t, c.RebootLock.Slots, 2)
+		assert.Equal(t, c.RebootLock.TTL, 6*time.Hour)
+		assert.Equal(t, c.RebootLock.Holder, "yaml-host")
+		assert.Equal(t, c.TrialBoot, true)
+		assert.Equal(t, c.StateDir, "/var/lib/yaml")
 	})
 
 	t.Run("initialize config from env", func(t *testing.T) {
 		t.Setenv("NHU_DEBUG", strconv.FormatBool(cenv.Debug))
+		t.Setenv("NHU_CONDITIONS_AC_POWER", strconv.FormatBool(cenv.Conditions.ACPower))
+		t.Setenv("NHU_CONDITIONS_NO_SESSIONS", strconv.FormatBool(cenv.Conditions.NoSessions))
+		t.Setenv("NHU_CONDITIONS_MAX_LOAD", strconv.FormatFloat(cenv.Conditions.MaxLoad, 'f', -1, 64))
+		t.Setenv("NHU_CONDITIONS_UNMETERED", strconv.FormatBool(cenv.Conditions.Unmetered))
 		t.Setenv("NHU_HEALTHCHECK_CANARYHOSTS", fmt.Sprintf("%v,%v", cenv.HealthCheck.CanaryHosts[0], cenv.HealthCheck.CanaryHosts[1]))
+		t.Setenv("NHU_HEALTHCHECK_PING_COUNT", strconv.Itoa(cenv.HealthCheck.Ping.Count))
+		t.Setenv("NHU_HEALTHCHECK_PING_INTERVAL", cenv.HealthCheck.Ping.Interval.String())
+		t.Setenv("NHU_HEALTHCHECK_PING_TIMEOUT", cenv.HealthCheck.Ping.Timeout.String())
+		t.Setenv("NHU_HEALTHCHECK_PING_MAX_LOSS", strconv.FormatFloat(cenv.HealthCheck.Ping.MaxLoss, 'f', -1, 64))
+		t.Setenv("NHU_HEALTHCHECK_PING_MAX_RTT", cenv.HealthCheck.Ping.MaxRTT.String())
+		t.Setenv("NHU_HEALTHCHECK_PING_PRIVILEGED", strconv.FormatBool(cenv.HealthCheck.Ping.Privileged))
+		t.Setenv("NHU_HEALTHCHECK_PING_IP_VERSION", strconv.Itoa(cenv.HealthCheck.Ping.IPVersion))
+		t.Setenv("NHU_HEALTHCHECK_TIMEOUT", cenv.HealthCheck.Timeout.String())
+		t.Setenv("NHU_HEALTHCHECK_DEADLINE", cenv.HealthCheck.Deadline.String())
+		t.Setenv("NHU_HEALTHCHECK_BACKOFF", cenv.HealthCheck.Backoff.String())
+		t.Setenv("NHU_HEALTHCHECK_MAX_BACKOFF", cenv.HealthCheck.MaxBackoff.String())
+		t.Setenv("NHU_HEALTHCHECK_FAILED_UNITS", cenv.HealthCheck.FailedUnits)
 		t.Setenv("NHU_HYDRA_INSTANCE", cenv.Hydra.Instance)
 		t.Setenv("NHU_HYDRA_JOBSET", cenv.Hydra.JobSet)
 		t.Setenv("NHU_HYDRA_JOB", cenv.Hydra.Job)
 		t.Setenv("NHU_HYDRA_PROJECT", cenv.Hydra.Project)
+		t.Setenv("NHU_HYDRA_AUTH_METHOD", cenv.Hydra.Auth.Method)
+		t.Setenv("NHU_HYDRA_AUTH_USER", cenv.Hydra.Auth.User)
+		t.Setenv("NHU_HYDRA_AUTH_CREDENTIAL", cenv.Hydra.Auth.Credential)
+		t.Setenv("NHU_HYDRA_SELECTION", cenv.Hydra.Selection)
+		t.Setenv("NHU_HYDRA_SEARCH_DEPTH", strconv.Itoa(cenv.Hydra.SearchDepth))
+		t.Setenv("NHU_HYDRA_REQUIRED_JOBS", fmt.Sprintf("%v,%v", cenv.Hydra.RequiredJobs[0], cenv.Hydra.RequiredJobs[1]))
+		t.Setenv("NHU_HYDRA_AGGREGATE_JOB", cenv.Hydra.AggregateJob)
+		t.Setenv("NHU_HYDRA_TIMEOUT", cenv.Hydra.Timeout.String())
+		t.Setenv("NHU_HYDRA_DEADLINE", cenv.Hydra.Deadline.String())
+		t.Setenv("NHU_HYDRA_RETRIES", strconv.Itoa(cenv.Hydra.Retries))
+		t.Setenv("NHU_HYDRA_BACKOFF", cenv.Hydra.Backoff.String())
+		t.Setenv("NHU_HYDRA_MAX_BACKOFF", cenv.Hydra.MaxBackoff.String())
 		t.Setenv("NHU_NIX_BUILD_ARGS", fmt.Sprintf("%v,%v", cenv.NixBuild.Args[0], cenv.NixBuild.Args[1]))
 		t.Setenv("NHU_NIX_BUILD_HOST", cenv.NixBuild.Host)
 		t.Setenv("NHU_NIX_BUILD_OPERATION", cenv.NixBuild.Operation)
+		t.Setenv("NHU_NIX_BUILD_MODE", cenv.NixBuild.Mode)
+		t.Setenv("NHU_NIX_BUILD_VERIFY_OUTPUT", cenv.NixBuild.VerifyOutput)
+		t.Setenv("NHU_NIX_BUILD_SUBSTITUTE_ONLY", strconv.FormatBool(cenv.NixBuild.SubstituteOnly))
+		t.Setenv("NHU_ROLLBACK_ENABLE", strconv.FormatBool(cenv.Rollback.Enable))
+		t.Setenv("NHU_ROLLBACK_WINDOW", cenv.Rollback.Window.String())
+		t.Setenv("NHU_ROLLBACK_INTERVAL", cenv.Rollback.Interval.String())
 		t.Setenv("NHU_REBOOT", strconv.FormatBool(cenv.Reboot))
+		t.Setenv("NHU_REBOOT_POLICY_WHEN", cenv.RebootPolicy.When)
+		t.Setenv("NHU_REBOOT_POLICY_MARKER", cenv.RebootPolicy.Marker)
+		t.Setenv("NHU_REBOOT_POLICY_WINDOW_START", cenv.RebootPolicy.WindowStart)
+		t.Setenv("NHU_REBOOT_POLICY_WINDOW_END", cenv.RebootPolicy.WindowEnd)
+		t.Setenv("NHU_REBOOT_POLICY_DELAY", cenv.RebootPolicy.Delay.String())
+		t.Setenv("NHU_REBOOT_POLICY_MESSAGE", cenv.RebootPolicy.Message)
+		t.Setenv("NHU_REBOOT_LOCK_BACKEND", cenv.RebootLock.Backend)
+		t.Setenv("NHU_REBOOT_LOCK_URL", cenv.RebootLock.URL)
+		t.Setenv("NHU_REBOOT_LOCK_SLOTS", strconv.Itoa(cenv.RebootLock.Slots))
+		t.Setenv("NHU_REBOOT_LOCK_TTL", cenv.RebootLock.TTL.String())
+		t.Setenv("NHU_REBOOT_LOCK_HOLDER", cenv.RebootLock.Holder)
+		t.Setenv("NHU_TRIAL_BOOT", strconv.FormatBool(cenv.TrialBoot))
+		t.Setenv("NHU_STATE_DIR", cenv.StateDir)
 
 		cmd := cmd.NewRootCmd()
 		c, err := config.InitializeConfig(cmd, []string{})
@@ -128,15 +471,56 @@ func TestInitializeConfig(t *testing.T) {
 		}
 
 		assert.Equal(t, c.Debug, cenv.Debug)
+		assert.Equal(t, c.Conditions.ACPower, cenv.Conditions.ACPower)
+		assert.Equal(t, c.Conditions.NoSessions, cenv.Conditions.NoSessions)
+		assert.Equal(t, c.Conditions.MaxLoad, cenv.Conditions.MaxLoad)
+		assert.Equal(t, c.Conditions.Unmetered, cenv.Conditions.Unmetered)
 		assert.ArrayEqual(t, c.HealthCheck.CanaryHosts, cenv.HealthCheck.CanaryHosts)
+		assert.Equal(t, c.HealthCheck.Ping, cenv.HealthCheck.Ping)
+		assert.Equal(t, c.HealthCheck.Timeout, cenv.HealthCheck.Timeout)
+		assert.Equal(t, c.HealthCheck.Deadline, cenv.HealthCheck.Deadline)
+		assert.Equal(t, c.HealthCheck.Backoff, cenv.HealthCheck.Backoff)
+		assert.Equal(t, c.HealthCheck.MaxBackoff, cenv.HealthCheck.MaxBackoff)
+		assert.Equal(t, c.HealthCheck.FailedUnits, cenv.HealthCheck.FailedUnits)
 		assert.Equal(t, c.Hydra.Instance, cenv.Hydra.Instance)
 		assert.Equal(t, c.Hydra.Job, cenv.Hydra.Job)
 		assert.Equal(t, c.Hydra.JobSet, cenv.Hydra.JobSet)
 		assert.Equal(t, c.Hydra.Project, cenv.Hydra.Project)
+		assert.Equal(t, c.Hydra.Auth.Method, cenv.Hydra.Auth.Method)
+		assert.Equal(t, c.Hydra.Auth.User, cenv.Hydra.Auth.User)
+		assert.Equal(t, c.Hydra.Auth.Credential, cenv.Hydra.Auth.Credential)
+		assert.Equal(t, c.Hydra.Selection, cenv.Hydra.Selection)
+		assert.Equal(t, c.Hydra.SearchDepth, cenv.Hydra.SearchDepth)
+		assert.ArrayEqual(t, c.Hydra.RequiredJobs, cenv.Hydra.RequiredJobs)
+		assert.Equal(t, c.Hydra.AggregateJob, cenv.Hydra.AggregateJob)
+		assert.Equal(t, c.Hydra.Timeout, cenv.Hydra.Timeout)
+		assert.Equal(t, c.Hydra.Deadline, cenv.Hydra.Deadline)
+		assert.Equal(t, c.Hydra.Retries, cenv.Hydra.Retries)
+		assert.Equal(t, c.Hydra.Backoff, cenv.Hydra.Backoff)
+		assert.Equal(t, c.Hydra.MaxBackoff, cenv.Hydra.MaxBackoff)
 		assert.ArrayEqual(t, c.NixBuild.Args, cenv.NixBuild.Args)
 		assert.Equal(t, c.NixBuild.Host, cenv.NixBuild.Host)
 		assert.Equal(t, c.NixBuild.Operation, cenv.NixBuild.Operation)
+		assert.Equal(t, c.NixBuild.Mode, cenv.NixBuild.Mode)
+		assert.Equal(t, c.NixBuild.VerifyOutput, cenv.NixBuild.VerifyOutput)
+		assert.Equal(t, c.NixBuild.SubstituteOnly, cenv.NixBuild.SubstituteOnly)
+		assert.Equal(t, c.Rollback.Enable, cenv.Rollback.Enable)
+		assert.Equal(t, c.Rollback.Window, cenv.Rollback.Window)
+		assert.Equal(t, c.Rollback.Interval, cenv.Rollback.Interval)
 		assert.Equal(t, c.Reboot, cenv.Reboot)
+		assert.Equal(t, c.RebootPolicy.When, cenv.RebootPolicy.When)
+		assert.Equal(t, c.RebootPolicy.Marker, cenv.RebootPolicy.Marker)
+		assert.Equal(t, c.RebootPolicy.WindowStart, cenv.RebootPolicy.WindowStart)
+		assert.Equal(t, c.RebootPolicy.WindowEnd, cenv.RebootPolicy.WindowEnd)
+		assert.Equal(t, c.RebootPolicy.Delay, cenv.RebootPolicy.Delay)
+		assert.Equal(t, c.RebootPolicy.Message, cenv.RebootPolicy.Message)
+		assert.Equal(t, c.RebootLock.Backend, cenv.RebootLock.Backend)
+		assert.Equal(t, c.RebootLock.URL, cenv.RebootLock.URL)
+		assert.Equal(t, c.RebootLock.Slots, cenv.RebootLock.Slots)
+		assert.Equal(t, c.RebootLock.TTL, cenv.RebootLock.TTL)
+		assert.Equal(t, c.RebootLock.Holder, cenv.RebootLock.Holder)
+		assert.Equal(t, c.TrialBoot, cenv.TrialBoot)
+		assert.Equal(t, c.StateDir, cenv.StateDir)
 	})
 
 	t.Run("environment variables override yaml config", func(t *testing.T) {
@@ -168,10 +552,37 @@ func TestInitializeConfig(t *testing.T) {
 		cmd := cmd.NewRootCmd()
 		err := cmd.ParseFlags([]string{
 			"--debug",
+			"--condition-ac-power",
+			"--condition-no-sessions",
+			"--condition-max-load",
+			strconv.FormatFloat(cflag.Conditions.MaxLoad, 'f', -1, 64),
 			"--canary",
 			cflag.HealthCheck.CanaryHosts[0],
 			"--canary",
 			cflag.HealthCheck.CanaryHosts[1],
+			"--ping-count",
+			strconv.Itoa(cflag.HealthCheck.Ping.Count),
+			"--ping-interval",
+			cflag.HealthCheck.Ping.Interval.String(),
+			"--ping-timeout",
+			cflag.HealthCheck.Ping.Timeout.String(),
+			"--ping-max-loss",
+			strconv.FormatFloat(cflag.HealthCheck.Ping.MaxLoss, 'f', -1, 64),
+			"--ping-max-rtt",
+			cflag.HealthCheck.Ping.MaxRTT.String(),
+			"--ping-privileged",
+			"--ping-ip-version",
+			strconv.Itoa(cflag.HealthCheck.Ping.IPVersion),
+			"--healthcheck-timeout",
+			cflag.HealthCheck.Timeout.String(),
+			"--healthcheck-deadline",
+			cflag.HealthCheck.Deadline.String(),
+			"--healthcheck-backoff",
+			cflag.HealthCheck.Backoff.String(),
+			"--healthcheck-max-backoff",
+			cflag.HealthCheck.MaxBackoff.String(),
+			"--failed-units",
+			cflag.HealthCheck.FailedUnits,
 			"--instance",
 			cflag.Hydra.Instance,
 			"--job",
@@ -180,11 +591,54 @@ func TestInitializeConfig(t *testing.T) {
 			cflag.Hydra.JobSet,
 			"--project",
 			cflag.Hydra.Project,
+			"--hydra-auth",
+			cflag.Hydra.Auth.Method,
+			"--hydra-header",
+			cflag.Hydra.Auth.Header,
+			"--hydra-secret-file",
+			cflag.Hydra.Auth.SecretFile,
+			"--hydra-selection",
+			cflag.Hydra.Selection,
+			"--build-id",
+			strconv.Itoa(cflag.Hydra.Pin.BuildID),
+			"--allow-downgrade",
 			"--passthru-args",
 			fmt.Sprintf("%v,%v", cflag.NixBuild.Args[0], cflag.NixBuild.Args[1]),
 			"--host",
 			cflag.NixBuild.Host,
+			"--mode",
+			cflag.NixBuild.Mode,
+			"--verify-output",
+			cflag.NixBuild.VerifyOutput,
+			"--substitute-only",
+			"--rollback",
+			"--rollback-window",
+			cflag.Rollback.Window.String(),
 			"--reboot",
+			"--reboot-when",
+			cflag.RebootPolicy.When,
+			"--reboot-marker",
+			cflag.RebootPolicy.Marker,
+			"--reboot-window-start",
+			cflag.RebootPolicy.WindowStart,
+			"--reboot-window-end",
+			cflag.RebootPolicy.WindowEnd,
+			"--reboot-delay",
+			cflag.RebootPolicy.Delay.String(),
+			"--reboot-message",
+			cflag.RebootPolicy.Message,
+			"--reboot-lock-backend",
+			cflag.RebootLock.Backend,
+			"--reboot-lock-path",
+			cflag.RebootLock.Path,
+			"--reboot-lock-slots",
+			strconv.Itoa(cflag.RebootLock.Slots),
+			"--reboot-lock-ttl",
+			cflag.RebootLock.TTL.String(),
+			"--reboot-lock-holder",
+			cflag.RebootLock.Holder,
+			"--state-dir",
+			cflag.StateDir,
 		})
 		if err != nil {
 			panic(err)
@@ -195,15 +649,50 @@ func TestInitializeConfig(t *testing.T) {
 		}
 
 		assert.Equal(t, c.Debug, cflag.Debug)
+		assert.Equal(t, c.Conditions.ACPower, cflag.Conditions.ACPower)
+		assert.Equal(t, c.Conditions.NoSessions, cflag.Conditions.NoSessions)
+		assert.Equal(t, c.Conditions.MaxLoad, cflag.Conditions.MaxLoad)
+		assert.Equal(t, c.Conditions.Unmetered, cflag.Conditions.Unmetered)
 		assert.ArrayEqual(t, c.HealthCheck.CanaryHosts, cflag.HealthCheck.CanaryHosts)
+		assert.Equal(t, c.HealthCheck.Ping, cflag.HealthCheck.Ping)
+		assert.Equal(t, c.HealthCheck.Timeout, cflag.HealthCheck.Timeout)
+		assert.Equal(t, c.HealthCheck.Deadline, cflag.HealthCheck.Deadline)
+		assert.Equal(t, c.HealthCheck.Backoff, cflag.HealthCheck.Backoff)
+		assert.Equal(t, c.HealthCheck.MaxBackoff, cflag.HealthCheck.MaxBackoff)
+		assert.Equal(t, c.HealthCheck.FailedUnits, cflag.HealthCheck.FailedUnits)
 		assert.Equal(t, c.Hydra.Instance, cflag.Hydra.Instance)
 		assert.Equal(t, c.Hydra.Job, cflag.Hydra.Job)
 		assert.Equal(t, c.Hydra.JobSet, cflag.Hydra.JobSet)
 		assert.Equal(t, c.Hydra.Project, cflag.Hydra.Project)
+		assert.Equal(t, c.Hydra.Auth.Method, cflag.Hydra.Auth.Method)
+		assert.Equal(t, c.Hydra.Auth.Header, cflag.Hydra.Auth.Header)
+		assert.Equal(t, c.Hydra.Auth.SecretFile, cflag.Hydra.Auth.SecretFile)
+		assert.Equal(t, c.Hydra.Selection, cflag.Hydra.Selection)
+		assert.Equal(t, c.Hydra.Pin.BuildID, cflag.Hydra.Pin.BuildID)
+		assert.Equal(t, c.Hydra.Pin.AllowDowngrade, cflag.Hydra.Pin.AllowDowngrade)
 		assert.ArrayEqual(t, c.NixBuild.Args, cflag.NixBuild.Args)
 		assert.Equal(t, c.NixBuild.Host, cflag.NixBuild.Host)
 		assert.Equal(t, c.NixBuild.Operation, cflag.NixBuild.Operation)
+		assert.Equal(t, c.NixBuild.Mode, cflag.NixBuild.Mode)
+		assert.Equal(t, c.NixBuild.VerifyOutput, cflag.NixBuild.VerifyOutput)
+		assert.Equal(t, c.NixBuild.SubstituteOnly, cflag.NixBuild.SubstituteOnly)
+		assert.Equal(t, c.Rollback.Enable, cflag.Rollback.Enable)
+		assert.Equal(t, c.Rollback.Window, cflag.Rollback.Window)
+		assert.Equal(t, c.Rollback.Interval, cflag.Rollback.Interval)
 		assert.Equal(t, c.Reboot, cflag.Reboot)
+		assert.Equal(t, c.RebootPolicy.When, cflag.RebootPolicy.When)
+		assert.Equal(t, c.RebootPolicy.Marker, cflag.RebootPolicy.Marker)
+		assert.Equal(t, c.RebootPolicy.WindowStart, cflag.RebootPolicy.WindowStart)
+		assert.Equal(t, c.RebootPolicy.WindowEnd, cflag.RebootPolicy.WindowEnd)
+		assert.Equal(t, c.RebootPolicy.Delay, cflag.RebootPolicy.Delay)
+		assert.Equal(t, c.RebootPolicy.Message, cflag.RebootPolicy.Message)
+		assert.Equal(t, c.RebootLock.Backend, cflag.RebootLock.Backend)
+		assert.Equal(t, c.RebootLock.Path, cflag.RebootLock.Path)
+		assert.Equal(t, c.RebootLock.Slots, cflag.RebootLock.Slots)
+		assert.Equal(t, c.RebootLock.TTL, cflag.RebootLock.TTL)
+		assert.Equal(t, c.RebootLock.Holder, cflag.RebootLock.Holder)
+		assert.Equal(t, c.TrialBoot, cflag.TrialBoot)
+		assert.Equal(t, c.StateDir, cflag.StateDir)
 	})
 
 	t.Run("flags override environment variables and yaml config", func(t *testing.T) {
@@ -245,6 +734,12 @@ func cloneConfig(c config.Config) config.Config {
 	c2 := c
 	c2.HealthCheck.CanaryHosts = []string{}
 	c2.HealthCheck.CanaryHosts = append(c2.HealthCheck.CanaryHosts, c.HealthCheck.CanaryHosts...)
+	c2.HealthCheck.Checks = []healthcheck.Spec{}
+	c2.HealthCheck.Checks = append(c2.HealthCheck.Checks, c.HealthCheck.Checks...)
+	c2.HealthCheck.Groups = []healthcheck.Group{}
+	c2.HealthCheck.Groups = append(c2.HealthCheck.Groups, c.HealthCheck.Groups...)
+	c2.Hydra.RequiredJobs = []string{}
+	c2.Hydra.RequiredJobs = append(c2.Hydra.RequiredJobs, c.Hydra.RequiredJobs...)
 	c2.NixBuild.Args = []string{}
 	c2.NixBuild.Args = append(c2.NixBuild.Args, c.NixBuild.Args...)
 
@@ -263,6 +758,7 @@ func TestValidate(t *testing.T) {
 	t.Run("required config passes validation without errors", func(t *testing.T) {
 		c := cloneConfig(cenv)
 		c.HealthCheck.CanaryHosts = []string{}
+		c.HealthCheck.Groups = []healthcheck.Group{}
 		c.NixBuild.Args = []string{}
 
 		err := c.Validate()
@@ -285,29 +781,205 @@ func TestValidate(t *testing.T) {
 	emptyJobSet.Hydra.JobSet = ""
 	emptyProject := cloneConfig(cenv)
 	emptyProject.Hydra.Project = ""
+	badAuthMethod := cloneConfig(cenv)
+	badAuthMethod.Hydra.Auth.Method = "invalid"
+	emptyAuthUser := cloneConfig(cenv)
+	emptyAuthUser.Hydra.Auth.User = ""
+	emptyAuthHeader := cloneConfig(cflag)
+	emptyAuthHeader.Hydra.Auth.Header = ""
+	emptyAuthSecret := cloneConfig(cenv)
+	emptyAuthSecret.Hydra.Auth.Credential = ""
+	multipleAuthSecrets := cloneConfig(cenv)
+	multipleAuthSecrets.Hydra.Auth.SecretFile = "/run/secrets/env"
+	multiplePins := cloneConfig(cenv)
+	multiplePins.Hydra.Pin.BuildID = 1234
+	multiplePins.Hydra.Pin.EvalID = 5678
+	multiplePinsRev := cloneConfig(cenv)
+	multiplePinsRev.Hydra.Pin.EvalID = 5678
+	multiplePinsRev.Hydra.Pin.Rev = "c717fb0d"
+	badPinRev := cloneConfig(cenv)
+	badPinRev.Hydra.Pin.Rev = "main"
+	shortPinRev := cloneConfig(cenv)
+	shortPinRev.Hydra.Pin.Rev = "c717fb"
+	badSelection := cloneConfig(cenv)
+	badSelection.Hydra.Selection = "invalid"
+	zeroSearchDepth := cloneConfig(cenv)
+	zeroSearchDepth.Hydra.SearchDepth = 0
+	emptyRequiredJob := cloneConfig(cenv)
+	emptyRequiredJob.Hydra.RequiredJobs = []string{""}
+	badStatusPolicyStatus := cloneConfig(cenv)
+	badStatusPolicyStatus.Hydra.StatusPolicy = map[string]string{"succeeded": "skip"}
+	badStatusPolicy := cloneConfig(cenv)
+	badStatusPolicy.Hydra.StatusPolicy = map[string]string{"cancelled": "ignore"}
+	negativeTimeout := cloneConfig(cenv)
+	negativeTimeout.Hydra.Timeout = -time.Second
+	negativeRetries := cloneConfig(cenv)
+	negativeRetries.Hydra.Retries = -1
+	smallMaxBackoff := cloneConfig(cenv)
+	smallMaxBackoff.Hydra.MaxBackoff = time.Second
 	emptyOperation := cloneConfig(cenv)
 	emptyOperation.NixBuild.Operation = ""
 	badOperation := cloneConfig(cenv)
 	badOperation.NixBuild.Operation = "invalid"
+	badMode := cloneConfig(cenv)
+	badMode.NixBuild.Mode = "invalid"
+	badVerifyOutput := cloneConfig(cenv)
+	badVerifyOutput.NixBuild.VerifyOutput = "invalid"
 	emptyHost := cloneConfig(cenv)
 	emptyHost.NixBuild.Host = ""
 	emptyArg := cloneConfig(cenv)
 	emptyArg.NixBuild.Args = []string{""}
+	negativeRollbackWindow := cloneConfig(cenv)
+	negativeRollbackWindow.Rollback.Window = -time.Second
+	zeroRollbackInterval := cloneConfig(cenv)
+	zeroRollbackInterval.Rollback.Interval = 0
+	badRebootWhen := cloneConfig(cenv)
+	badRebootWhen.RebootPolicy.When = "never"
+	emptyRebootMarker := cloneConfig(cenv)
+	emptyRebootMarker.RebootPolicy.Marker = ""
+	badRebootWindow := cloneConfig(cenv)
+	badRebootWindow.RebootPolicy.WindowStart = "2am"
+	partialRebootWindow := cloneConfig(cenv)
+	partialRebootWindow.RebootPolicy.WindowEnd = ""
+	emptyRebootWindow := cloneConfig(cenv)
+	emptyRebootWindow.RebootPolicy.WindowEnd = emptyRebootWindow.RebootPolicy.WindowStart
+	negativeRebootDelay := cloneConfig(cenv)
+	negativeRebootDelay.RebootPolicy.Delay = -time.Minute
+	zeroHealthCheckTimeout := cloneConfig(cenv)
+	zeroHealthCheckTimeout.HealthCheck.Timeout = 0
+	zeroPingCount := cloneConfig(cenv)
+	zeroPingCount.HealthCheck.Ping.Count = 0
+	zeroPingInterval := cloneConfig(cenv)
+	zeroPingInterval.HealthCheck.Ping.Interval = 0
+	negativePingTimeout := cloneConfig(cenv)
+	negativePingTimeout.HealthCheck.Ping.Timeout = -time.Second
+	excessPingMaxLoss := cloneConfig(cenv)
+	excessPingMaxLoss.HealthCheck.Ping.MaxLoss = 101
+	negativePingMaxRTT := cloneConfig(cenv)
+	negativePingMaxRTT.HealthCheck.Ping.MaxRTT = -time.Millisecond
+	badPingIPVersion := cloneConfig(cenv)
+	badPingIPVersion.HealthCheck.Ping.IPVersion = 5
+	negativeHealthCheckDeadline := cloneConfig(cenv)
+	negativeHealthCheckDeadline.HealthCheck.Deadline = -time.Second
+	lowHealthCheckMaxBackoff := cloneConfig(cenv)
+	lowHealthCheckMaxBackoff.HealthCheck.MaxBackoff = cenv.HealthCheck.Backoff / 2
+	negativeMaxLoad := cloneConfig(cenv)
+	negativeMaxLoad.Conditions.MaxLoad = -1
+	badFailedUnits := cloneConfig(cenv)
+	badFailedUnits.HealthCheck.FailedUnits = "ignore"
+	emptyCheckName := cloneConfig(cenv)
+	emptyCheckName.HealthCheck.Checks[0].Name = ""
+	duplicateCheckNames := cloneConfig(cenv)
+	duplicateCheckNames.HealthCheck.Checks = append(duplicateCheckNames.HealthCheck.Checks, duplicateCheckNames.HealthCheck.Checks[0])
+	badCheckKind := cloneConfig(cenv)
+	badCheckKind.HealthCheck.Checks[0].Kind = "smoke-signal"
+	negativeCheckTimeout := cloneConfig(cenv)
+	negativeCheckTimeout.HealthCheck.Checks[0].Timeout = -time.Second
+	missingCheckSetting := cloneConfig(cenv)
+	missingCheckSetting.HealthCheck.Checks[0].Settings = map[string]any{}
+	negativeCheckDeadline := cloneConfig(cenv)
+	negativeCheckDeadline.HealthCheck.Checks[0].Deadline = -time.Second
+	emptyGroupName := cloneConfig(cenv)
+	emptyGroupName.HealthCheck.Groups[0].Name = ""
+	zeroGroupMinPass := cloneConfig(cenv)
+	zeroGroupMinPass.HealthCheck.Groups[0].MinPass = 0
+	emptyGroup := cloneConfig(cenv)
+	emptyGroup.HealthCheck.Groups[0].Name = "gateways"
+	excessGroupMinPass := cloneConfig(cenv)
+	excessGroupMinPass.HealthCheck.Groups[0].MinPass = 3
+	duplicateGroupNames := cloneConfig(cenv)
+	duplicateGroupNames.HealthCheck.Groups = append(duplicateGroupNames.HealthCheck.Groups, duplicateGroupNames.HealthCheck.Groups[0])
+	unknownCheckSetting := cloneConfig(cenv)
+	unknownCheckSetting.HealthCheck.Checks[0].Settings = map[string]any{"host": "10.0.0.1", "hots": "10.0.0.2"}
+	badRebootLockBackend := cloneConfig(cenv)
+	badRebootLockBackend.RebootLock.Backend = "etcd"
+	emptyRebootLockURL := cloneConfig(cenv)
+	emptyRebootLockURL.RebootLock.URL = ""
+	nonUrlRebootLockURL := cloneConfig(cenv)
+	nonUrlRebootLockURL.RebootLock.URL = "leases"
+	emptyRebootLockPath := cloneConfig(cflag)
+	emptyRebootLockPath.RebootLock.Path = ""
+	zeroRebootLockSlots := cloneConfig(cenv)
+	zeroRebootLockSlots.RebootLock.Slots = 0
+	negativeRebootLockTTL := cloneConfig(cenv)
+	negativeRebootLockTTL.RebootLock.TTL = -time.Minute
+	trialBootSwitch := cloneConfig(cenv)
+	trialBootSwitch.TrialBoot = true
+	emptyStateDir := cloneConfig(cenv)
+	emptyStateDir.StateDir = ""
 
 	var validationFailureTests = []struct {
 		description string
 		conf        config.Config
 	}{
 		{"empty HealthCheck.CanaryHosts string", emptyCanary},
+		{"zero HealthCheck.Timeout", zeroHealthCheckTimeout},
+		{"zero HealthCheck.Ping.Count", zeroPingCount},
+		{"zero HealthCheck.Ping.Interval", zeroPingInterval},
+		{"negative HealthCheck.Ping.Timeout", negativePingTimeout},
+		{"excess HealthCheck.Ping.MaxLoss", excessPingMaxLoss},
+		{"negative HealthCheck.Ping.MaxRTT", negativePingMaxRTT},
+		{"invalid HealthCheck.Ping.IPVersion", badPingIPVersion},
+		{"negative HealthCheck.Deadline", negativeHealthCheckDeadline},
+		{"HealthCheck.MaxBackoff less than HealthCheck.Backoff", lowHealthCheckMaxBackoff},
+		{"invalid HealthCheck.FailedUnits", badFailedUnits},
+		{"negative Conditions.MaxLoad", negativeMaxLoad},
+		{"empty HealthCheck.Checks name", emptyCheckName},
+		{"duplicate HealthCheck.Checks names", duplicateCheckNames},
+		{"unknown HealthCheck.Checks kind", badCheckKind},
+		{"negative HealthCheck.Checks timeout", negativeCheckTimeout},
+		{"missing HealthCheck.Checks setting", missingCheckSetting},
+		{"unknown HealthCheck.Checks setting", unknownCheckSetting},
+		{"negative HealthCheck.Checks deadline", negativeCheckDeadline},
+		{"empty HealthCheck.Groups name", emptyGroupName},
+		{"zero HealthCheck.Groups min_pass", zeroGroupMinPass},
+		{"duplicate HealthCheck.Groups names", duplicateGroupNames},
+		{"HealthCheck.Groups without checks", emptyGroup},
+		{"HealthCheck.Groups min_pass exceeding its checks", excessGroupMinPass},
 		{"non-url Hydra.Instance", nonUrlInstance},
 		{"empty Hydra.Instance", emptyInstance},
 		{"empty Hydra.Job", emptyJob},
 		{"empty Hydra.JobSet", emptyJobSet},
 		{"empty Hydra.Project", emptyProject},
+		{"invalid Hydra.Auth.Method", badAuthMethod},
+		{"empty Hydra.Auth.User with session auth", emptyAuthUser},
+		{"empty Hydra.Auth.Header with header auth", emptyAuthHeader},
+		{"no Hydra.Auth secret source", emptyAuthSecret},
+		{"multiple Hydra.Auth secret sources", multipleAuthSecrets},
+		{"multiple Hydra.Pin build and eval", multiplePins},
+		{"multiple Hydra.Pin eval and rev", multiplePinsRev},
+		{"non-hex Hydra.Pin.Rev", badPinRev},
+		{"short Hydra.Pin.Rev", shortPinRev},
+		{"invalid Hydra.Selection", badSelection},
+		{"zero Hydra.SearchDepth", zeroSearchDepth},
+		{"empty Hydra.RequiredJobs string", emptyRequiredJob},
+		{"invalid Hydra.StatusPolicy status", badStatusPolicyStatus},
+		{"invalid Hydra.StatusPolicy policy", badStatusPolicy},
+		{"negative Hydra.Timeout", negativeTimeout},
+		{"negative Hydra.Retries", negativeRetries},
+		{"Hydra.MaxBackoff less than Hydra.Backoff", smallMaxBackoff},
 		{"empty NixBuild.Operation", emptyOperation},
 		{"invalid NixBuild.Operation", badOperation},
+		{"invalid NixBuild.Mode", badMode},
+		{"invalid NixBuild.VerifyOutput", badVerifyOutput},
 		{"empty NixBuild.Host", emptyHost},
 		{"empty NixBuild.Args string", emptyArg},
+		{"negative Rollback.Window", negativeRollbackWindow},
+		{"zero Rollback.Interval", zeroRollbackInterval},
+		{"invalid RebootPolicy.When", badRebootWhen},
+		{"empty RebootPolicy.Marker", emptyRebootMarker},
+		{"invalid RebootPolicy.WindowStart", badRebootWindow},
+		{"RebootPolicy.WindowStart without RebootPolicy.WindowEnd", partialRebootWindow},
+		{"RebootPolicy.WindowEnd equal to RebootPolicy.WindowStart", emptyRebootWindow},
+		{"negative RebootPolicy.Delay", negativeRebootDelay},
+		{"invalid RebootLock.Backend", badRebootLockBackend},
+		{"empty RebootLock.URL with http backend", emptyRebootLockURL},
+		{"non-url RebootLock.URL", nonUrlRebootLockURL},
+		{"empty RebootLock.Path with file backend", emptyRebootLockPath},
+		{"zero RebootLock.Slots", zeroRebootLockSlots},
+		{"negative RebootLock.TTL", negativeRebootLockTTL},
+		{"TrialBoot without boot NixBuild.Operation", trialBootSwitch},
+		{"empty StateDir", emptyStateDir},
 	}
 
 	for _, test := range validationFailureTests {
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// host is the system being upgraded: how nix commands run, where its
+// running system and run conditions are read, how it reboots, and its
+// clock. Commands act on localHost, tests use a fake host.
+type host struct {
+	runner nix.Runner
+	// links to the toplevels of the running system and boot
+	currentSystem string
+	bootedSystem  string
+	// read for run conditions
+	powerSupplyDir string
+	loadAvgFile    string
+
+	systemReboot         func() error
+	systemScheduleReboot func(delay time.Duration, message string) error
+	systemCancelReboot   func() error
+	now                  func() time.Time
+}
+
+// localHost returns the host this runs on.
+func localHost() *host {
+	return &host{
+		runner:               nix.ExecRunner{},
+		currentSystem:        "/run/current-system",
+		bootedSystem:         "/run/booted-system",
+		powerSupplyDir:       system.PowerSupplyDir,
+		loadAvgFile:          system.LoadAvgFile,
+		systemReboot:         system.Reboot,
+		systemScheduleReboot: system.ScheduleReboot,
+		systemCancelReboot:   system.CancelReboot,
+		now:                  time.Now,
+	}
+}
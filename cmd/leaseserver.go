@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/lock"
+	"github.com/spf13/cobra"
+)
+
+// NewLeaseServerCommand serves reboot lock leases for the http reboot
+// lock backend.
+func NewLeaseServerCommand(rootCmd *cobra.Command) *cobra.Command {
+	var (
+		flagListen string
+		flagSlots  int
+		flagTTL    time.Duration
+	)
+	leaseServerCmd := &cobra.Command{
+		Use:   "lease-server",
+		Short: "Serves reboot lock leases to a fleet",
+		Long: `Serves reboot lock leases for --reboot-lock-backend http. At most --slots hosts hold a lease at once, each from its reboot until the verify command passes on the next boot.
+
+Leases are persisted in --state-dir, and expire after --ttl if it's set.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			debug, _ := cmd.Flags().GetBool(config.CobraKeys.Debug)
+			stateDir, _ := cmd.Flags().GetString(config.CobraKeys.StateDir)
+			setupLogging(config.Config{Debug: debug})
+			exitOnError(runLeaseServer(cmd.Context(), flagListen, flagSlots, flagTTL, stateDir))
+		},
+	}
+	leaseServerCmd.Flags().StringVar(&flagListen, "listen", ":8080", "Address to listen on")
+	leaseServerCmd.Flags().IntVar(&flagSlots, "slots", 1, "Concurrent reboots")
+	leaseServerCmd.Flags().DurationVar(&flagTTL, "ttl", 0, "Expire leases held longer than this, 0 never expires them")
+
+	return leaseServerCmd
+}
+
+// runLeaseServer serves leases until interrupted.
+func runLeaseServer(ctx context.Context, listen string, slots int, ttl time.Duration, stateDir string) error {
+	if slots < 1 {
+		return errors.New("lease-server: --slots must be at least 1")
+	}
+	leases, err := lock.NewServer(slots, ttl, stateDir)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: listen, Handler: leases, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving reboot lock leases.",
+		slog.String("listen", listen),
+		slog.Int("slots", slots),
+		slog.Duration("ttl", ttl),
+		slog.String("state_dir", stateDir))
+	err = srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
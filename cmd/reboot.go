@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+	"github.com/spf13/cobra"
+)
+
+// rebootPendingState is the state file recording a deferred reboot.
+const rebootPendingState = "reboot-pending.json"
+
+// pendingReboot describes a reboot deferred until the reboot window
+// opens.
+type pendingReboot struct {
+	Reasons []string  `json:"reasons"`
+	Since   time.Time `json:"since"`
+	// booted system when deferred, any reboot since then completes it
+	Booted string `json:"booted"`
+}
+
+// rebootReasons returns why activating result with operation requires
+// a reboot, or nothing if it doesn't.
+func (h *host) rebootReasons(operation, result string) ([]string, error) {
+	switch operation {
+	case "switch", "boot":
+		// other changes to a boot generation apply whenever the host
+		// next reboots
+		return system.RebootRequired(h.bootedSystem, result)
+	default:
+		// test, check and dry-activate never change the boot default
+		return nil, nil
+	}
+}
+
+// rebootAfterUpgrade reboots into an upgraded system when it's required
+// and allowed. Required reboots that aren't allowed are recorded in the
+// reboot required marker instead.
+func (h *host) rebootAfterUpgrade(ctx context.Context, conf config.Config, result string) error {
+	if conf.TrialBoot {
+		return h.reboot(ctx, conf, []string{"trial-boot"})
+	}
+
+	reasons, err := h.rebootReasons(conf.NixBuild.Operation, result)
+	if err != nil {
+		if conf.Reboot {
+			return failStage(stageReboot, err)
+		}
+		slog.Warn("Unable to determine whether a reboot is required.", slog.Any("err", err))
+		return nil
+	}
+
+	if !conf.Reboot {
+		if len(reasons) > 0 {
+			err = system.WriteRebootRequired(conf.RebootPolicy.Marker, reasons)
+			if err != nil {
+				return failStage(stageReboot, err)
+			}
+			slog.Info("Reboot required, but reboot is disabled.",
+				slog.Any("reasons", reasons),
+				slog.String("marker", conf.RebootPolicy.Marker))
+		}
+		return nil
+	}
+	if len(reasons) == 0 && conf.RebootPolicy.When != "always" {
+		slog.Info("No reboot required.", slog.String("operation", conf.NixBuild.Operation))
+		return nil
+	}
+	return h.reboot(ctx, conf, reasons)
+}
+
+// reboot reboots, after the configured delay, if the reboot window is
+// open and a reboot lock slot is free. Otherwise the reboot is recorded
+// as pending, and the reboot required marker is written. Reboots
+// waiting for a lock slot are retried later.
+func (h *host) reboot(ctx context.Context, conf config.Config, reasons []string) error {
+	window, err := system.ParseWindow(conf.RebootPolicy.WindowStart, conf.RebootPolicy.WindowEnd)
+	if err != nil {
+		return failStage(stageReboot, err)
+	}
+
+	if !window.Contains(h.now()) {
+		pending, err := h.deferReboot(conf, reasons)
+		if err != nil {
+			return err
+		}
+		slog.Info("Reboot deferred until the reboot window opens.",
+			slog.Any("reasons", reasons),
+			slog.String("window", window.String()),
+			slog.Time("since", pending.Since))
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rebootLockTimeout)
+	defer cancel()
+	lockErr := h.acquireRebootLock(ctx, conf)
+	if lockErr != nil {
+		_, err := h.deferReboot(conf, reasons)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: reboot waiting for a reboot lock slot: %w", errRetryLater, lockErr)
+	}
+
+	err = system.RemoveState(conf.StateDir, rebootPendingState)
+	if err != nil {
+		return failStage(stageReboot, err)
+	}
+	if conf.RebootPolicy.Delay > 0 {
+		slog.Info("Scheduling reboot",
+			slog.Any("reasons", reasons),
+			slog.Duration("delay", conf.RebootPolicy.Delay),
+			slog.String("message", conf.RebootPolicy.Message))
+		err = h.systemScheduleReboot(conf.RebootPolicy.Delay, conf.RebootPolicy.Message)
+	} else {
+		slog.Info("Initiating reboot", slog.Any("reasons", reasons), slog.String("when", conf.RebootPolicy.When))
+		err = h.systemReboot()
+	}
+	if err != nil {
+		// the slot is only released by verify after a reboot
+		releaseErr := releaseRebootLock(ctx, conf)
+		if releaseErr != nil {
+			slog.Warn("Unable to release reboot lock.", slog.Any("err", releaseErr))
+		}
+		return failStage(stageReboot, err)
+	}
+	return nil
+}
+
+// deferReboot records a pending reboot, keeping the time an earlier
+// reboot was deferred if it's still pending.
+func (h *host) deferReboot(conf config.Config, reasons []string) (pendingReboot, error) {
+	booted, err := filepath.EvalSymlinks(h.bootedSystem)
+	if err != nil {
+		return pendingReboot{}, failStage(stageReboot, fmt.Errorf("%w: %w", system.ErrRebootCheck, err))
+	}
+	pending := pendingReboot{Reasons: reasons, Since: h.now(), Booted: booted}
+	var previous pendingReboot
+	ok, err := system.ReadState(conf.StateDir, rebootPendingState, &previous)
+	if err == nil && ok && previous.Booted == booted {
+		pending.Since = previous.Since
+	}
+
+	err = system.WriteState(conf.StateDir, rebootPendingState, pending)
+	if err != nil {
+		return pending, failStage(stageReboot, err)
+	}
+	err = system.WriteRebootRequired(conf.RebootPolicy.Marker, reasons)
+	if err != nil {
+		return pending, failStage(stageReboot, err)
+	}
+	return pending, nil
+}
+
+// runRebootPending performs a pending reboot once the reboot window
+// opens. Reboots are no longer pending once the system has rebooted
+// for any reason.
+func (h *host) runRebootPending(ctx context.Context, conf config.Config) error {
+	var pending pendingReboot
+	ok, err := system.ReadState(conf.StateDir, rebootPendingState, &pending)
+	if err != nil {
+		return failStage(stageReboot, err)
+	}
+	if !ok {
+		slog.Info("No reboot pending.")
+		return nil
+	}
+
+	booted, err := filepath.EvalSymlinks(h.bootedSystem)
+	if err == nil && booted != pending.Booted {
+		slog.Info("System rebooted since the reboot was deferred, no reboot pending.", slog.Time("since", pending.Since))
+		err = system.RemoveState(conf.StateDir, rebootPendingState)
+		if err != nil {
+			return failStage(stageReboot, err)
+		}
+		return nil
+	}
+	return h.reboot(ctx, conf, pending.Reasons)
+}
+
+// cancelReboot cancels a delayed reboot, and any pending reboot,
+// releasing its reboot lock slot.
+func (h *host) cancelReboot(ctx context.Context, conf config.Config) error {
+	err := h.systemCancelReboot()
+	if err != nil {
+		return failStage(stageReboot, err)
+	}
+	err = system.RemoveState(conf.StateDir, rebootPendingState)
+	if err != nil {
+		return failStage(stageReboot, err)
+	}
+	err = releaseRebootLock(ctx, conf)
+	if err != nil {
+		return failStage(stageReboot, err)
+	}
+	slog.Info("Reboot cancelled.")
+	return nil
+}
+
+// NewRebootPendingCommand performs deferred reboots, and should run
+// when the reboot window opens.
+func NewRebootPendingCommand(rootCmd *cobra.Command) *cobra.Command {
+	var flagCancel bool
+	rebootPendingCmd := &cobra.Command{
+		Use:   "reboot-pending",
+		Short: "Performs a reboot deferred until the reboot window, or cancels it",
+		Long: `Performs a reboot that was deferred because an upgrade finished outside of the reboot window. Nothing is done while the window is closed, or if the system has rebooted since.
+
+Reboots waiting for a reboot lock slot exit 75 to be retried later.
+
+--cancel cancels a delayed reboot and any pending reboot, and releases its reboot lock slot.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return loadConfig(cmd, rootCmd, nil)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			setupLogging(conf)
+			if flagCancel {
+				exitOnError(localHost().cancelReboot(cmd.Context(), conf))
+				return
+			}
+			exitOnError(localHost().runRebootPending(cmd.Context(), conf))
+		},
+	}
+	rebootPendingCmd.Flags().BoolVar(&flagCancel, "cancel", false, "Cancel a delayed or pending reboot")
+
+	return rebootPendingCmd
+}
@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// newRebootTest boots a fake toplevel with kernel, returning its host,
+// a config with reboot disabled and a fake toplevel linking newKernel.
+func newRebootTest(t *testing.T, operation, kernel, newKernel string) (*host, config.Config, string) {
+	dir := t.TempDir()
+	fakeToplevel := func(name, kernel string) string {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Join(dir, kernel), 0755)
+		os.MkdirAll(path, 0755)
+		os.Symlink(filepath.Join(dir, kernel), filepath.Join(path, "kernel"))
+		return path
+	}
+	booted := filepath.Join(dir, "booted-system")
+	os.Symlink(fakeToplevel("aaaa-nixos-system-oak", kernel), booted)
+	result := fakeToplevel("bbbb-nixos-system-oak", newKernel)
+
+	h := newTestHost(t)
+	h.bootedSystem = booted
+
+	var c config.Config
+	c.NixBuild.Operation = operation
+	c.RebootPolicy.When = "required"
+	c.RebootPolicy.Marker = filepath.Join(dir, "reboot-required")
+	c.StateDir = filepath.Join(dir, "state")
+	return h, c, result
+}
+
+// fakeReboots records h's reboot actions instead of performing them,
+// at the provided local time.
+func fakeReboots(h *host, hour, minute int) *[]string {
+	var actions []string
+	h.systemReboot = func() error {
+		actions = append(actions, "reboot")
+		return nil
+	}
+	h.systemScheduleReboot = func(delay time.Duration, message string) error {
+		actions = append(actions, fmt.Sprintf("schedule %s %s", delay, message))
+		return nil
+	}
+	h.systemCancelReboot = func() error {
+		actions = append(actions, "cancel")
+		return nil
+	}
+	h.now = func() time.Time {
+		return time.Date(2024, 5, 2, hour, minute, 0, 0, time.Local)
+	}
+	return &actions
+}
+
+func TestRebootAfterUpgrade(t *testing.T) {
+	t.Run("switch without boot component changes doesn't require a reboot", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "switch", "linux-6.6", "linux-6.6")
+
+		err := h.rebootAfterUpgrade(context.Background(), c, result)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		_, err = os.Stat(c.RebootPolicy.Marker)
+		assert.Equal(t, os.IsNotExist(err), true)
+	})
+
+	t.Run("switch with a new kernel records a disallowed reboot", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+
+		err := h.rebootAfterUpgrade(context.Background(), c, result)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		contents, _ := os.ReadFile(c.RebootPolicy.Marker)
+		assert.Equal(t, string(contents), "kernel\n")
+	})
+
+	t.Run("boot without boot component changes doesn't reboot", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "boot", "linux-6.6", "linux-6.6")
+		c.Reboot = true
+		actions := fakeReboots(h, 3, 0)
+
+		err := h.rebootAfterUpgrade(context.Background(), c, result)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(*actions), 0)
+	})
+
+	t.Run("boot with a new kernel reboots", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "boot", "linux-6.6", "linux-6.12")
+		c.Reboot = true
+		actions := fakeReboots(h, 3, 0)
+
+		err := h.rebootAfterUpgrade(context.Background(), c, result)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, *actions, []string{"reboot"})
+	})
+
+	t.Run("test never requires a reboot", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "test", "linux-6.6", "linux-6.12")
+
+		err := h.rebootAfterUpgrade(context.Background(), c, result)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		_, err = os.Stat(c.RebootPolicy.Marker)
+		assert.Equal(t, os.IsNotExist(err), true)
+	})
+}
+
+func TestRebootScheduling(t *testing.T) {
+	t.Run("reboots immediately inside the window", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+		c.Reboot = true
+		c.RebootPolicy.WindowStart = "02:00"
+		c.RebootPolicy.WindowEnd = "05:00"
+		actions := fakeReboots(h, 4, 40)
+
+		err := h.rebootAfterUpgrade(context.Background(), c, result)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, *actions, []string{"reboot"})
+	})
+
+	t.Run("delays reboots with a message", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+		c.Reboot = true
+		c.RebootPolicy.Delay = 5 * time.Minute
+		c.RebootPolicy.Message = "rebooting"
+		actions := fakeReboots(h, 4, 40)
+
+		err := h.rebootAfterUpgrade(context.Background(), c, result)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, *actions, []string{"schedule 5m0s rebooting"})
+	})
+
+	t.Run("defers reboots outside the window until it opens", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+		c.Reboot = true
+		c.RebootPolicy.WindowStart = "02:00"
+		c.RebootPolicy.WindowEnd = "05:00"
+		actions := fakeReboots(h, 13, 0)
+
+		err := h.rebootAfterUpgrade(context.Background(), c, result)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(*actions), 0)
+		contents, _ := os.ReadFile(c.RebootPolicy.Marker)
+		assert.Equal(t, string(contents), "kernel\n")
+
+		// still closed
+		err = h.runRebootPending(context.Background(), c)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(*actions), 0)
+
+		h.now = func() time.Time { return time.Date(2024, 5, 3, 2, 30, 0, 0, time.Local) }
+		err = h.runRebootPending(context.Background(), c)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, *actions, []string{"reboot"})
+		ok, _ := system.ReadState(c.StateDir, rebootPendingState, &pendingReboot{})
+		assert.Equal(t, ok, false)
+	})
+
+	t.Run("pending reboots are complete after any reboot", func(t *testing.T) {
+		h, c, _ := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+		c.Reboot = true
+		actions := fakeReboots(h, 4, 40)
+		system.WriteState(c.StateDir, rebootPendingState, pendingReboot{
+			Reasons: []string{"kernel"},
+			Booted:  "/nix/store/zzzz-nixos-system-oak",
+		})
+
+		err := h.runRebootPending(context.Background(), c)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(*actions), 0)
+		ok, _ := system.ReadState(c.StateDir, rebootPendingState, &pendingReboot{})
+		assert.Equal(t, ok, false)
+	})
+
+	t.Run("cancels delayed and pending reboots", func(t *testing.T) {
+		h, c, _ := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+		actions := fakeReboots(h, 4, 40)
+		system.WriteState(c.StateDir, rebootPendingState, pendingReboot{Reasons: []string{"kernel"}})
+
+		err := h.cancelReboot(context.Background(), c)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, *actions, []string{"cancel"})
+		ok, _ := system.ReadState(c.StateDir, rebootPendingState, &pendingReboot{})
+		assert.Equal(t, ok, false)
+	})
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/lock"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// rebootLockState is the state file recording a held reboot lock slot.
+const rebootLockState = "reboot-lock.json"
+
+// rebootLockTokenState is the state file holding this host's lease
+// server token.
+const rebootLockTokenState = "reboot-lock-token.json"
+
+// lease server request timeout
+const rebootLockTimeout = 30 * time.Second
+
+// heldRebootLock describes a reboot lock slot held until the rebooted
+// system is verified.
+type heldRebootLock struct {
+	Holder   string    `json:"holder"`
+	Backend  string    `json:"backend"`
+	Acquired time.Time `json:"acquired"`
+}
+
+// newRebootLock returns the configured reboot lock and this host's
+// holder name, or a nil lock if reboots aren't coordinated.
+func newRebootLock(conf config.RebootLockConfig, stateDir string) (lock.Lock, string, error) {
+	holder := conf.Holder
+	if holder == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %w", lock.ErrLock, err)
+		}
+		holder = hostname
+	}
+
+	switch conf.Backend {
+	case "http":
+		token, err := rebootLockToken(stateDir)
+		if err != nil {
+			return nil, "", err
+		}
+		return lock.HTTPLock{
+			URL:        conf.URL,
+			Token:      token,
+			HTTPClient: &http.Client{Timeout: rebootLockTimeout},
+		}, holder, nil
+	case "file":
+		return lock.FileLock{Dir: conf.Path, Slots: conf.Slots, TTL: conf.TTL}, holder, nil
+	default:
+		return nil, holder, nil
+	}
+}
+
+// rebootLockToken returns this host's lease server token, generating it
+// on first use. It's kept in stateDir, so leases are released by the
+// same host after a reboot whatever address it comes back with.
+func rebootLockToken(stateDir string) (string, error) {
+	var token string
+	ok, err := system.ReadState(stateDir, rebootLockTokenState, &token)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", lock.ErrLock, err)
+	}
+	if ok && token != "" {
+		return token, nil
+	}
+	token = rand.Text()
+	err = system.WriteState(stateDir, rebootLockTokenState, token)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", lock.ErrLock, err)
+	}
+	return token, nil
+}
+
+// acquireRebootLock takes a reboot lock slot, and records it for
+// release after the next boot.
+func (h *host) acquireRebootLock(ctx context.Context, conf config.Config) error {
+	l, holder, err := newRebootLock(conf.RebootLock, conf.StateDir)
+	if err != nil || l == nil {
+		return err
+	}
+	err = l.Acquire(ctx, holder)
+	if err != nil {
+		return err
+	}
+	err = system.WriteState(conf.StateDir, rebootLockState, heldRebootLock{
+		Holder:   holder,
+		Backend:  conf.RebootLock.Backend,
+		Acquired: h.now(),
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Reboot lock acquired.", slog.String("holder", holder), slog.String("backend", conf.RebootLock.Backend))
+	return nil
+}
+
+// releaseRebootLock releases a recorded reboot lock slot, if any.
+func releaseRebootLock(ctx context.Context, conf config.Config) error {
+	var held heldRebootLock
+	ok, err := system.ReadState(conf.StateDir, rebootLockState, &held)
+	if err != nil || !ok {
+		return err
+	}
+	l, _, err := newRebootLock(conf.RebootLock, conf.StateDir)
+	if err != nil {
+		return err
+	}
+	if l != nil {
+		err = l.Release(ctx, held.Holder)
+		if err != nil {
+			return err
+		}
+	}
+	err = system.RemoveState(conf.StateDir, rebootLockState)
+	if err != nil {
+		return err
+	}
+	slog.Info("Reboot lock released.", slog.String("holder", held.Holder), slog.Time("acquired", held.Acquired))
+	return nil
+}
+
+// rebootLockHeld reports whether a reboot lock slot is recorded.
+func rebootLockHeld(conf config.Config) (bool, error) {
+	return system.ReadState(conf.StateDir, rebootLockState, &heldRebootLock{})
+}
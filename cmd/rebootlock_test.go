@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/lock"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+func TestRebootLock(t *testing.T) {
+	t.Run("reboots holding a file lock slot until verified", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+		c.Reboot = true
+		c.RebootLock.Backend = "file"
+		c.RebootLock.Path = filepath.Join(t.TempDir(), "locks")
+		c.RebootLock.Slots = 1
+		c.RebootLock.Holder = "oak"
+		actions := fakeReboots(h, 4, 40)
+
+		err := h.rebootAfterUpgrade(context.Background(), c, result)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, *actions, []string{"reboot"})
+		holder, _ := os.ReadFile(filepath.Join(c.RebootLock.Path, "slot-0"))
+		assert.Equal(t, string(holder), "oak")
+
+		err = h.runVerify(context.Background(), c)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		_, err = os.Stat(filepath.Join(c.RebootLock.Path, "slot-0"))
+		assert.Equal(t, os.IsNotExist(err), true)
+		held, _ := rebootLockHeld(c)
+		assert.Equal(t, held, false)
+	})
+
+	t.Run("defers reboots while every slot is held", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+		c.Reboot = true
+		c.RebootLock.Backend = "file"
+		c.RebootLock.Path = filepath.Join(t.TempDir(), "locks")
+		c.RebootLock.Slots = 1
+		c.RebootLock.Holder = "oak"
+		actions := fakeReboots(h, 4, 40)
+		elm := lock.FileLock{Dir: c.RebootLock.Path, Slots: 1}
+		elm.Acquire(context.Background(), "elm")
+
+		err := h.rebootAfterUpgrade(context.Background(), c, result)
+
+		assert.Equal(t, errors.Is(err, errRetryLater), true)
+		assert.Equal(t, errors.Is(err, lock.ErrLocked), true)
+		assert.Equal(t, len(*actions), 0)
+		ok, _ := system.ReadState(c.StateDir, rebootPendingState, &pendingReboot{})
+		assert.Equal(t, ok, true)
+
+		// elm verified, the pending reboot can proceed
+		elm.Release(context.Background(), "elm")
+		err = h.runRebootPending(context.Background(), c)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, *actions, []string{"reboot"})
+	})
+
+	t.Run("cancelled runs don't acquire a slot", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+		c.Reboot = true
+		c.RebootLock.Backend = "file"
+		c.RebootLock.Path = filepath.Join(t.TempDir(), "locks")
+		c.RebootLock.Slots = 1
+		c.RebootLock.Holder = "oak"
+		actions := fakeReboots(h, 4, 40)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := h.rebootAfterUpgrade(ctx, c, result)
+
+		assert.Equal(t, errors.Is(err, context.Canceled), true)
+		assert.Equal(t, len(*actions), 0)
+		_, err = os.Stat(filepath.Join(c.RebootLock.Path, "slot-0"))
+		assert.Equal(t, os.IsNotExist(err), true)
+	})
+
+	t.Run("releases lease server leases after verify", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+		leases, err := lock.NewServer(1, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(leases)
+		defer server.Close()
+		c.Reboot = true
+		c.RebootLock.Backend = "http"
+		c.RebootLock.URL = server.URL
+		c.RebootLock.Holder = "oak"
+		actions := fakeReboots(h, 4, 40)
+		elm := lock.HTTPLock{URL: server.URL}
+
+		err = h.rebootAfterUpgrade(context.Background(), c, result)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, *actions, []string{"reboot"})
+		assert.Equal(t, errors.Is(elm.Acquire(context.Background(), "elm"), lock.ErrLocked), true)
+		// only released with the token kept in the state dir
+		assert.Equal(t, errors.Is(elm.Release(context.Background(), "oak"), lock.ErrLock), true)
+
+		err = h.runVerify(context.Background(), c)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, elm.Acquire(context.Background(), "elm"), nil)
+	})
+
+	t.Run("failed health checks keep the slot", func(t *testing.T) {
+		h, c, _ := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+		c.RebootLock.Backend = "file"
+		c.RebootLock.Path = filepath.Join(t.TempDir(), "locks")
+		c.RebootLock.Slots = 1
+		c.RebootLock.Holder = "oak"
+		c.HealthCheck.CanaryHosts = []string{"canary.invalid"}
+		fakeReboots(h, 4, 40)
+		err := h.acquireRebootLock(context.Background(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = h.runVerify(context.Background(), c)
+
+		assert.Equal(t, stageOf(err), stageHealthCheck)
+		held, _ := rebootLockHeld(c)
+		assert.Equal(t, held, true)
+		holder, _ := os.ReadFile(filepath.Join(c.RebootLock.Path, "slot-0"))
+		assert.Equal(t, string(holder), "oak")
+	})
+
+	t.Run("failed reboots release the slot", func(t *testing.T) {
+		h, c, result := newRebootTest(t, "switch", "linux-6.6", "linux-6.12")
+		c.Reboot = true
+		c.RebootLock.Backend = "file"
+		c.RebootLock.Path = filepath.Join(t.TempDir(), "locks")
+		c.RebootLock.Slots = 1
+		c.RebootLock.Holder = "oak"
+		fakeReboots(h, 4, 40)
+		h.systemReboot = func() error { return system.ErrRebootFailed }
+
+		err := h.rebootAfterUpgrade(context.Background(), c, result)
+
+		assert.Equal(t, stageOf(err), stageReboot)
+		_, err = os.Stat(filepath.Join(c.RebootLock.Path, "slot-0"))
+		assert.Equal(t, os.IsNotExist(err), true)
+	})
+}
@@ -4,12 +4,9 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
-	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
-	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/hydra"
-	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix"
-	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
 	"github.com/spf13/cobra"
 )
 
@@ -21,6 +18,11 @@ var (
 )
 
 func NewRootCmd() *cobra.Command {
+	return newRootCmd(localHost())
+}
+
+// newRootCmd creates the root command, upgrading h.
+func newRootCmd(h *host) *cobra.Command {
 	rootCmd := &cobra.Command{
 		Use:   "nixos-hydra-upgrade [boot|check|dry-activate|test|switch]",
 		Short: "nixos-hydra-upgrade performs NixOS system upgrades based on hydra build success",
@@ -51,86 +53,11 @@ Config follows the precedence CLI Flag > Environment variable > YAML config, wit
 				os.Exit(0)
 			}
 
-			var err error
-			conf, err = config.InitializeConfig(cmd, args)
-			if err != nil {
-				return err
-			}
-			err = conf.Validate()
-			if err != nil {
-				cmd.Usage()
-				os.Exit(1)
-			}
-			return nil
+			return loadConfig(cmd, cmd, args)
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			// structured logging setup
-			logLevel := slog.LevelInfo
-			if conf.Debug {
-				logLevel = slog.LevelDebug
-			}
-			logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel, AddSource: true}))
-			slog.SetDefault(logger)
-
-			// get latest hydra build status and flake
-			hydraClient := hydra.HydraClient{
-				Instance: conf.Hydra.Instance,
-				JobSet:   conf.Hydra.JobSet,
-				Job:      conf.Hydra.Job,
-				Project:  conf.Hydra.Project,
-			}
-
-			build := hydraClient.GetLatestBuild()
-			if build.Finished != 1 {
-				slog.Info("Latest build unfinished. Exiting.")
-				os.Exit(0)
-			}
-			if build.BuildStatus != 0 {
-				slog.Info("Latest build unsuccessful. Exiting.", slog.Int("buildstatus", build.BuildStatus))
-				os.Exit(1)
-			}
-
-			eval := hydraClient.GetEval(build)
-
-			// check flake metadata to see if this is an update
-			selfMetadata := nix.GetFlakeMetadata("self")
-			hydraMetadata := nix.GetFlakeMetadata(eval.Flake)
-
-			if selfMetadata.LastModified >= hydraMetadata.LastModified {
-				slog.Info("System is already up to date. Exiting.")
-				os.Exit(0)
-			}
-			flakeSpec := fmt.Sprintf("%s#%s", hydraMetadata.OriginalUrl, conf.NixBuild.Host)
-
-			// health checks
-			for _, h := range conf.HealthCheck.CanaryHosts {
-				err := healthcheck.Ping(h)
-				if err != nil {
-					slog.Info("Ping healthcheck failed. Exiting.", slog.String("host", h))
-					os.Exit(1)
-				}
-			}
-
-			toplevel := nix.FlakeToToplevel(flakeSpec)
-			slog.Info("Building toplevel derivation.", slog.String("toplevel", toplevel))
-			result := nix.NixBuild(toplevel, conf.NixBuild.Args)
-			slog.Info("Build complete", slog.String("result", result))
-
-			// default profile only for now is fine.
-			result = nix.NixBuild(toplevel, append([]string{"--profile", "/nix/var/nix/profiles/system"}, conf.NixBuild.Args...))
-			slog.Info("Switched to new profile", slog.String("result", result))
-
-			nix.NixDiff("/nix/var/nix/profiles/system", result)
-
-			slog.Info("executing switch-to-derivation", slog.String("toplevel", toplevel), slog.String("operation", conf.NixBuild.Operation))
-			nix.SwitchToConfiguration(result, conf.NixBuild.Operation)
-
-			slog.Info("System upgrade complete.", slog.String("flake", flakeSpec))
-
-			if conf.Reboot {
-				slog.Info("Initiating reboot")
-				system.Reboot()
-			}
+			setupLogging(conf)
+			exitOnError(h.runUpgrade(cmd.Context(), conf))
 		},
 	}
 
@@ -140,6 +67,22 @@ Config follows the precedence CLI Flag > Environment variable > YAML config, wit
 		config.ViperKeys.Debug,
 		"Enable debug logging",
 		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Conditions.ACPower, false, flagUsage(
+		config.ViperKeys.Conditions.ACPower,
+		"Skip upgrades unless on mains power",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Conditions.NoSessions, false, flagUsage(
+		config.ViperKeys.Conditions.NoSessions,
+		"Skip upgrades while graphical or remote (ssh) sessions are logged in",
+		false))
+	rootCmd.PersistentFlags().Float64(config.CobraKeys.Conditions.MaxLoad, 0, flagUsage(
+		config.ViperKeys.Conditions.MaxLoad,
+		"Skip upgrades while the 1 minute load average is at or above this, 0 disables",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Conditions.Unmetered, false, flagUsage(
+		config.ViperKeys.Conditions.Unmetered,
+		"Skip upgrades while NetworkManager reports a metered connection",
+		false))
 	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.Instance, "", flagUsage(
 		config.ViperKeys.Hydra.Instance,
 		"Hydra instance",
@@ -156,18 +99,218 @@ Config follows the precedence CLI Flag > Environment variable > YAML config, wit
 		config.ViperKeys.Hydra.Job,
 		"Hydra job",
 		true))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.Auth.Method, "none", flagUsage(
+		config.ViperKeys.Hydra.Auth.Method,
+		"Hydra auth method [none|basic|bearer|header|session]",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.Auth.User, "", flagUsage(
+		config.ViperKeys.Hydra.Auth.User,
+		"Hydra user, required for basic and session auth",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.Auth.Header, "", flagUsage(
+		config.ViperKeys.Hydra.Auth.Header,
+		"Header name carrying the secret for header auth",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.Auth.SecretFile, "", flagUsage(
+		config.ViperKeys.Hydra.Auth.SecretFile,
+		"File containing the hydra password or token",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.Auth.Credential, "", flagUsage(
+		config.ViperKeys.Hydra.Auth.Credential,
+		"systemd credential name containing the hydra password or token",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Hydra.Pin.BuildID, 0, flagUsage(
+		config.ViperKeys.Hydra.Pin.BuildID,
+		"Pin the upgrade to a specific hydra build id",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Hydra.Pin.EvalID, 0, flagUsage(
+		config.ViperKeys.Hydra.Pin.EvalID,
+		"Pin the upgrade to the job's build in a specific hydra evaluation id",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.Pin.Rev, "", flagUsage(
+		config.ViperKeys.Hydra.Pin.Rev,
+		"Pin the upgrade to the job's build in the newest evaluation of a flake revision, at least 7 characters",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Hydra.Pin.AllowDowngrade, false, flagUsage(
+		config.ViperKeys.Hydra.Pin.AllowDowngrade,
+		"Allow a pinned build older than the running system, ignored without a pin",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.Selection, "latest", flagUsage(
+		config.ViperKeys.Hydra.Selection,
+		"Build selection [latest|latest-finished|latest-successful]",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Hydra.SearchDepth, 10, flagUsage(
+		config.ViperKeys.Hydra.SearchDepth,
+		"Number of recent builds searched by latest-successful selection",
+		false))
+	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.Hydra.RequiredJobs, []string{}, flagUsage(
+		config.ViperKeys.Hydra.RequiredJobs,
+		"Multivalue - Jobs in the same evaluation that must also succeed, e.g. tests",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.Hydra.AggregateJob, "", flagUsage(
+		config.ViperKeys.Hydra.AggregateJob,
+		"Aggregate job in the same evaluation whose constituents must all succeed",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Hydra.Timeout, 30*time.Second, flagUsage(
+		config.ViperKeys.Hydra.Timeout,
+		"Timeout for each hydra request",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Hydra.Deadline, 5*time.Minute, flagUsage(
+		config.ViperKeys.Hydra.Deadline,
+		"Deadline for all hydra requests, including retries",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.Hydra.Retries, 3, flagUsage(
+		config.ViperKeys.Hydra.Retries,
+		"Retries after hydra 5xx responses or connection errors",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Hydra.Backoff, time.Second, flagUsage(
+		config.ViperKeys.Hydra.Backoff,
+		"Initial delay between hydra retries, doubled each retry with jitter",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Hydra.MaxBackoff, 30*time.Second, flagUsage(
+		config.ViperKeys.Hydra.MaxBackoff,
+		"Maximum delay between hydra retries",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.Rollback.Enable, false, flagUsage(
+		config.ViperKeys.Rollback.Enable,
+		"Roll back to the previous generation if health checks fail after switch or test",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Rollback.Window, time.Minute, flagUsage(
+		config.ViperKeys.Rollback.Window,
+		"Repeat post-activation health checks for this long, 0 checks once",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.Rollback.Interval, 10*time.Second, flagUsage(
+		config.ViperKeys.Rollback.Interval,
+		"Delay between post-activation health checks",
+		false))
 	rootCmd.PersistentFlags().Bool(config.CobraKeys.Reboot, false, flagUsage(
 		config.ViperKeys.Reboot,
 		"Reboot system on successful upgrade",
 		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.RebootPolicy.When, "required", flagUsage(
+		config.ViperKeys.RebootPolicy.When,
+		"[required|always] Reboot only when the kernel, initrd, kernel modules, kernel params or systemd changed, or always",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.RebootPolicy.Marker, "/run/reboot-required", flagUsage(
+		config.ViperKeys.RebootPolicy.Marker,
+		"File recording why a reboot is required when reboot is disabled",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.RebootPolicy.WindowStart, "", flagUsage(
+		config.ViperKeys.RebootPolicy.WindowStart,
+		"HH:MM local time reboots may start after, reboots outside the window are deferred",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.RebootPolicy.WindowEnd, "", flagUsage(
+		config.ViperKeys.RebootPolicy.WindowEnd,
+		"HH:MM local time reboots may start before",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.RebootPolicy.Delay, 0, flagUsage(
+		config.ViperKeys.RebootPolicy.Delay,
+		"Delay reboots, rounded up to minutes, broadcasting the reboot message",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.RebootPolicy.Message, "nixos-hydra-upgrade: rebooting into the upgraded system", flagUsage(
+		config.ViperKeys.RebootPolicy.Message,
+		"Message broadcast to logged in users for delayed reboots",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.RebootLock.Backend, "none", flagUsage(
+		config.ViperKeys.RebootLock.Backend,
+		"[none|http|file] Hold a fleet-wide reboot lock slot from reboot until the verify command passes",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.RebootLock.URL, "", flagUsage(
+		config.ViperKeys.RebootLock.URL,
+		"Lease server url, for the http reboot lock backend",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.RebootLock.Path, "", flagUsage(
+		config.ViperKeys.RebootLock.Path,
+		"Directory on a shared mount, for the file reboot lock backend",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.RebootLock.Slots, 1, flagUsage(
+		config.ViperKeys.RebootLock.Slots,
+		"Concurrent reboots, for the file reboot lock backend",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.RebootLock.TTL, 0, flagUsage(
+		config.ViperKeys.RebootLock.TTL,
+		"Expire file reboot lock slots held longer than this, 0 never expires them",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.RebootLock.Holder, "", flagUsage(
+		config.ViperKeys.RebootLock.Holder,
+		"Identifies this host to the reboot lock, defaults to the hostname",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.TrialBoot, false, flagUsage(
+		config.ViperKeys.TrialBoot,
+		"Boot the new generation once, and make it the default only after the verify command passes. Implies reboot",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.StateDir, "/var/lib/nixos-hydra-upgrade", flagUsage(
+		config.ViperKeys.StateDir,
+		"Directory for persistent state",
+		false))
 	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.HealthCheck.CanaryHosts, []string{}, flagUsage(
 		config.ViperKeys.HealthCheck.CanaryHosts,
 		"Multivalue - Canary systems, only upgrade if these hostnames respond to ping",
 		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.HealthCheck.Ping.Count, 3, flagUsage(
+		config.ViperKeys.HealthCheck.Ping.Count,
+		"Echo requests sent by ping checks",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.HealthCheck.Ping.Interval, time.Second, flagUsage(
+		config.ViperKeys.HealthCheck.Ping.Interval,
+		"Delay between ping check echo requests",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.HealthCheck.Ping.Timeout, 0, flagUsage(
+		config.ViperKeys.HealthCheck.Ping.Timeout,
+		"Time ping checks wait for replies, 0 waits count * interval + 1s",
+		false))
+	rootCmd.PersistentFlags().Float64(config.CobraKeys.HealthCheck.Ping.MaxLoss, 100, flagUsage(
+		config.ViperKeys.HealthCheck.Ping.MaxLoss,
+		"Percent of ping check echo requests that may be lost, at least one reply is always required",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.HealthCheck.Ping.MaxRTT, 0, flagUsage(
+		config.ViperKeys.HealthCheck.Ping.MaxRTT,
+		"Maximum average ping check round trip time, 0 disables",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.HealthCheck.Ping.Privileged, false, flagUsage(
+		config.ViperKeys.HealthCheck.Ping.Privileged,
+		"Ping with raw ICMP sockets instead of unprivileged UDP ICMP sockets",
+		false))
+	rootCmd.PersistentFlags().Int(config.CobraKeys.HealthCheck.Ping.IPVersion, 0, flagUsage(
+		config.ViperKeys.HealthCheck.Ping.IPVersion,
+		"[0|4|6] Ping over IPv4 or IPv6 only, 0 uses either",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.HealthCheck.Timeout, 30*time.Second, flagUsage(
+		config.ViperKeys.HealthCheck.Timeout,
+		"Timeout for each health check without its own",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.HealthCheck.Deadline, 0, flagUsage(
+		config.ViperKeys.HealthCheck.Deadline,
+		"Retry failed health checks without their own deadline until this long after their first attempt, 0 disables retries",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.HealthCheck.Backoff, time.Second, flagUsage(
+		config.ViperKeys.HealthCheck.Backoff,
+		"Initial delay between health check retries, doubled each retry with jitter",
+		false))
+	rootCmd.PersistentFlags().Duration(config.CobraKeys.HealthCheck.MaxBackoff, 30*time.Second, flagUsage(
+		config.ViperKeys.HealthCheck.MaxBackoff,
+		"Maximum delay between health check retries",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.HealthCheck.FailedUnits, "off", flagUsage(
+		config.ViperKeys.HealthCheck.FailedUnits,
+		"[off|abort|continue] Failed systemd units before an upgrade abort it, or are ignored by later health checks",
+		false))
 	rootCmd.PersistentFlags().String(config.CobraKeys.NixBuild.Host, "", flagUsage(
 		config.ViperKeys.NixBuild.Host,
 		"Flake `nixosConfigurations.<name>`, usually hostname",
 		true))
+	rootCmd.PersistentFlags().String(config.CobraKeys.NixBuild.Mode, "eval", flagUsage(
+		config.ViperKeys.NixBuild.Mode,
+		"[eval|substitute] Evaluate the flake locally, or substitute the hydra build output",
+		false))
+	rootCmd.PersistentFlags().String(config.CobraKeys.NixBuild.VerifyOutput, "off", flagUsage(
+		config.ViperKeys.NixBuild.VerifyOutput,
+		"[off|warn|fail] Compare the locally evaluated toplevel with the hydra build output",
+		false))
+	rootCmd.PersistentFlags().Bool(config.CobraKeys.NixBuild.SubstituteOnly, false, flagUsage(
+		config.ViperKeys.NixBuild.SubstituteOnly,
+		"Abort if anything would be built locally instead of substituted, and build with --max-jobs 0",
+		false))
 	rootCmd.PersistentFlags().StringSlice(config.CobraKeys.NixBuild.Args, []string{}, flagUsage(
 		config.ViperKeys.NixBuild.Args,
 		"Multivalue - Additional args to provide to nix build. YAML array",
@@ -176,11 +319,37 @@ Config follows the precedence CLI Flag > Environment variable > YAML config, wit
 	return rootCmd
 }
 
+// structured logging setup
+func setupLogging(conf config.Config) {
+	logLevel := slog.LevelInfo
+	if conf.Debug {
+		logLevel = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel, AddSource: true}))
+	slog.SetDefault(logger)
+}
+
+// loadConfig initializes and validates config for a command, exiting
+// with usage if it's invalid.
+func loadConfig(cmd, rootCmd *cobra.Command, args []string) error {
+	var err error
+	conf, err = config.InitializeConfig(rootCmd, args)
+	if err != nil {
+		return err
+	}
+	err = conf.Validate()
+	if err != nil {
+		cmd.Usage()
+		os.Exit(1)
+	}
+	return nil
+}
+
 // usage string Sprintf helper
 func flagUsage(viperKey, usage string, required bool) string {
 	reqStr := ""
 	if required {
 		reqStr = " (required)"
 	}
-	return fmt.Sprintf("YAML: %-27sENV: %-28s%s\n%s", viperKey, config.GetEnv(viperKey), reqStr, usage)
+	return fmt.Sprintf("YAML: %-28sENV: %-32s%s\n%s", viperKey, config.GetEnv(viperKey), reqStr, usage)
 }
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+	"github.com/spf13/cobra"
+)
+
+// trial boot stage, reported with trial boot and verify failures
+const stageTrialBoot = "trial-boot"
+
+// trialBootState is the state file recording a pending trial boot.
+const trialBootState = "trial-boot.json"
+
+// failedTrialState is the state file recording the last build that
+// failed its trial boot.
+const failedTrialState = "failed-trial.json"
+
+// errTrialNotBooted is returned by verify when the trial generation
+// didn't boot, e.g. because it failed and the boot loader fell back to
+// the default entry.
+var errTrialNotBooted = errors.New("trial boot generation not booted")
+
+// trialBoot describes a generation waiting to be verified.
+type trialBoot struct {
+	// generation that stays the default until verified
+	Previous int `json:"previous"`
+	// generation booted once for verification
+	Generation int    `json:"generation"`
+	Toplevel   string `json:"toplevel"`
+	Build      int    `json:"build"`
+}
+
+// failedTrial is a build that failed its trial boot, skipped by
+// upgrades until hydra has a newer build.
+type failedTrial struct {
+	Build    int    `json:"build"`
+	Toplevel string `json:"toplevel"`
+}
+
+// startTrialBoot restores the previous generation as the loader.conf
+// default, boots the new generation once on the next boot, and records
+// it for verification.
+func (h *host) startTrialBoot(conf config.Config, trial trialBoot) error {
+	err := nix.SwitchToConfiguration(h.runner, nix.GenerationLink(systemProfile, trial.Previous), "boot")
+	if err != nil {
+		return err
+	}
+	err = system.SetOneShotBootEntry(system.SystemdBootEntry(trial.Generation))
+	if err != nil {
+		return err
+	}
+	err = system.WriteState(conf.StateDir, trialBootState, trial)
+	if err != nil {
+		return err
+	}
+	slog.Info("Trial boot scheduled.",
+		slog.Int("generation", trial.Generation),
+		slog.Int("previous", trial.Previous),
+		slog.String("toplevel", trial.Toplevel))
+	return nil
+}
+
+// runVerify verifies the system after a reboot. A pending trial boot
+// is verified first, then a held reboot lock slot is released once
+// health checks pass. Failing health checks keep the slot, so a broken
+// host stops the rest of the fleet rebooting.
+func (h *host) runVerify(ctx context.Context, conf config.Config) error {
+	// units that failed before the upgrade are still ignored
+	var failedUnits []system.FailedUnit
+	_, err := system.ReadState(conf.StateDir, failedUnitsState, &failedUnits)
+	if err != nil {
+		return failStage(stageHealthCheck, err)
+	}
+	ctx = healthcheck.WithUpgrade(ctx, healthcheck.Upgrade{FailedUnits: failedUnits})
+
+	verified, err := h.verifyTrialBoot(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	held, err := rebootLockHeld(conf)
+	if err != nil {
+		return failStage(stageReboot, err)
+	}
+	if !held {
+		return nil
+	}
+	if !verified {
+		check, err := runHealthChecks(ctx, conf.HealthCheck)
+		if err != nil {
+			slog.Warn("Health check failed after reboot, keeping reboot lock.", slog.String("check", check))
+			return failStage(stageHealthCheck, fmt.Errorf("%s: %w", check, err))
+		}
+	}
+	err = releaseRebootLock(ctx, conf)
+	if err != nil {
+		return failStage(stageReboot, err)
+	}
+	return nil
+}
+
+// verifyTrialBoot verifies a pending trial boot. If the trial generation
+// booted and health checks pass, it's promoted to the boot default.
+// Otherwise the trial is abandoned. The trial is only verified once
+// either way. verified reports whether health checks ran and passed.
+func (h *host) verifyTrialBoot(ctx context.Context, conf config.Config) (verified bool, err error) {
+	var trial trialBoot
+	ok, err := system.ReadState(conf.StateDir, trialBootState, &trial)
+	if err != nil {
+		return false, failStage(stageTrialBoot, err)
+	}
+	if !ok {
+		slog.Info("No trial boot to verify.")
+		return false, nil
+	}
+	err = system.RemoveState(conf.StateDir, trialBootState)
+	if err != nil {
+		return false, failStage(stageTrialBoot, err)
+	}
+
+	booted, err := filepath.EvalSymlinks(h.bootedSystem)
+	if err != nil {
+		err = fmt.Errorf("%w: %w", errTrialNotBooted, err)
+		return false, failStage(stageTrialBoot, errors.Join(err, h.abandonTrialBoot(conf, trial)))
+	}
+	if booted != trial.Toplevel {
+		err = fmt.Errorf("%w: generation %d, booted %s, expected %s",
+			errTrialNotBooted, trial.Generation, booted, trial.Toplevel)
+		return false, failStage(stageTrialBoot, errors.Join(err, h.abandonTrialBoot(conf, trial)))
+	}
+
+	upgrade, _ := healthcheck.UpgradeFrom(ctx)
+	upgrade.New = trial.Toplevel
+	upgrade.BuildID = trial.Build
+	check, err := runHealthChecks(healthcheck.WithUpgrade(ctx, upgrade), conf.HealthCheck)
+	if err != nil {
+		slog.Warn("Trial boot health check failed, keeping previous default generation.",
+			slog.String("check", check),
+			slog.Int("generation", trial.Generation),
+			slog.Int("previous", trial.Previous))
+		err = fmt.Errorf("%s: %w", check, err)
+		return false, failStage(stageHealthCheck, errors.Join(err, h.abandonTrialBoot(conf, trial)))
+	}
+
+	err = nix.SwitchToConfiguration(h.runner, trial.Toplevel, "boot")
+	if err != nil {
+		return false, failStage(stageTrialBoot, err)
+	}
+	// loader.conf decides the default, not a persistent bootctl override
+	err = system.ClearDefaultBootEntry()
+	if err != nil {
+		return false, failStage(stageTrialBoot, err)
+	}
+	slog.Info("Trial boot verified, generation is now the boot default.",
+		slog.Int("generation", trial.Generation),
+		slog.Int("build", trial.Build))
+	return true, nil
+}
+
+// abandonTrialBoot switches the system profile back to the previous
+// generation, so later activations don't make the failed generation
+// the boot default, and records its build to skip it.
+func (h *host) abandonTrialBoot(conf config.Config, trial trialBoot) error {
+	err := nix.SwitchGeneration(h.runner, systemProfile, trial.Previous)
+	if err != nil {
+		return err
+	}
+	err = system.WriteState(conf.StateDir, failedTrialState, failedTrial{Build: trial.Build, Toplevel: trial.Toplevel})
+	if err != nil {
+		return err
+	}
+	slog.Warn("Trial boot abandoned, skipping its build until hydra has a newer one.",
+		slog.Int("generation", trial.Generation),
+		slog.Int("previous", trial.Previous),
+		slog.Int("build", trial.Build))
+	return nil
+}
+
+// NewVerifyCommand verifies trial boots and releases reboot locks, and
+// should run once from a boot time unit.
+func NewVerifyCommand(rootCmd *cobra.Command) *cobra.Command {
+	verifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verifies a trial boot with health checks, and makes it the boot default",
+		Long: `Verifies a generation booted once by --trial-boot. If the trial generation is running and health checks pass, it becomes the boot default. Otherwise the previous generation remains the default for the next boot.
+
+A reboot lock slot held since the reboot is released once health checks pass, and kept if they fail.
+
+Should run once from a boot time unit. Exits 0 without a trial boot to verify or reboot lock to release.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return loadConfig(cmd, rootCmd, nil)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			setupLogging(conf)
+			exitOnError(localHost().runVerify(cmd.Context(), conf))
+		},
+	}
+
+	return verifyCmd
+}
@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix/nixtest"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// newVerifyTest returns a host booted into a fake toplevel.
+func newVerifyTest(t *testing.T, toplevel string) (*host, config.Config) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, toplevel), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "booted-system")
+	err = os.Symlink(filepath.Join(dir, toplevel), link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newTestHost(t)
+	h.bootedSystem = link
+
+	var c config.Config
+	c.StateDir = filepath.Join(dir, "state")
+	return h, c
+}
+
+// fakeBootctl puts a bootctl first in PATH that records its arguments,
+// returning a function reading them back one call per line.
+func fakeBootctl(t *testing.T) func() []string {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$1 $2\" >> " + calls + "\n"
+	err := os.WriteFile(filepath.Join(dir, "bootctl"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return func() []string {
+		out, _ := os.ReadFile(calls)
+		return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	}
+}
+
+// fakeSwitch replaces h's runner with one that accepts every
+// switch-to-configuration.
+func fakeSwitch(h *host) *nixtest.Runner {
+	fake := nixtest.NewRunner()
+	fake.Handle("/")
+	h.runner = fake
+	return fake
+}
+
+func TestStartTrialBoot(t *testing.T) {
+	bootctl := fakeBootctl(t)
+	h := newTestHost(t)
+	fake := fakeSwitch(h)
+	var c config.Config
+	c.StateDir = t.TempDir()
+
+	err := h.startTrialBoot(c, trialBoot{Previous: 41, Generation: 42, Toplevel: "/nix/store/bbbb-nixos-system-oak"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the previous generation stays the loader.conf default, without
+	// a persistent override
+	assert.ArrayEqual(t, fake.Commands(), []string{nix.GenerationLink(systemProfile, 41) + "/bin/switch-to-configuration boot"})
+	assert.ArrayEqual(t, bootctl(), []string{"set-oneshot nixos-generation-42.conf"})
+}
+
+func TestVerify(t *testing.T) {
+	t.Run("exits without a trial boot", func(t *testing.T) {
+		h, c := newVerifyTest(t, "bbbb-nixos-system-oak")
+
+		err := h.runVerify(context.Background(), c)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("fails once if the trial generation didn't boot", func(t *testing.T) {
+		h, c := newVerifyTest(t, "aaaa-nixos-system-oak")
+		fake := nixtest.NewRunner()
+		fake.Handle("nix-env")
+		h.runner = fake
+		err := system.WriteState(c.StateDir, trialBootState, trialBoot{
+			Previous:   41,
+			Generation: 42,
+			Toplevel:   "/nix/store/bbbb-nixos-system-oak",
+			Build:      7,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = h.runVerify(context.Background(), c)
+
+		assert.Equal(t, stageOf(err), stageTrialBoot)
+		assert.Equal(t, errors.Is(err, errTrialNotBooted), true)
+		// the profile no longer points at the failed generation, and its
+		// build is skipped
+		assert.ArrayEqual(t, fake.Commands(), []string{"nix-env --profile /nix/var/nix/profiles/system --switch-generation 41"})
+		var failed failedTrial
+		system.ReadState(c.StateDir, failedTrialState, &failed)
+		assert.Equal(t, failed, failedTrial{Build: 7, Toplevel: "/nix/store/bbbb-nixos-system-oak"})
+
+		err = h.runVerify(context.Background(), c)
+		if err != nil {
+			t.Errorf("unexpected error verifying twice: %v", err)
+		}
+	})
+
+	t.Run("verified trials become the loader.conf default", func(t *testing.T) {
+		h, c := newVerifyTest(t, "bbbb-nixos-system-oak")
+		bootctl := fakeBootctl(t)
+		fake := fakeSwitch(h)
+		toplevel, _ := filepath.EvalSymlinks(h.bootedSystem)
+		err := system.WriteState(c.StateDir, trialBootState, trialBoot{Previous: 41, Generation: 42, Toplevel: toplevel})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = h.runVerify(context.Background(), c)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		assert.ArrayEqual(t, fake.Commands(), []string{toplevel + "/bin/switch-to-configuration boot"})
+		// any bootctl default override is cleared
+		assert.ArrayEqual(t, bootctl(), []string{"set-default "})
+	})
+
+	t.Run("corrupt state fails", func(t *testing.T) {
+		h, c := newVerifyTest(t, "bbbb-nixos-system-oak")
+		os.MkdirAll(c.StateDir, 0755)
+		os.WriteFile(filepath.Join(c.StateDir, trialBootState), []byte("{"), 0600)
+
+		err := h.runVerify(context.Background(), c)
+
+		assert.Equal(t, stageOf(err), stageTrialBoot)
+		assert.Equal(t, errors.Is(err, system.ErrState), true)
+	})
+}
+
+func TestTrialBootUpgrade(t *testing.T) {
+	t.Run("upgrades before the trial reboot keep the previous generation the default", func(t *testing.T) {
+		bootctl := fakeBootctl(t)
+		h, server, fake := newUpgradeTest(t)
+		fake.Handle("nix-env --profile /nix/var/nix/profiles/system --list-generations",
+			nixtest.Result{Stdout: "  41   2024-05-01 04:40:12   (current)\n"},
+			nixtest.Result{Stdout: "  42   2024-05-02 04:40:12   (current)\n"})
+		fake.Handle(systemProfile + "-")
+		fake.Handle(testSwitch)
+		// the reboot window is closed, so the trial reboot stays pending
+		actions := fakeReboots(h, 13, 0)
+		conf := testConfig(t, server)
+		conf.TrialBoot = true
+		conf.StateDir = t.TempDir()
+		conf.RebootPolicy.WindowStart = "02:00"
+		conf.RebootPolicy.WindowEnd = "05:00"
+
+		for range 2 {
+			err := h.runUpgrade(context.Background(), conf)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		previous := nix.GenerationLink(systemProfile, 41) + "/bin/switch-to-configuration boot"
+		switches := 0
+		for _, command := range fake.Commands() {
+			if command == previous {
+				switches++
+			}
+		}
+		assert.Equal(t, switches, 2)
+		assert.Equal(t, fake.Ran(nix.GenerationLink(systemProfile, 42)), false)
+		var trial trialBoot
+		system.ReadState(conf.StateDir, trialBootState, &trial)
+		assert.Equal(t, trial.Previous, 41)
+		assert.Equal(t, trial.Generation, 42)
+		assert.ArrayEqual(t, bootctl(), []string{
+			"set-oneshot nixos-generation-42.conf",
+			"set-oneshot nixos-generation-42.conf",
+		})
+		assert.Equal(t, len(*actions), 0)
+	})
+
+	t.Run("builds that failed a trial boot are skipped", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		conf := testConfig(t, server)
+		conf.TrialBoot = true
+		conf.StateDir = t.TempDir()
+		system.WriteState(conf.StateDir, failedTrialState, failedTrial{Build: 1, Toplevel: testOutPath})
+
+		err := h.runUpgrade(context.Background(), conf)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		assert.Equal(t, fake.Ran("nix build"), false)
+	})
+}
@@ -0,0 +1,711 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/backoff"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/hydra"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// upgrade stages, reported with any failure
+const (
+	stageHydra       = "hydra"
+	stageMetadata    = "flake-metadata"
+	stageHealthCheck = "healthcheck"
+	stagePreflight   = "substitute-only"
+	stageBuild       = "build"
+	stageVerify      = "verify-output"
+	stageProfile     = "profile"
+	stageActivation  = "activation"
+	stagePostCheck   = "post-activation"
+	stageRollback    = "rollback"
+	stageReboot      = "reboot"
+)
+
+// systemProfile is the NixOS system profile upgrades are installed to.
+const systemProfile = "/nix/var/nix/profiles/system"
+
+// failedUnitsState records the units that failed before an upgrade, so
+// verify ignores them after a reboot too.
+const failedUnitsState = "failed-units.json"
+
+// stageError associates an upgrade failure with the stage that failed.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.stage, e.err)
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+func failStage(stage string, err error) error {
+	return &stageError{stage: stage, err: err}
+}
+
+// errRetryLater defers an upgrade to a later run without alerting.
+var errRetryLater = errors.New("retry later")
+
+// exit code for errRetryLater, EX_TEMPFAIL from sysexits.h
+const exitCodeRetry = 75
+
+// exitOnError exits with a code matching the error, emitting a single
+// structured event describing it. Returns normally for a nil error.
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+	if errors.Is(err, errRetryLater) {
+		slog.Warn("System upgrade deferred.", slog.Any("reason", err))
+		os.Exit(exitCodeRetry)
+	}
+
+	stage := "unknown"
+	var se *stageError
+	if errors.As(err, &se) {
+		stage = se.stage
+	}
+	slog.Error("System upgrade failed.", slog.String("stage", stage), slog.Any("err", err))
+	os.Exit(1)
+}
+
+// build status policies, see config.HydraConfig.StatusPolicy
+const (
+	policyAlert = "alert"
+	policyRetry = "retry"
+	policySkip  = "skip"
+)
+
+// selectPinnedBuild looks up a pinned build. Pinned builds are deployed
+// on request, so anything but success fails regardless of status
+// policies.
+func selectPinnedBuild(ctx context.Context, client hydra.HydraClient, pin config.HydraPinConfig) (hydra.Build, error) {
+	var build hydra.Build
+	var err error
+	switch {
+	case pin.BuildID != 0:
+		build, err = client.GetBuild(ctx, pin.BuildID)
+	case pin.EvalID != 0:
+		build, err = client.GetEvalJobBuild(ctx, pin.EvalID)
+	default:
+		var eval hydra.Eval
+		eval, err = client.GetRevEval(ctx, pin.Rev)
+		if err != nil {
+			return build, err
+		}
+		slog.Info("Found evaluation for pinned revision.", slog.String("rev", pin.Rev), slog.Int("eval", eval.ID))
+		build, err = client.GetEvalJobBuild(ctx, eval.ID)
+	}
+	if err != nil {
+		return build, err
+	}
+
+	if build.Project != client.Project || build.JobSet != client.JobSet || build.Job != client.Job {
+		return build, fmt.Errorf("%w: build %d is %s:%s:%s, expected %s:%s:%s", hydra.ErrJobMismatch, build.ID,
+			build.Project, build.JobSet, build.Job, client.Project, client.JobSet, client.Job)
+	}
+	if build.Status() != hydra.StatusSucceeded {
+		return build, fmt.Errorf("%w: pinned %s build %d %s", hydra.ErrBuildUnsuccessful, build.Job, build.ID, build.Status())
+	}
+	slog.Info("Selected pinned build.",
+		slog.Int("build", build.ID),
+		slog.Int("build_id", pin.BuildID),
+		slog.Int("eval_id", pin.EvalID),
+		slog.String("rev", pin.Rev))
+	return build, nil
+}
+
+// statusPolicy returns the configured policy for a build status.
+// Statuses without a configured policy alert.
+func statusPolicy(conf config.HydraConfig, status hydra.BuildStatus) string {
+	policy, ok := conf.StatusPolicy[status.String()]
+	if !ok {
+		return policyAlert
+	}
+	return policy
+}
+
+// applyStatusPolicy decides how to end a run for a build that didn't
+// succeed.
+func applyStatusPolicy(conf config.HydraConfig, build hydra.Build) error {
+	status := build.Status()
+
+	switch statusPolicy(conf, status) {
+	case policySkip:
+		slog.Info("Build unsuccessful, skipping upgrade. Exiting.",
+			slog.Int("build", build.ID),
+			slog.String("job", build.Job),
+			slog.String("buildstatus", status.String()))
+		return nil
+	case policyRetry:
+		return fmt.Errorf("%w: %s build %d %s", errRetryLater, build.Job, build.ID, status)
+	default:
+		return failStage(stageHydra, fmt.Errorf("%w: %s build %d %s", hydra.ErrBuildUnsuccessful, build.Job, build.ID, status))
+	}
+}
+
+// checkRequiredBuilds logs every unsuccessful required build. If any
+// are unsuccessful, the one with the most severe policy is returned
+// with ok false.
+func checkRequiredBuilds(conf config.HydraConfig, required []hydra.Build) (unsuccessful hydra.Build, ok bool) {
+	severity := map[string]int{policySkip: 1, policyRetry: 2, policyAlert: 3}
+	worst := 0
+	for _, b := range required {
+		status := b.Status()
+		if status == hydra.StatusSucceeded {
+			continue
+		}
+		policy := statusPolicy(conf, status)
+		slog.Info("Required job unsuccessful.",
+			slog.String("job", b.Job),
+			slog.Int("build", b.ID),
+			slog.String("buildstatus", status.String()),
+			slog.String("policy", policy))
+		if severity[policy] > worst {
+			worst = severity[policy]
+			unsuccessful = b
+		}
+	}
+	if worst == 0 {
+		slog.Info("All required jobs succeeded.", slog.Int("jobs", len(required)))
+		return unsuccessful, true
+	}
+	return unsuccessful, false
+}
+
+// newHydraClient builds a hydra client, resolving any auth secret.
+func newHydraClient(conf config.HydraConfig) (hydra.HydraClient, error) {
+	client := hydra.HydraClient{
+		Instance: conf.Instance,
+		JobSet:   conf.JobSet,
+		Job:      conf.Job,
+		Project:  conf.Project,
+		Auth: hydra.Auth{
+			Method: hydra.AuthMethod(conf.Auth.Method),
+			User:   conf.Auth.User,
+			Header: conf.Auth.Header,
+		},
+		HTTPClient:     &http.Client{},
+		RequestTimeout: conf.Timeout,
+		Retries:        conf.Retries,
+		Backoff: backoff.Backoff{
+			Initial: conf.Backoff,
+			Max:     conf.MaxBackoff,
+		},
+	}
+
+	var err error
+	switch {
+	case conf.Auth.SecretFile != "":
+		client.Auth.Secret, err = system.ReadSecretFile(conf.Auth.SecretFile)
+	case conf.Auth.Credential != "":
+		client.Auth.Secret, err = system.ReadCredential(conf.Auth.Credential)
+	}
+	if err != nil {
+		return client, err
+	}
+
+	if client.Auth.Method == hydra.AuthSession {
+		// cookiejar.New never returns an error
+		client.HTTPClient.Jar, _ = cookiejar.New(nil)
+	}
+	return client, nil
+}
+
+// selectBuild picks the hydra build to upgrade to according to the
+// configured pin or selection mode.
+func selectBuild(ctx context.Context, client hydra.HydraClient, conf config.HydraConfig) (hydra.Build, error) {
+	if conf.Pin.Pinned() {
+		return selectPinnedBuild(ctx, client, conf.Pin)
+	}
+
+	switch conf.Selection {
+	case "latest-finished":
+		return client.GetLatestFinishedBuild(ctx)
+	case "latest-successful":
+		build, skipped, err := client.GetLatestSuccessfulBuild(ctx, conf.SearchDepth)
+		for _, s := range skipped {
+			slog.Info("Skipping newer unsuccessful build.",
+				slog.Int("build", s.ID),
+				slog.String("buildstatus", s.Status().String()))
+		}
+		if err != nil {
+			return build, err
+		}
+		slog.Info("Selected latest successful build.", slog.Int("build", build.ID), slog.Int("skipped", len(skipped)))
+		return build, nil
+	default:
+		return client.GetLatestBuild(ctx)
+	}
+}
+
+// substituteOnlyPreflight fails if realising toplevel would build any
+// derivation locally instead of substituting it, logging a report of
+// what would be built.
+func (h *host) substituteOnlyPreflight(toplevel string, args []string) error {
+	report, err := nix.NixDryRun(h.runner, toplevel, args)
+	if err != nil {
+		return err
+	}
+	if len(report.Build) == 0 {
+		slog.Info("Substitute only preflight passed.", slog.Int("fetch", len(report.Fetch)))
+		return nil
+	}
+
+	slog.Warn("Substitute only preflight found local builds.",
+		slog.String("toplevel", toplevel),
+		slog.Int("fetch", len(report.Fetch)),
+		slog.Int("build", len(report.Build)),
+		slog.Any("would_build", report.Build))
+	return fmt.Errorf("%w: %d derivations", nix.ErrWouldBuild, len(report.Build))
+}
+
+// verifyOutput compares a locally built toplevel with the output hydra
+// built and tested. Mismatches are logged with both store and
+// derivation paths, and only returned as an error in fail mode.
+func (h *host) verifyOutput(mode string, build hydra.Build, result string) error {
+	if mode == "off" {
+		return nil
+	}
+
+	hydraOut, err := build.OutPath()
+	if err == nil && hydraOut == result {
+		slog.Info("Build output matches hydra.", slog.String("result", result))
+		return nil
+	}
+
+	localDrv, drvErr := nix.Deriver(h.runner, result)
+	if drvErr != nil {
+		localDrv = drvErr.Error()
+	}
+	slog.Warn("Build output differs from hydra.",
+		slog.String("mode", mode),
+		slog.String("local_out", result),
+		slog.String("local_drv", localDrv),
+		slog.String("hydra_out", hydraOut),
+		slog.String("hydra_drv", build.DrvPath),
+		slog.Int("build", build.ID))
+
+	if mode != "fail" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: local %s, hydra %s", nix.ErrOutputMismatch, result, hydraOut)
+}
+
+// healthChecks creates the configured health checks. Canary hosts are
+// ping checks named "ping <host>" in the group "canary", and failed
+// units are checked by a systemd check named "failed units".
+func healthChecks(conf config.HealthCheckConfig) ([]healthcheck.Check, error) {
+	specs := make([]healthcheck.Spec, 0, len(conf.CanaryHosts)+len(conf.Checks))
+	for _, h := range conf.CanaryHosts {
+		specs = append(specs, healthcheck.Spec{
+			Name:     "ping " + h,
+			Kind:     "ping",
+			Group:    "canary",
+			Settings: pingSettings(conf.Ping, map[string]any{"host": h}),
+		})
+	}
+	if conf.FailedUnits != "" && conf.FailedUnits != "off" {
+		specs = append(specs, healthcheck.Spec{Name: "failed units", Kind: "systemd"})
+	}
+	for _, spec := range conf.Checks {
+		if spec.Kind == "ping" {
+			spec.Settings = pingSettings(conf.Ping, spec.Settings)
+		}
+		specs = append(specs, spec)
+	}
+	return healthcheck.NewChecks(specs)
+}
+
+// pingSettings returns the global ping settings overridden by the
+// settings of a single ping check.
+func pingSettings(conf config.PingConfig, settings map[string]any) map[string]any {
+	merged := map[string]any{
+		"count":      conf.Count,
+		"interval":   conf.Interval,
+		"timeout":    conf.Timeout,
+		"max_loss":   conf.MaxLoss,
+		"max_rtt":    conf.MaxRTT,
+		"privileged": conf.Privileged,
+		"ip_version": conf.IPVersion,
+	}
+	maps.Copy(merged, settings)
+	return merged
+}
+
+// failedUnitsBaseline checks for systemd units that failed before an
+// upgrade. In abort mode any fail the upgrade, in continue mode they're
+// recorded and returned to be ignored by later health checks.
+func failedUnitsBaseline(ctx context.Context, conf config.Config) ([]system.FailedUnit, error) {
+	mode := conf.HealthCheck.FailedUnits
+	if mode == "" || mode == "off" {
+		return nil, nil
+	}
+	units, err := system.FailedUnits(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(units) > 0 {
+		if mode == "abort" {
+			return nil, fmt.Errorf("%w before upgrade: %s", healthcheck.ErrFailedUnits, strings.Join(system.UnitNames(units), ", "))
+		}
+		slog.Warn("System degraded before upgrade, ignoring failed units in health checks unless they fail again.",
+			slog.Any("units", system.UnitNames(units)))
+	}
+	err = system.WriteState(conf.StateDir, failedUnitsState, units)
+	if err != nil {
+		return nil, err
+	}
+	return units, nil
+}
+
+// runHealthChecks runs the configured health checks concurrently,
+// logging each result and the quorum decision for each group. Returns
+// the name of the first check or group to fail.
+func runHealthChecks(ctx context.Context, conf config.HealthCheckConfig) (check string, err error) {
+	checks, err := healthChecks(conf)
+	if err != nil {
+		return "", err
+	}
+	results := healthcheck.RunAll(ctx, checks, healthcheck.Options{
+		Timeout:  conf.Timeout,
+		Deadline: conf.Deadline,
+		Backoff: backoff.Backoff{
+			Initial: conf.Backoff,
+			Max:     conf.MaxBackoff,
+		},
+	})
+	for _, r := range results {
+		if r.Err != nil {
+			slog.Warn("Health check failed.", slog.Any("check", r))
+		} else {
+			slog.Info("Health check passed.", slog.Any("check", r))
+		}
+	}
+
+	quorums := results.Quorums(conf.Groups)
+	for _, q := range quorums {
+		if q.Group == "" {
+			continue
+		}
+		if q.Err() != nil {
+			slog.Warn("Health check group failed.", slog.Any("group", q))
+		} else {
+			slog.Info("Health check group passed.", slog.Any("group", q))
+		}
+	}
+	for _, q := range quorums {
+		err = q.Err()
+		if err != nil {
+			return q.Name(), err
+		}
+	}
+	slog.Info("Health checks passed.", slog.Int("checks", len(results)), slog.Int("failed", len(results.Failed())))
+	return "", nil
+}
+
+// watchHealthChecks runs check every interval until window has
+// elapsed, returning the first failure. A zero window checks once.
+func watchHealthChecks(ctx context.Context, window, interval time.Duration, check func() (string, error)) (string, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		name, err := check()
+		if err != nil {
+			return name, err
+		}
+		slog.Debug("Post-activation health checks passed.", slog.Int("attempt", attempt))
+		if time.Since(start)+interval > window {
+			return "", nil
+		}
+		err = backoff.Sleep(ctx, interval)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// postActivation watches health checks after a configuration is
+// activated. If any fail within the rollback window, the system profile
+// is rolled back to the previous generation and reactivated.
+func (h *host) postActivation(ctx context.Context, conf config.Config, check func() (string, error)) error {
+	name, err := watchHealthChecks(ctx, conf.Rollback.Window, conf.Rollback.Interval, check)
+	if err == nil {
+		slog.Info("Post-activation health checks passed.", slog.Duration("window", conf.Rollback.Window))
+		return nil
+	}
+	checkErr := fmt.Errorf("%s: %w", name, err)
+
+	slog.Warn("Post-activation health check failed, rolling back.",
+		slog.String("check", name),
+		slog.Any("err", err))
+	err = nix.Rollback(h.runner, systemProfile)
+	if err != nil {
+		return failStage(stageRollback, fmt.Errorf("%w: after %w", err, checkErr))
+	}
+	err = nix.SwitchToConfiguration(h.runner, systemProfile, conf.NixBuild.Operation)
+	if err != nil {
+		return failStage(stageRollback, fmt.Errorf("%w: after %w", err, checkErr))
+	}
+
+	slog.Warn("System upgrade rolled back.",
+		slog.String("check", name),
+		slog.Any("err", checkErr),
+		slog.String("profile", systemProfile),
+		slog.String("operation", conf.NixBuild.Operation))
+	return failStage(stagePostCheck, checkErr)
+}
+
+// runUpgrade performs the full upgrade flow. Returning nil without
+// upgrading is expected when there is nothing to do.
+func (h *host) runUpgrade(ctx context.Context, conf config.Config) error {
+	// busy machines are upgraded on a later run, those that can't tell
+	// are retried
+	reason, err := h.unmetCondition(ctx, conf.Conditions)
+	if err != nil {
+		return fmt.Errorf("%w: unable to check run conditions: %w", errRetryLater, err)
+	}
+	if reason != "" {
+		slog.Info("Run conditions not met, skipping upgrade. Exiting.", slog.String("reason", reason))
+		return nil
+	}
+
+	// get latest hydra build status and flake
+	hydraClient, err := newHydraClient(conf.Hydra)
+	if err != nil {
+		return failStage(stageHydra, err)
+	}
+	hydraCtx := ctx
+	if conf.Hydra.Deadline > 0 {
+		var cancel context.CancelFunc
+		hydraCtx, cancel = context.WithTimeout(ctx, conf.Hydra.Deadline)
+		defer cancel()
+	}
+
+	err = hydraClient.Login(hydraCtx)
+	if err != nil {
+		return failStage(stageHydra, err)
+	}
+
+	build, err := selectBuild(hydraCtx, hydraClient, conf.Hydra)
+	if err != nil {
+		return failStage(stageHydra, err)
+	}
+	if build.Status() != hydra.StatusSucceeded {
+		return applyStatusPolicy(conf.Hydra, build)
+	}
+
+	if len(conf.Hydra.RequiredJobs) > 0 || conf.Hydra.AggregateJob != "" {
+		required, err := hydraClient.GetRequiredBuilds(hydraCtx, build, conf.Hydra.RequiredJobs, conf.Hydra.AggregateJob)
+		if err != nil {
+			return failStage(stageHydra, err)
+		}
+		unsuccessful, ok := checkRequiredBuilds(conf.Hydra, required)
+		if !ok {
+			return applyStatusPolicy(conf.Hydra, unsuccessful)
+		}
+	}
+
+	eval, err := hydraClient.GetEval(hydraCtx, build)
+	if err != nil {
+		return failStage(stageHydra, err)
+	}
+
+	// check flake metadata to see if this is an update
+	selfMetadata, err := nix.GetFlakeMetadata(h.runner, "self")
+	if err != nil {
+		return failStage(stageMetadata, err)
+	}
+	hydraMetadata, err := nix.GetFlakeMetadata(h.runner, eval.Flake)
+	if err != nil {
+		return failStage(stageMetadata, err)
+	}
+
+	// never go backwards, even when selection fell back to an older
+	// build, unless explicitly allowed for a pinned build
+	allowDowngrade := conf.Hydra.Pin.AllowDowngrade && conf.Hydra.Pin.Pinned()
+	if selfMetadata.LastModified == hydraMetadata.LastModified ||
+		(selfMetadata.LastModified > hydraMetadata.LastModified && !allowDowngrade) {
+		slog.Info("System is already up to date. Exiting.",
+			slog.Int("build", build.ID),
+			slog.Int64("system_last_modified", selfMetadata.LastModified),
+			slog.Int64("build_last_modified", hydraMetadata.LastModified))
+		// trial boots reboot without reboot enabled
+		if conf.Reboot || conf.TrialBoot {
+			return h.runRebootPending(ctx, conf)
+		}
+		return nil
+	}
+	if selfMetadata.LastModified > hydraMetadata.LastModified {
+		slog.Warn("Downgrading system to an older build.",
+			slog.Int("build", build.ID),
+			slog.Int64("system_last_modified", selfMetadata.LastModified),
+			slog.Int64("build_last_modified", hydraMetadata.LastModified))
+	}
+	flakeSpec := fmt.Sprintf("%s#%s", hydraMetadata.OriginalUrl, conf.NixBuild.Host)
+
+	// builds that failed a trial boot wait for a newer build
+	hydraOut, _ := build.OutPath()
+	var failed failedTrial
+	ok, err := system.ReadState(conf.StateDir, failedTrialState, &failed)
+	if err != nil {
+		return failStage(stageTrialBoot, err)
+	}
+	if ok && (failed.Build == build.ID || (hydraOut != "" && hydraOut == failed.Toplevel)) {
+		slog.Warn("Build failed its trial boot, waiting for a newer build. Exiting.",
+			slog.Int("build", build.ID),
+			slog.String("toplevel", failed.Toplevel))
+		return nil
+	}
+
+	// health checks, told about the hydra output before it's built
+	// locally
+	upgrade := healthcheck.Upgrade{New: hydraOut, BuildID: build.ID}
+	upgrade.Current, err = filepath.EvalSymlinks(h.currentSystem)
+	if err != nil {
+		slog.Debug("Current system unknown.", slog.Any("err", err))
+	}
+	upgrade.FailedUnits, err = failedUnitsBaseline(ctx, conf)
+	if err != nil {
+		return failStage(stageHealthCheck, err)
+	}
+	check, err := runHealthChecks(healthcheck.WithUpgrade(ctx, upgrade), conf.HealthCheck)
+	if err != nil {
+		return failStage(stageHealthCheck, fmt.Errorf("%s: %w", check, err))
+	}
+
+	// toplevel is evaluated locally in eval mode, or the hydra output
+	// store path in substitute mode
+	var toplevel, result string
+	switch conf.NixBuild.Mode {
+	case "substitute":
+		toplevel, err = build.OutPath()
+		if err != nil {
+			return failStage(stageHydra, err)
+		}
+	default:
+		toplevel, err = nix.FlakeToToplevel(flakeSpec)
+		if err != nil {
+			return failStage(stageBuild, err)
+		}
+	}
+
+	buildArgs := conf.NixBuild.Args
+	if conf.NixBuild.SubstituteOnly {
+		err = h.substituteOnlyPreflight(toplevel, buildArgs)
+		if err != nil {
+			return failStage(stagePreflight, err)
+		}
+		// appended last so passthru args can't re-enable local builds
+		buildArgs = append(slices.Clone(buildArgs), "--max-jobs", "0")
+	}
+
+	switch conf.NixBuild.Mode {
+	case "substitute":
+		slog.Info("Substituting hydra build output.",
+			slog.String("toplevel", toplevel),
+			slog.String("drvpath", build.DrvPath),
+			slog.String("nixname", build.NixName))
+		result, err = nix.Realise(h.runner, toplevel, buildArgs)
+		if err != nil {
+			return failStage(stageBuild, err)
+		}
+		slog.Info("Substitution complete", slog.String("result", result))
+	default:
+		slog.Info("Building toplevel derivation.", slog.String("toplevel", toplevel))
+		result, err = nix.NixBuild(h.runner, toplevel, buildArgs)
+		if err != nil {
+			return failStage(stageBuild, err)
+		}
+		slog.Info("Build complete", slog.String("result", result))
+
+		err = h.verifyOutput(conf.NixBuild.VerifyOutput, build, result)
+		if err != nil {
+			return failStage(stageVerify, err)
+		}
+	}
+
+	var trial trialBoot
+	if conf.TrialBoot {
+		// a trial still waiting for its reboot already made the current
+		// generation untested
+		var pending trialBoot
+		ok, err = system.ReadState(conf.StateDir, trialBootState, &pending)
+		if err != nil {
+			return failStage(stageTrialBoot, err)
+		}
+		trial.Previous = pending.Previous
+		if !ok {
+			trial.Previous, err = nix.CurrentGeneration(h.runner, systemProfile)
+			if err != nil {
+				return failStage(stageProfile, err)
+			}
+		}
+	}
+
+	// default profile only for now is fine.
+	result, err = nix.NixBuild(h.runner, toplevel, append([]string{"--profile", systemProfile}, buildArgs...))
+	if err != nil {
+		return failStage(stageProfile, err)
+	}
+	slog.Info("Switched to new profile", slog.String("result", result))
+	if conf.TrialBoot {
+		trial.Generation, err = nix.CurrentGeneration(h.runner, systemProfile)
+		if err != nil {
+			return failStage(stageProfile, err)
+		}
+	}
+
+	nix.NixDiff(h.runner, systemProfile, result)
+
+	slog.Info("executing switch-to-derivation", slog.String("toplevel", toplevel), slog.String("operation", conf.NixBuild.Operation))
+	err = nix.SwitchToConfiguration(h.runner, result, conf.NixBuild.Operation)
+	if err != nil {
+		return failStage(stageActivation, err)
+	}
+
+	if conf.Rollback.Enable && (conf.NixBuild.Operation == "switch" || conf.NixBuild.Operation == "test") {
+		upgrade.New = result
+		checkCtx := healthcheck.WithUpgrade(ctx, upgrade)
+		err = h.postActivation(ctx, conf, func() (string, error) {
+			return runHealthChecks(checkCtx, conf.HealthCheck)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if conf.TrialBoot {
+		trial.Toplevel = result
+		trial.Build = build.ID
+		err = h.startTrialBoot(conf, trial)
+		if err != nil {
+			return failStage(stageTrialBoot, err)
+		}
+	}
+
+	slog.Info("System upgrade complete.", slog.String("flake", flakeSpec))
+
+	return h.rebootAfterUpgrade(ctx, conf, result)
+}
@@ -0,0 +1,575 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/cmd/config"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/hydra"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/hydra/hydratest"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix/nixtest"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+const (
+	testFlake    = "github:hyperparabolic/nix-config/c717fb0df0c30ead2f33ab2eecf4640f57fb5517"
+	testToplevel = testFlake + "#nixosConfigurations.oak.config.system.build.toplevel"
+	testOutPath  = "/nix/store/bbbb-nixos-system-oak"
+	testSwitch   = testOutPath + "/bin/switch-to-configuration"
+)
+
+// newTestHost returns a host booted into an empty fake toplevel, with a
+// nix runner that fails every command, no power supplies or load
+// average, and reboots that fail the test.
+func newTestHost(t *testing.T) *host {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "aaaa-nixos-system-oak"), 0755)
+	os.Symlink(filepath.Join(dir, "aaaa-nixos-system-oak"), filepath.Join(dir, "booted-system"))
+
+	unexpected := func(action string) error {
+		t.Errorf("unexpected %s", action)
+		return system.ErrRebootFailed
+	}
+	return &host{
+		runner:         nixtest.NewRunner(),
+		currentSystem:  filepath.Join(dir, "booted-system"),
+		bootedSystem:   filepath.Join(dir, "booted-system"),
+		powerSupplyDir: filepath.Join(dir, "power_supply"),
+		loadAvgFile:    filepath.Join(dir, "loadavg"),
+		systemReboot:   func() error { return unexpected("reboot") },
+		systemScheduleReboot: func(delay time.Duration, message string) error {
+			return unexpected("scheduled reboot")
+		},
+		systemCancelReboot: func() error { return unexpected("reboot cancel") },
+		now:                time.Now,
+	}
+}
+
+// newUpgradeTest serves a successful build of hosts.oak from a fake
+// hydra, and fakes nix commands for a host one commit behind it.
+func newUpgradeTest(t *testing.T) (*host, *hydratest.Server, *nixtest.Runner) {
+	server := hydratest.NewServer(t)
+	server.AddBuild(hydra.Build{
+		ID:           1,
+		Project:      "nix-config",
+		JobSet:       "main",
+		Job:          "hosts.oak",
+		Finished:     1,
+		BuildStatus:  hydra.StatusSucceeded,
+		JobSetEvals:  []int{10},
+		NixName:      "nixos-system-oak",
+		DrvPath:      "/nix/store/aaaa-nixos-system-oak.drv",
+		BuildOutputs: map[string]hydra.BuildOutput{"out": {Path: testOutPath}},
+	})
+	server.AddEval("nix-config", "main", hydra.Eval{ID: 10, Flake: testFlake})
+	server.SetLatest("nix-config", "main", "hosts.oak", 1)
+
+	fake := nixtest.NewRunner()
+	fake.Handle("nix flake metadata self", nixtest.Result{Stdout: `{"lastModified":100,"originalUrl":"github:hyperparabolic/nix-config"}`})
+	fake.Handle("nix flake metadata "+testFlake, nixtest.Result{Stdout: `{"lastModified":200,"originalUrl":"` + testFlake + `"}`})
+	// store paths are reported without outputs
+	fake.Handle("nix build "+testOutPath, nixtest.Result{Stdout: `[{"path":"` + testOutPath + `"}]`})
+	fake.Handle("nix build", nixtest.Result{Stdout: `[{"drvPath":"/nix/store/aaaa-nixos-system-oak.drv","outputs":{"out":"` + testOutPath + `"}}]`})
+	fake.Handle("dix")
+
+	h := newTestHost(t)
+	h.runner = fake
+	return h, server, fake
+}
+
+// executeRoot runs the root command upgrading h. Only use with
+// successful upgrades, failures exit the test binary. Returns the
+// reboot required marker path.
+func executeRoot(t *testing.T, h *host, server *hydratest.Server, args ...string) string {
+	marker := filepath.Join(t.TempDir(), "reboot-required")
+	rootCmd := newRootCmd(h)
+	rootCmd.SetArgs(append([]string{
+		"--reboot-marker", marker,
+		"--state-dir", t.TempDir(),
+		"--instance", server.URL,
+		"--project", "nix-config",
+		"--jobset", "main",
+		"--job", "hosts.oak",
+		"--host", "oak",
+		"--hydra-backoff", "1ms",
+	}, args...))
+	err := rootCmd.ExecuteContext(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return marker
+}
+
+func testConfig(t *testing.T, server *hydratest.Server) config.Config {
+	var c config.Config
+	c.Hydra.Instance = server.URL
+	c.Hydra.Project = "nix-config"
+	c.Hydra.JobSet = "main"
+	c.Hydra.Job = "hosts.oak"
+	c.Hydra.Auth.Method = "none"
+	c.Hydra.Selection = "latest"
+	c.Hydra.Timeout = time.Second
+	c.Hydra.Retries = 1
+	c.Hydra.Backoff = time.Millisecond
+	c.NixBuild.Operation = "boot"
+	c.NixBuild.Mode = "eval"
+	c.NixBuild.VerifyOutput = "off"
+	c.NixBuild.Host = "oak"
+	c.RebootPolicy.When = "required"
+	c.RebootPolicy.Marker = filepath.Join(t.TempDir(), "reboot-required")
+	return c
+}
+
+func stageOf(err error) string {
+	var se *stageError
+	if errors.As(err, &se) {
+		return se.stage
+	}
+	return ""
+}
+
+func TestUpgrade(t *testing.T) {
+	t.Run("evaluates, builds, and activates the latest hydra build", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		fake.Handle(testSwitch)
+
+		executeRoot(t, h, server, "switch")
+
+		assert.ArrayEqual(t, fake.Commands(), []string{
+			"nix flake metadata self --json",
+			"nix flake metadata " + testFlake + " --json",
+			"nix build " + testToplevel + " --no-link --json",
+			"nix build " + testToplevel + " --no-link --json --profile /nix/var/nix/profiles/system",
+			"dix /nix/var/nix/profiles/system " + testOutPath,
+			testSwitch + " switch",
+		})
+	})
+
+	t.Run("substitutes the hydra output without local evaluation", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		fake.Handle(testSwitch)
+
+		executeRoot(t, h, server, "--mode", "substitute", "--substitute-only")
+
+		assert.Equal(t, fake.Ran("nix build "+testToplevel), false)
+		assert.Equal(t, fake.Ran("nix build "+testOutPath+" --dry-run"), true)
+		assert.Equal(t, fake.Ran("nix build "+testOutPath+" --no-link --json --max-jobs 0"), true)
+		assert.Equal(t, fake.Ran(testSwitch+" boot"), true)
+	})
+
+	t.Run("substitutions without a store path fail at the build stage", func(t *testing.T) {
+		h, server, _ := newUpgradeTest(t)
+		// handlers match in order, replace the default runner
+		fake := nixtest.NewRunner()
+		fake.Handle("nix flake metadata self", nixtest.Result{Stdout: `{"lastModified":100}`})
+		fake.Handle("nix flake metadata", nixtest.Result{Stdout: `{"lastModified":200}`})
+		fake.Handle("nix build", nixtest.Result{Stdout: `[{"outputs":{}}]`})
+		h.runner = fake
+		conf := testConfig(t, server)
+		conf.NixBuild.Mode = "substitute"
+
+		err := h.runUpgrade(context.Background(), conf)
+
+		assert.Equal(t, stageOf(err), stageBuild)
+		assert.Equal(t, errors.Is(err, nix.ErrDecode), true)
+		assert.Equal(t, fake.Ran("nix build "+testOutPath+" --no-link --json --profile"), false)
+	})
+
+	t.Run("exits without building when already up to date", func(t *testing.T) {
+		h, server, _ := newUpgradeTest(t)
+		// handlers match in order, replace the default runner
+		fake := nixtest.NewRunner()
+		fake.Handle("nix flake metadata", nixtest.Result{Stdout: `{"lastModified":200}`})
+		h.runner = fake
+
+		executeRoot(t, h, server)
+
+		assert.Equal(t, fake.Ran("nix build"), false)
+		assert.Equal(t, fake.Ran(testSwitch), false)
+	})
+
+	t.Run("trial boots perform pending reboots when already up to date", func(t *testing.T) {
+		h, server, _ := newUpgradeTest(t)
+		fake := nixtest.NewRunner()
+		fake.Handle("nix flake metadata", nixtest.Result{Stdout: `{"lastModified":200}`})
+		h.runner = fake
+		actions := fakeReboots(h, 3, 0)
+		conf := testConfig(t, server)
+		conf.TrialBoot = true
+		conf.StateDir = t.TempDir()
+		conf.RebootPolicy.WindowStart = "02:00"
+		conf.RebootPolicy.WindowEnd = "05:00"
+		booted, _ := filepath.EvalSymlinks(h.bootedSystem)
+		system.WriteState(conf.StateDir, rebootPendingState, pendingReboot{Reasons: []string{"trial-boot"}, Booted: booted})
+
+		err := h.runUpgrade(context.Background(), conf)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		assert.ArrayEqual(t, *actions, []string{"reboot"})
+	})
+
+	t.Run("unsuccessful builds fail at the hydra stage", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		server.AddBuild(hydra.Build{ID: 2, Job: "hosts.oak", Finished: 1, BuildStatus: hydra.StatusFailed, JobSetEvals: []int{20}})
+		server.SetLatest("nix-config", "main", "hosts.oak", 2)
+
+		err := h.runUpgrade(context.Background(), testConfig(t, server))
+
+		assert.Equal(t, stageOf(err), stageHydra)
+		assert.Equal(t, errors.Is(err, hydra.ErrBuildUnsuccessful), true)
+		assert.Equal(t, len(fake.Commands()), 0)
+	})
+
+	t.Run("hydra errors fail at the hydra stage after retries", func(t *testing.T) {
+		h, server, _ := newUpgradeTest(t)
+		server.InjectFault("/job/nix-config/main/hosts.oak/latest", hydratest.Fault{Status: 502}, hydratest.Fault{Status: 502})
+
+		err := h.runUpgrade(context.Background(), testConfig(t, server))
+
+		assert.Equal(t, stageOf(err), stageHydra)
+		assert.Equal(t, errors.Is(err, hydra.ErrHTTPStatus), true)
+		assert.Equal(t, server.Requests("/job/nix-config/main/hosts.oak/latest"), 2)
+	})
+
+	t.Run("health checks are told about the upgrade", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		fake.Handle(testSwitch)
+		dir := t.TempDir()
+		check := filepath.Join(dir, "check.sh")
+		env := filepath.Join(dir, "env")
+		os.WriteFile(check, []byte("#!/bin/sh\necho $NHU_CURRENT_SYSTEM $NHU_NEW_SYSTEM $NHU_HYDRA_BUILD_ID >> "+env+"\n"), 0755)
+		conf := testConfig(t, server)
+		conf.HealthCheck.Checks = []healthcheck.Spec{{Name: "script", Kind: "exec", Settings: map[string]any{"command": check}}}
+
+		err := h.runUpgrade(context.Background(), conf)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		current, _ := filepath.EvalSymlinks(h.currentSystem)
+		contents, _ := os.ReadFile(env)
+		assert.Equal(t, string(contents), current+" "+testOutPath+" 1\n")
+	})
+
+	t.Run("build failures fail at the build stage", func(t *testing.T) {
+		h, server, _ := newUpgradeTest(t)
+		// handlers match in order, replace the default runner
+		fake := nixtest.NewRunner()
+		fake.Handle("nix flake metadata self", nixtest.Result{Stdout: `{"lastModified":100}`})
+		fake.Handle("nix flake metadata", nixtest.Result{Stdout: `{"lastModified":200,"originalUrl":"` + testFlake + `"}`})
+		fake.Handle("nix build", nixtest.Result{Stderr: "error: builder failed", ExitCode: 1})
+		h.runner = fake
+
+		err := h.runUpgrade(context.Background(), testConfig(t, server))
+
+		assert.Equal(t, stageOf(err), stageBuild)
+		assert.Equal(t, errors.Is(err, nix.ErrBuildFailed), true)
+	})
+
+	t.Run("missing switch-to-configuration fails at the activation stage", func(t *testing.T) {
+		h, server, _ := newUpgradeTest(t)
+
+		err := h.runUpgrade(context.Background(), testConfig(t, server))
+
+		assert.Equal(t, stageOf(err), stageActivation)
+		assert.Equal(t, errors.Is(err, nix.ErrActivationFailed), true)
+	})
+}
+
+// newerSystemRunner fakes a running system newer than the hydra build.
+func newerSystemRunner() *nixtest.Runner {
+	fake := nixtest.NewRunner()
+	fake.Handle("nix flake metadata self", nixtest.Result{Stdout: `{"lastModified":300}`})
+	fake.Handle("nix flake metadata", nixtest.Result{Stdout: `{"lastModified":200}`})
+	fake.Handle("nix build", nixtest.Result{Stdout: `[{"outputs":{"out":"` + testOutPath + `"}}]`})
+	fake.Handle("dix")
+	fake.Handle(testSwitch)
+	return fake
+}
+
+func TestPins(t *testing.T) {
+	t.Run("pinned builds of other jobsets are refused", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		server.AddBuild(hydra.Build{ID: 3, Project: "nix-config", JobSet: "staging", Job: "hosts.oak", Finished: 1, BuildStatus: hydra.StatusSucceeded, JobSetEvals: []int{10}})
+		conf := testConfig(t, server)
+		conf.Hydra.Pin.BuildID = 3
+
+		err := h.runUpgrade(context.Background(), conf)
+
+		assert.Equal(t, stageOf(err), stageHydra)
+		assert.Equal(t, errors.Is(err, hydra.ErrJobMismatch), true)
+		assert.Equal(t, len(fake.Commands()), 0)
+	})
+
+	t.Run("pinned builds may downgrade", func(t *testing.T) {
+		h, server, _ := newUpgradeTest(t)
+		fake := newerSystemRunner()
+		h.runner = fake
+		conf := testConfig(t, server)
+		conf.Hydra.Pin.BuildID = 1
+		conf.Hydra.Pin.AllowDowngrade = true
+
+		err := h.runUpgrade(context.Background(), conf)
+
+		assert.Equal(t, err, nil)
+		assert.Equal(t, fake.Ran(testSwitch+" boot"), true)
+	})
+
+	t.Run("selected builds never downgrade", func(t *testing.T) {
+		h, server, _ := newUpgradeTest(t)
+		fake := newerSystemRunner()
+		h.runner = fake
+		conf := testConfig(t, server)
+		conf.Hydra.Pin.AllowDowngrade = true
+
+		err := h.runUpgrade(context.Background(), conf)
+
+		assert.Equal(t, err, nil)
+		assert.Equal(t, fake.Ran("nix build"), false)
+	})
+}
+
+func TestPostActivation(t *testing.T) {
+	rollbackConfig := func(window time.Duration) config.Config {
+		var c config.Config
+		c.NixBuild.Operation = "switch"
+		c.Rollback.Enable = true
+		c.Rollback.Window = window
+		c.Rollback.Interval = time.Millisecond
+		return c
+	}
+
+	t.Run("zero window checks once", func(t *testing.T) {
+		h, _, fake := newUpgradeTest(t)
+		checks := 0
+
+		err := h.postActivation(context.Background(), rollbackConfig(0), func() (string, error) {
+			checks++
+			return "", nil
+		})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, checks, 1)
+		assert.Equal(t, len(fake.Commands()), 0)
+	})
+
+	t.Run("checks repeat for the window", func(t *testing.T) {
+		h, _, fake := newUpgradeTest(t)
+		checks := 0
+
+		err := h.postActivation(context.Background(), rollbackConfig(20*time.Millisecond), func() (string, error) {
+			checks++
+			return "", nil
+		})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, checks > 1, true)
+		assert.Equal(t, len(fake.Commands()), 0)
+	})
+
+	t.Run("failed checks roll back and reactivate the previous generation", func(t *testing.T) {
+		h, _, fake := newUpgradeTest(t)
+		fake.Handle("nix-env")
+		fake.Handle(systemProfile + "/bin/switch-to-configuration")
+		checks := 0
+
+		err := h.postActivation(context.Background(), rollbackConfig(time.Minute), func() (string, error) {
+			checks++
+			if checks == 2 {
+				return "ping canary.example.com", healthcheck.ErrPingFailed
+			}
+			return "", nil
+		})
+
+		assert.Equal(t, stageOf(err), stagePostCheck)
+		assert.Equal(t, errors.Is(err, healthcheck.ErrPingFailed), true)
+		assert.ArrayEqual(t, fake.Commands(), []string{
+			"nix-env --profile /nix/var/nix/profiles/system --rollback",
+			"/nix/var/nix/profiles/system/bin/switch-to-configuration switch",
+		})
+	})
+
+	t.Run("rollback failures fail at the rollback stage", func(t *testing.T) {
+		h, _, fake := newUpgradeTest(t)
+		fake.Handle("nix-env", nixtest.Result{ExitCode: 1})
+
+		err := h.postActivation(context.Background(), rollbackConfig(0), func() (string, error) {
+			return "ping canary.example.com", healthcheck.ErrPingFailed
+		})
+
+		assert.Equal(t, stageOf(err), stageRollback)
+		assert.Equal(t, errors.Is(err, nix.ErrRollbackFailed), true)
+		assert.Equal(t, errors.Is(err, healthcheck.ErrPingFailed), true)
+	})
+}
+
+func TestHealthChecks(t *testing.T) {
+	conf := config.HealthCheckConfig{
+		CanaryHosts: []string{"canary.example.com"},
+		Ping: config.PingConfig{
+			Count:     5,
+			Interval:  200 * time.Millisecond,
+			MaxLoss:   20,
+			IPVersion: 6,
+		},
+		Checks: []healthcheck.Spec{
+			{Name: "gateway", Kind: "ping", Settings: map[string]any{"host": "10.0.0.1", "count": 2, "ip_version": 4}},
+		},
+	}
+
+	checks, err := healthChecks(conf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	assert.Equal(t, len(checks), 2)
+	assert.Equal(t, checks[0].Spec.Name, "ping canary.example.com")
+	assert.Equal(t, checks[0].Spec.Group, "canary")
+	assert.Equal(t, checks[0].HealthCheck.(healthcheck.PingCheck), healthcheck.PingCheck{
+		Host:      "canary.example.com",
+		Count:     5,
+		Interval:  200 * time.Millisecond,
+		Timeout:   2 * time.Second,
+		MaxLoss:   20,
+		IPVersion: 6,
+	})
+	assert.Equal(t, checks[1].Spec.Name, "gateway")
+	assert.Equal(t, checks[1].HealthCheck.(healthcheck.PingCheck), healthcheck.PingCheck{
+		Host:      "10.0.0.1",
+		Count:     2,
+		Interval:  200 * time.Millisecond,
+		Timeout:   1400 * time.Millisecond,
+		MaxLoss:   20,
+		IPVersion: 4,
+	})
+}
+
+func TestRunHealthChecks(t *testing.T) {
+	conf := config.HealthCheckConfig{
+		Timeout: time.Second,
+		Checks: []healthcheck.Spec{
+			{Name: "replica a", Kind: "exec", Group: "replicas", Settings: map[string]any{"command": "true"}},
+			{Name: "replica b", Kind: "exec", Group: "replicas", Settings: map[string]any{"command": "false"}},
+		},
+	}
+
+	t.Run("groups pass by quorum", func(t *testing.T) {
+		conf.Groups = []healthcheck.Group{{Name: "replicas", MinPass: 1}}
+
+		check, err := runHealthChecks(context.Background(), conf)
+
+		assert.Equal(t, check, "")
+		assert.Equal(t, err, nil)
+	})
+
+	t.Run("groups without a quorum require every check", func(t *testing.T) {
+		conf.Groups = nil
+
+		check, err := runHealthChecks(context.Background(), conf)
+
+		assert.Equal(t, check, "replicas")
+		assert.Equal(t, errors.Is(err, healthcheck.ErrQuorum), true)
+		assert.Equal(t, errors.Is(err, healthcheck.ErrExecCheck), true)
+	})
+}
+
+// fakeSystemctl puts a systemctl first in PATH that lists units as
+// failed. Listings before the after'th list before, later listings list
+// later.
+func fakeSystemctl(t *testing.T, after int, before, later []system.FailedUnit) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	list := func(units []system.FailedUnit) string {
+		script := "if [ \"$1\" = show ]; then\n"
+		for _, u := range units {
+			script += "echo 'InactiveEnterTimestamp=@" + strconv.FormatInt(u.Since.Unix(), 10) + "'\necho\n"
+		}
+		script += "exit 0\nfi\n"
+		for _, u := range units {
+			script += "echo '" + u.Name + " loaded failed failed " + u.Name + "'\n"
+		}
+		return script + "exit 0\n"
+	}
+	script := "#!/bin/sh\n[ \"$1\" = show ] || echo x >> " + calls + "\n"
+	script += "if [ $(wc -l < " + calls + ") -lt " + strconv.Itoa(after) + " ]; then\n" + list(before) + "fi\n"
+	script += list(later)
+	err := os.WriteFile(filepath.Join(dir, "systemctl"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestFailedUnits(t *testing.T) {
+	t.Run("degraded systems abort before building", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		fakeSystemctl(t, 0, nil, []system.FailedUnit{{Name: "zfs-scrub.service"}})
+		conf := testConfig(t, server)
+		conf.HealthCheck.FailedUnits = "abort"
+
+		err := h.runUpgrade(context.Background(), conf)
+
+		assert.Equal(t, stageOf(err), stageHealthCheck)
+		assert.Equal(t, errors.Is(err, healthcheck.ErrFailedUnits), true)
+		assert.Equal(t, fake.Ran("nix build"), false)
+	})
+
+	t.Run("continue only fails on newly failed units", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		fake.Handle(testSwitch)
+		fake.Handle("nix-env")
+		fake.Handle(systemProfile + "/bin/switch-to-configuration")
+		// the baseline and pre-upgrade check pass, then nginx fails
+		zfs := system.FailedUnit{Name: "zfs-scrub.service", Since: time.Unix(1760000000, 0)}
+		fakeSystemctl(t, 3, []system.FailedUnit{zfs}, []system.FailedUnit{zfs, {Name: "nginx.service", Since: zfs.Since.Add(time.Hour)}})
+		conf := testConfig(t, server)
+		conf.StateDir = t.TempDir()
+		conf.HealthCheck.FailedUnits = "continue"
+		conf.NixBuild.Operation = "switch"
+		conf.Rollback.Enable = true
+
+		err := h.runUpgrade(context.Background(), conf)
+
+		assert.Equal(t, stageOf(err), stagePostCheck)
+		assert.Equal(t, errors.Is(err, healthcheck.ErrFailedUnits), true)
+		assert.Equal(t, err.Error(), "post-activation: failed units: systemd units failed: nginx.service")
+		var baseline []system.FailedUnit
+		system.ReadState(conf.StateDir, failedUnitsState, &baseline)
+		assert.Equal(t, len(baseline), 1)
+		assert.Equal(t, baseline[0].Name, "zfs-scrub.service")
+		assert.Equal(t, baseline[0].Since.Equal(zfs.Since), true)
+	})
+
+	t.Run("continue fails on units failing again after the upgrade", func(t *testing.T) {
+		h, server, fake := newUpgradeTest(t)
+		fake.Handle(testSwitch)
+		fake.Handle("nix-env")
+		fake.Handle(systemProfile + "/bin/switch-to-configuration")
+		// zfs-scrub recovers during the upgrade, then fails again
+		zfs := system.FailedUnit{Name: "zfs-scrub.service", Since: time.Unix(1760000000, 0)}
+		refailed := system.FailedUnit{Name: zfs.Name, Since: zfs.Since.Add(time.Hour)}
+		fakeSystemctl(t, 3, []system.FailedUnit{zfs}, []system.FailedUnit{refailed})
+		conf := testConfig(t, server)
+		conf.StateDir = t.TempDir()
+		conf.HealthCheck.FailedUnits = "continue"
+		conf.NixBuild.Operation = "switch"
+		conf.Rollback.Enable = true
+
+		err := h.runUpgrade(context.Background(), conf)
+
+		assert.Equal(t, stageOf(err), stagePostCheck)
+		assert.Equal(t, err.Error(), "post-activation: failed units: systemd units failed: zfs-scrub.service")
+	})
+}
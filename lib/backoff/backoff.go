@@ -0,0 +1,64 @@
+package backoff
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff computes exponential retry delays with jitter.
+type Backoff struct {
+	// delay before the first retry
+	Initial time.Duration
+	// upper bound for any delay, ignored if zero
+	Max time.Duration
+}
+
+// Delay returns the delay before retry attempt n, starting at 1. The
+// exponential delay is capped at Max, then jittered to a random value
+// in [delay/2, delay) so that many clients don't retry in lockstep.
+func (b Backoff) Delay(n int) time.Duration {
+	if b.Initial <= 0 {
+		return 0
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	delay := b.Initial
+	for i := 1; i < n; i++ {
+		if b.Max > 0 && delay >= b.Max/2 {
+			delay = b.Max
+			break
+		}
+		if delay > math.MaxInt64/2 {
+			// uncapped delays stop growing before they overflow
+			break
+		}
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + rand.N(half)
+}
+
+// Sleep waits for d, returning early with the context error if ctx
+// is done first.
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
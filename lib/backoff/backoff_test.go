@@ -0,0 +1,63 @@
+package backoff_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/backoff"
+)
+
+func TestDelay(t *testing.T) {
+	b := backoff.Backoff{Initial: time.Second, Max: 10 * time.Second}
+
+	var delayTests = []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{1, 500 * time.Millisecond, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{3, 2 * time.Second, 4 * time.Second},
+		{4, 4 * time.Second, 8 * time.Second},
+		{5, 5 * time.Second, 10 * time.Second},
+		{64, 5 * time.Second, 10 * time.Second},
+	}
+
+	for _, test := range delayTests {
+		for range 20 {
+			d := b.Delay(test.attempt)
+			if d < test.min || d >= test.max {
+				t.Errorf("attempt %d: delay %v not in [%v, %v)", test.attempt, d, test.min, test.max)
+			}
+		}
+	}
+
+	t.Run("uncapped delays don't overflow", func(t *testing.T) {
+		uncapped := backoff.Backoff{Initial: time.Second}
+		for _, attempt := range []int{40, 64, 1000} {
+			if d := uncapped.Delay(attempt); d < time.Hour {
+				t.Errorf("attempt %d: unexpected delay %v", attempt, d)
+			}
+		}
+	})
+
+	t.Run("zero value never waits", func(t *testing.T) {
+		if d := (backoff.Backoff{}).Delay(3); d != 0 {
+			t.Errorf("unexpected delay %v", d)
+		}
+	})
+}
+
+func TestSleep(t *testing.T) {
+	t.Run("returns context error when cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := backoff.Sleep(ctx, time.Hour)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
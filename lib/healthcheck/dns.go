@@ -0,0 +1,280 @@
+package healthcheck
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrDNSCheck is returned when a dns check fails.
+var ErrDNSCheck = errors.New("dns check failed")
+
+func init() {
+	Register("dns", NewDNS)
+}
+
+// DNSCheck resolves a name, and optionally compares the records.
+type DNSCheck struct {
+	// name to resolve
+	Host string
+	// A, AAAA, CNAME, TXT, MX or NS, defaults to A
+	Type string
+	// host:port of the resolver, defaults to the system resolvers. The
+	// server is queried directly for the fully qualified host, without
+	// /etc/hosts or search domains.
+	Server string
+	// expected records in any order, MX records as "<pref> <host>".
+	// Without it, the check passes on any records.
+	Expect []string
+}
+
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"TXT":   dnsmessage.TypeTXT,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+}
+
+// NewDNS creates a dns check, see DNSCheck for settings.
+func NewDNS(spec Spec) (HealthCheck, error) {
+	var c DNSCheck
+	err := DecodeSettings(spec, &c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Host == "" {
+		return nil, fmt.Errorf("%w: %s: host required", ErrSettings, spec.Name)
+	}
+	c.Type = strings.ToUpper(c.Type)
+	if c.Type == "" {
+		c.Type = "A"
+	}
+	if _, ok := dnsTypes[c.Type]; !ok {
+		return nil, fmt.Errorf("%w: %s: unsupported type %q", ErrSettings, spec.Name, c.Type)
+	}
+
+	if c.Server != "" {
+		if _, _, err := net.SplitHostPort(c.Server); err != nil {
+			// bare ipv6 addresses may be bracketed already
+			host := strings.TrimSuffix(strings.TrimPrefix(c.Server, "["), "]")
+			c.Server = net.JoinHostPort(host, "53")
+		}
+	}
+	return c, nil
+}
+
+func (c DNSCheck) Check(ctx context.Context) error {
+	records, err := c.lookup(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %s %s: %w", ErrDNSCheck, c.Type, c.Host, err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("%w: %s %s: no records", ErrDNSCheck, c.Type, c.Host)
+	}
+	if len(c.Expect) == 0 {
+		return nil
+	}
+
+	expect := make([]string, len(c.Expect))
+	for i, e := range c.Expect {
+		expect[i] = e
+		if c.Type != "TXT" {
+			expect[i] = normalizeRecord(e)
+		}
+	}
+	slices.Sort(expect)
+	slices.Sort(records)
+	if !slices.Equal(records, expect) {
+		return fmt.Errorf("%w: %s %s: got %s, expected %s", ErrDNSCheck, c.Type, c.Host,
+			strings.Join(records, ", "), strings.Join(expect, ", "))
+	}
+	return nil
+}
+
+// lookup resolves the check's records, normalized for comparison.
+func (c DNSCheck) lookup(ctx context.Context) ([]string, error) {
+	if c.Server != "" {
+		return c.query(ctx)
+	}
+
+	resolver := net.DefaultResolver
+	var records []string
+	switch c.Type {
+	case "A", "AAAA":
+		network := "ip4"
+		if c.Type == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := resolver.LookupNetIP(ctx, network, c.Host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			records = append(records, ip.Unmap().String())
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, c.Host)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, cname)
+	case "TXT":
+		txts, err := resolver.LookupTXT(ctx, c.Host)
+		if err != nil {
+			return nil, err
+		}
+		// TXT records are compared verbatim
+		return txts, nil
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, c.Host)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			records = append(records, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "NS":
+		nss, err := resolver.LookupNS(ctx, c.Host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range nss {
+			records = append(records, ns.Host)
+		}
+	}
+	for i, r := range records {
+		records[i] = normalizeRecord(r)
+	}
+	return records, nil
+}
+
+// query asks the check's server for the records over udp, retrying
+// truncated responses over tcp.
+func (c DNSCheck) query(ctx context.Context) ([]string, error) {
+	host := c.Host
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, err
+	}
+	qtype := dnsTypes[c.Type]
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.exchange(ctx, "udp", msg.ID, packed)
+	if err == nil && resp.Truncated {
+		resp, err = c.exchange(ctx, "tcp", msg.ID, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("%s: %s", c.Server, resp.RCode)
+	}
+
+	var records []string
+	for _, answer := range resp.Answers {
+		// answers may include the CNAME chain leading to the records
+		if answer.Header.Type != qtype {
+			continue
+		}
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			records = append(records, netip.AddrFrom4(body.A).String())
+		case *dnsmessage.AAAAResource:
+			records = append(records, netip.AddrFrom16(body.AAAA).Unmap().String())
+		case *dnsmessage.CNAMEResource:
+			records = append(records, normalizeRecord(body.CNAME.String()))
+		case *dnsmessage.TXTResource:
+			// TXT records are compared verbatim
+			records = append(records, strings.Join(body.TXT, ""))
+		case *dnsmessage.MXResource:
+			records = append(records, fmt.Sprintf("%d %s", body.Pref, normalizeRecord(body.MX.String())))
+		case *dnsmessage.NSResource:
+			records = append(records, normalizeRecord(body.NS.String()))
+		}
+	}
+	return records, nil
+}
+
+// exchange sends a packed query to the check's server over network,
+// and returns the response with a matching id.
+func (c DNSCheck) exchange(ctx context.Context, network string, id uint16, query []byte) (dnsmessage.Message, error) {
+	var resp dnsmessage.Message
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, c.Server)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// unblock reads when ctx is cancelled without a deadline
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if network == "tcp" {
+		// tcp messages are length prefixed
+		query = append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	}
+	_, err = conn.Write(query)
+	if err != nil {
+		return resp, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		var n int
+		if network == "tcp" {
+			_, err = io.ReadFull(conn, buf[:2])
+			if err == nil {
+				n = int(binary.BigEndian.Uint16(buf[:2]))
+				_, err = io.ReadFull(conn, buf[:n])
+			}
+		} else {
+			n, err = conn.Read(buf)
+		}
+		if err != nil {
+			return resp, err
+		}
+		err = resp.Unpack(buf[:n])
+		if err != nil {
+			return resp, fmt.Errorf("%s: %w", c.Server, err)
+		}
+		// stray udp responses are skipped
+		if resp.ID == id && resp.Response {
+			return resp, nil
+		}
+		if network == "tcp" {
+			return resp, fmt.Errorf("%s: response id %d doesn't match query id %d", c.Server, resp.ID, id)
+		}
+	}
+}
+
+// normalizeRecord lower cases names and drops the root label's dot.
+func normalizeRecord(record string) string {
+	return strings.TrimSuffix(strings.ToLower(record), ".")
+}
@@ -0,0 +1,104 @@
+package healthcheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrExecCheck is returned when an exec check exits unsuccessfully.
+var ErrExecCheck = errors.New("exec check failed")
+
+// time an exec check waits for its output to close after it's killed
+const execWaitDelay = time.Second
+
+func init() {
+	Register("exec", NewExec)
+}
+
+// ExecCheck runs an executable, passing if it exits 0. It may print a
+// JSON object with a message and metrics to stdout, which are logged
+// with the result, e.g. {"message": "pool online", "metrics": {"errors": 0}}.
+//
+// The pending upgrade is described to it by environment variables:
+// NHU_CURRENT_SYSTEM, NHU_NEW_SYSTEM and NHU_HYDRA_BUILD_ID, each empty
+// if unknown.
+type ExecCheck struct {
+	Command string
+	Args    []string
+	// added to the environment nixos-hydra-upgrade runs with. Names are
+	// uppercased, as config keys are case-insensitive.
+	Env map[string]string
+}
+
+// NewExec creates an exec check, see ExecCheck for settings.
+func NewExec(spec Spec) (HealthCheck, error) {
+	var c ExecCheck
+	err := DecodeSettings(spec, &c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Command == "" {
+		return nil, fmt.Errorf("%w: %s: command required", ErrSettings, spec.Name)
+	}
+	return c, nil
+}
+
+// env returns the environment for the command.
+func (c ExecCheck) env(ctx context.Context) []string {
+	env := os.Environ()
+	for k, v := range c.Env {
+		env = append(env, strings.ToUpper(k)+"="+v)
+	}
+	upgrade, _ := UpgradeFrom(ctx)
+	buildID := ""
+	if upgrade.BuildID != 0 {
+		buildID = strconv.Itoa(upgrade.BuildID)
+	}
+	return append(env,
+		"NHU_CURRENT_SYSTEM="+upgrade.Current,
+		"NHU_NEW_SYSTEM="+upgrade.New,
+		"NHU_HYDRA_BUILD_ID="+buildID)
+}
+
+func (c ExecCheck) Check(ctx context.Context) error {
+	_, err := c.CheckReport(ctx)
+	return err
+}
+
+// CheckReport runs the command, and reports the message and metrics it
+// printed. Output that isn't a JSON object is ignored.
+func (c ExecCheck) CheckReport(ctx context.Context) (Report, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Command, c.Args...)
+	cmd.Env = c.env(ctx)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = execWaitDelay
+	runErr := cmd.Run()
+
+	// a malformed report is no reason to fail a passing check
+	var report Report
+	if json.Unmarshal(bytes.TrimSpace(stdout.Bytes()), &report) != nil {
+		report = Report{}
+	}
+	if runErr == nil {
+		return report, nil
+	}
+
+	detail := report.Message
+	if detail == "" {
+		detail = strings.TrimSpace(stderr.String())
+	}
+	if detail != "" {
+		return report, fmt.Errorf("%w: %s: %w: %s", ErrExecCheck, c.Command, runErr, detail)
+	}
+	return report, fmt.Errorf("%w: %s: %w", ErrExecCheck, c.Command, runErr)
+}
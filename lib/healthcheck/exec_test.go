@@ -0,0 +1,128 @@
+package healthcheck_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
+)
+
+// script writes an executable shell script, returning its path.
+func script(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "check.sh")
+	err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// runExec runs a single exec check, returning its result.
+func runExec(ctx context.Context, t *testing.T, settings map[string]any, timeout time.Duration) healthcheck.Result {
+	t.Helper()
+	spec := healthcheck.Spec{Name: "script", Kind: "exec", Timeout: timeout, Settings: settings}
+	checks, err := healthcheck.NewChecks([]healthcheck.Spec{spec})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return healthcheck.RunAll(ctx, checks, healthcheck.Options{Timeout: time.Minute})[0]
+}
+
+func TestExecCheck(t *testing.T) {
+	t.Run("command is required", func(t *testing.T) {
+		_, err := healthcheck.New(healthcheck.Spec{Name: "script", Kind: "exec"})
+		assert.Equal(t, errors.Is(err, healthcheck.ErrSettings), true)
+	})
+
+	t.Run("zero exit passes with the upgrade in its environment", func(t *testing.T) {
+		ctx := healthcheck.WithUpgrade(context.Background(), healthcheck.Upgrade{
+			Current: "/nix/store/aaaa-nixos-system-oak",
+			New:     "/nix/store/bbbb-nixos-system-oak",
+			BuildID: 42,
+		})
+		path := script(t, `[ "$NHU_CURRENT_SYSTEM" = /nix/store/aaaa-nixos-system-oak ] || exit 1
+[ "$NHU_NEW_SYSTEM" = /nix/store/bbbb-nixos-system-oak ] || exit 1
+[ "$NHU_HYDRA_BUILD_ID" = 42 ] || exit 1
+[ "$1" = tank ] || exit 1
+[ "$POOL_STATE" = ONLINE ] || exit 1
+`)
+
+		r := runExec(ctx, t, map[string]any{
+			"command": path,
+			"args":    []any{"tank"},
+			"env":     map[string]any{"pool_state": "ONLINE"},
+		}, 0)
+
+		assert.Equal(t, r.Err, nil)
+	})
+
+	t.Run("unknown upgrade details are empty", func(t *testing.T) {
+		path := script(t, `[ -z "$NHU_NEW_SYSTEM" ] && [ -z "$NHU_HYDRA_BUILD_ID" ]`)
+
+		r := runExec(context.Background(), t, map[string]any{"command": path}, 0)
+
+		assert.Equal(t, r.Err, nil)
+	})
+
+	t.Run("json output is reported", func(t *testing.T) {
+		path := script(t, `echo '{"message": "pool online", "metrics": {"errors": 0, "pool": "tank"}}'`)
+
+		r := runExec(context.Background(), t, map[string]any{"command": path}, 0)
+
+		assert.Equal(t, r.Err, nil)
+		assert.Equal(t, r.Report.Message, "pool online")
+		assert.Equal(t, len(r.Report.Metrics), 2)
+		assert.Equal(t, r.Report.Metrics["pool"], any("tank"))
+	})
+
+	t.Run("other output is ignored", func(t *testing.T) {
+		path := script(t, `echo checking pool`)
+
+		r := runExec(context.Background(), t, map[string]any{"command": path}, 0)
+
+		assert.Equal(t, r.Err, nil)
+		assert.Equal(t, r.Report.Message, "")
+	})
+
+	t.Run("nonzero exit fails with the reported message", func(t *testing.T) {
+		path := script(t, `echo '{"message": "pool degraded"}'
+exit 2`)
+
+		r := runExec(context.Background(), t, map[string]any{"command": path}, 0)
+
+		assert.Equal(t, errors.Is(r.Err, healthcheck.ErrExecCheck), true)
+		assert.Equal(t, r.Report.Message, "pool degraded")
+		assert.Equal(t, r.Err.Error(), "exec check failed: "+path+": exit status 2: pool degraded")
+	})
+
+	t.Run("nonzero exit fails with stderr", func(t *testing.T) {
+		path := script(t, `echo "replication lag 300s" >&2
+exit 1`)
+
+		r := runExec(context.Background(), t, map[string]any{"command": path}, 0)
+
+		assert.Equal(t, r.Err.Error(), "exec check failed: "+path+": exit status 1: replication lag 300s")
+	})
+
+	t.Run("missing commands fail", func(t *testing.T) {
+		r := runExec(context.Background(), t, map[string]any{"command": filepath.Join(t.TempDir(), "missing")}, 0)
+
+		assert.Equal(t, errors.Is(r.Err, healthcheck.ErrExecCheck), true)
+	})
+
+	t.Run("commands are killed after the timeout", func(t *testing.T) {
+		path := script(t, `exec sleep 60`)
+
+		start := time.Now()
+		r := runExec(context.Background(), t, map[string]any{"command": path}, 50*time.Millisecond)
+
+		assert.Equal(t, time.Since(start) < 10*time.Second, true)
+		assert.Equal(t, errors.Is(r.Err, healthcheck.ErrTimeout), true)
+	})
+}
@@ -0,0 +1,415 @@
+/*
+Package healthcheck checks that the dependencies of a system work before
+and after it's upgraded. Each kind of check registers a Factory, and
+checks configured by a Spec run concurrently with RunAll. Failed checks
+may be retried until a deadline, and checks in a Group pass by quorum.
+*/
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/backoff"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+var (
+	// ErrUnknownKind is returned for a Spec with an unregistered kind.
+	ErrUnknownKind = errors.New("unknown health check kind")
+	// ErrSettings is returned when a Spec's settings are invalid for its kind.
+	ErrSettings = errors.New("invalid health check settings")
+	// ErrTimeout is returned when a check doesn't finish within its timeout.
+	ErrTimeout = errors.New("health check timed out")
+	// ErrQuorum is returned when too few checks in a group pass.
+	ErrQuorum = errors.New("health check quorum not met")
+)
+
+// HealthCheck is a single check of a dependency.
+type HealthCheck interface {
+	// Check returns nil if the dependency is healthy. Checks must
+	// return once ctx is done.
+	Check(ctx context.Context) error
+}
+
+// Reporter is implemented by checks that report details with their
+// result. RunAll prefers CheckReport to Check.
+type Reporter interface {
+	CheckReport(ctx context.Context) (Report, error)
+}
+
+// Report is details of a check's result, logged with it.
+type Report struct {
+	Message string         `json:"message"`
+	Metrics map[string]any `json:"metrics"`
+}
+
+// Upgrade describes the upgrade a check runs for.
+type Upgrade struct {
+	// store path of the system the upgrade started from, if known
+	Current string
+	// store path of the system being upgraded to, if known
+	New string
+	// hydra build of the new system, if known
+	BuildID int
+	// units that failed before the upgrade, ignored by systemd checks
+	// unless they've failed again since
+	FailedUnits []system.FailedUnit
+}
+
+type upgradeKey struct{}
+
+// WithUpgrade returns a context describing the upgrade checks run for.
+func WithUpgrade(ctx context.Context, upgrade Upgrade) context.Context {
+	return context.WithValue(ctx, upgradeKey{}, upgrade)
+}
+
+// UpgradeFrom returns the upgrade described by ctx, if any.
+func UpgradeFrom(ctx context.Context) (Upgrade, bool) {
+	upgrade, ok := ctx.Value(upgradeKey{}).(Upgrade)
+	return upgrade, ok
+}
+
+// Spec configures a health check. Settings are specific to the kind,
+// and decoded by its Factory.
+type Spec struct {
+	Name string `validate:"required"`
+	Kind string `validate:"required"`
+	// zero uses the default timeout
+	Timeout time.Duration `validate:"gte=0s"`
+	// failed attempts are retried until this long after the first,
+	// zero uses the default deadline
+	Deadline time.Duration `validate:"gte=0s"`
+	// checks in the same group pass by quorum, see Group
+	Group    string
+	Settings map[string]any `mapstructure:",remain"`
+}
+
+// Group requires MinPass of the checks naming it to pass. Checks naming
+// a group without a Group must all pass.
+type Group struct {
+	Name    string `validate:"required"`
+	MinPass int    `mapstructure:"min_pass" validate:"min=1"`
+}
+
+// Factory creates a kind of HealthCheck from a Spec.
+type Factory func(spec Spec) (HealthCheck, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register registers a kind of health check. Registering a kind twice
+// replaces it.
+func Register(kind string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[kind] = factory
+}
+
+// Kinds returns the registered kinds, sorted.
+func Kinds() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	kinds := make([]string, 0, len(registry))
+	for kind := range registry {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// New creates the health check configured by spec.
+func New(spec Spec) (HealthCheck, error) {
+	registryMu.RLock()
+	factory, ok := registry[spec.Kind]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s: %q", ErrUnknownKind, spec.Name, spec.Kind)
+	}
+	return factory(spec)
+}
+
+// DecodeSettings decodes a Spec's settings into v, a pointer to a
+// struct with mapstructure tags. Durations may be strings like "5s",
+// and unknown settings are rejected.
+func DecodeSettings(spec Spec, v any) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		Result:           v,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrSettings, spec.Name, err)
+	}
+	err = decoder.Decode(spec.Settings)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrSettings, spec.Name, err)
+	}
+	return nil
+}
+
+// Check is a health check and the spec it was created from.
+type Check struct {
+	Spec        Spec
+	HealthCheck HealthCheck
+}
+
+// NewChecks creates the health checks configured by specs.
+func NewChecks(specs []Spec) ([]Check, error) {
+	checks := make([]Check, 0, len(specs))
+	for _, spec := range specs {
+		hc, err := New(spec)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, Check{Spec: spec, HealthCheck: hc})
+	}
+	return checks, nil
+}
+
+// Result is the outcome of a single health check.
+type Result struct {
+	Name  string
+	Kind  string
+	Group string
+	// latency of the last attempt
+	Latency  time.Duration
+	Attempts int
+	Err      error
+	Report   Report
+}
+
+// LogValue logs a result as a group of its fields.
+func (r Result) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("name", r.Name),
+		slog.String("kind", r.Kind),
+		slog.Duration("latency", r.Latency),
+		slog.Int("attempts", r.Attempts),
+	}
+	if r.Group != "" {
+		attrs = append(attrs, slog.String("group", r.Group))
+	}
+	if r.Err != nil {
+		attrs = append(attrs, slog.Any("err", r.Err))
+	}
+	if r.Report.Message != "" {
+		attrs = append(attrs, slog.String("message", r.Report.Message))
+	}
+	if len(r.Report.Metrics) > 0 {
+		metrics := make([]any, 0, len(r.Report.Metrics))
+		for _, k := range slices.Sorted(maps.Keys(r.Report.Metrics)) {
+			metrics = append(metrics, slog.Any(k, r.Report.Metrics[k]))
+		}
+		attrs = append(attrs, slog.Group("metrics", metrics...))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Results are the outcomes of a set of health checks, in check order.
+type Results []Result
+
+// Failed returns the failed results.
+func (rs Results) Failed() Results {
+	var failed Results
+	for _, r := range rs {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Quorum is the outcome of a group of checks. Checks without a group
+// are each their own quorum, requiring them to pass.
+type Quorum struct {
+	// empty for a check without a group
+	Group   string
+	MinPass int
+	Results Results
+}
+
+// Name returns the group name, or the check name for a check without
+// a group.
+func (q Quorum) Name() string {
+	if q.Group == "" {
+		return q.Results[0].Name
+	}
+	return q.Group
+}
+
+// Passed returns the number of checks that passed.
+func (q Quorum) Passed() int {
+	return len(q.Results) - len(q.Results.Failed())
+}
+
+// Err returns nil if the quorum was met. Otherwise a check without a
+// group returns its error, and a group returns ErrQuorum wrapping its
+// first failure.
+func (q Quorum) Err() error {
+	if q.Passed() >= q.MinPass {
+		return nil
+	}
+	failed := q.Results.Failed()
+	if q.Group == "" {
+		return failed[0].Err
+	}
+	return fmt.Errorf("%w: %s: %d of %d passed, %d required: %s: %w",
+		ErrQuorum, q.Group, q.Passed(), len(q.Results), q.MinPass, failed[0].Name, failed[0].Err)
+}
+
+// LogValue logs a quorum's decision and its reasoning.
+func (q Quorum) LogValue() slog.Value {
+	failed := make([]string, 0, len(q.Results))
+	for _, r := range q.Results.Failed() {
+		failed = append(failed, r.Name)
+	}
+	return slog.GroupValue(
+		slog.String("name", q.Name()),
+		slog.Int("passed", q.Passed()),
+		slog.Int("total", len(q.Results)),
+		slog.Int("min_pass", q.MinPass),
+		slog.Any("failed", failed))
+}
+
+// Quorums groups results into quorums, in order of each group's first
+// check. Groups without a Group in groups require all of their checks
+// to pass.
+func (rs Results) Quorums(groups []Group) []Quorum {
+	minPass := map[string]int{}
+	for _, g := range groups {
+		minPass[g.Name] = g.MinPass
+	}
+
+	var quorums []Quorum
+	index := map[string]int{}
+	for _, r := range rs {
+		if r.Group == "" {
+			quorums = append(quorums, Quorum{MinPass: 1, Results: Results{r}})
+			continue
+		}
+		i, ok := index[r.Group]
+		if !ok {
+			i = len(quorums)
+			index[r.Group] = i
+			quorums = append(quorums, Quorum{Group: r.Group})
+		}
+		quorums[i].Results = append(quorums[i].Results, r)
+	}
+	for i, q := range quorums {
+		if q.Group == "" {
+			continue
+		}
+		n, ok := minPass[q.Group]
+		if !ok {
+			n = len(q.Results)
+		}
+		quorums[i].MinPass = n
+	}
+	return quorums
+}
+
+// Options configure how RunAll runs checks. Spec fields override them.
+type Options struct {
+	// limit for each attempt
+	Timeout time.Duration
+	// failed attempts are retried until this long after the first, zero
+	// disables retries
+	Deadline time.Duration
+	// delay between attempts
+	Backoff backoff.Backoff
+}
+
+// RunAll runs checks concurrently, retrying failed checks until their
+// deadline. Each attempt is limited to the check's timeout. Results are
+// in check order.
+func RunAll(ctx context.Context, checks []Check, opts Options) Results {
+	results := make(Results, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = run(ctx, check, opts)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// run runs a single check, retrying failed attempts with backoff until
+// its deadline.
+func run(ctx context.Context, check Check, opts Options) Result {
+	timeout := check.Spec.Timeout
+	if timeout == 0 {
+		timeout = opts.Timeout
+	}
+	deadline := check.Spec.Deadline
+	if deadline == 0 {
+		deadline = opts.Deadline
+	}
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		r := runOnce(ctx, check, timeout)
+		r.Attempts = attempt
+		if r.Err == nil || deadline <= 0 || ctx.Err() != nil {
+			return r
+		}
+		delay := opts.Backoff.Delay(attempt)
+		if time.Since(start)+delay >= deadline {
+			return r
+		}
+		slog.Warn("Health check attempt failed, retrying.",
+			slog.Any("check", r),
+			slog.Duration("delay", delay),
+			slog.Duration("deadline", deadline))
+		if backoff.Sleep(ctx, delay) != nil {
+			return r
+		}
+	}
+}
+
+// runOnce runs a single attempt of a check within its timeout.
+func runOnce(ctx context.Context, check Check, timeout time.Duration) Result {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	var report Report
+	var err error
+	if reporter, ok := check.HealthCheck.(Reporter); ok {
+		report, err = reporter.CheckReport(ctx)
+	} else {
+		err = check.HealthCheck.Check(ctx)
+	}
+	latency := time.Since(start)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.Is(err, ErrTimeout) {
+		err = fmt.Errorf("%w after %s: %w", ErrTimeout, timeout, err)
+	}
+	return Result{
+		Name:    check.Spec.Name,
+		Kind:    check.Spec.Kind,
+		Group:   check.Spec.Group,
+		Latency: latency,
+		Err:     err,
+		Report:  report,
+	}
+}
@@ -0,0 +1,244 @@
+package healthcheck_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/backoff"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
+)
+
+var errUnhealthy = errors.New("unhealthy")
+
+// fakeCheck sleeps for Delay, then fails if Fail is set.
+type fakeCheck struct {
+	Delay time.Duration
+	Fail  bool
+}
+
+func (c fakeCheck) Check(ctx context.Context) error {
+	select {
+	case <-time.After(c.Delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if c.Fail {
+		return errUnhealthy
+	}
+	return nil
+}
+
+func init() {
+	healthcheck.Register("fake", func(spec healthcheck.Spec) (healthcheck.HealthCheck, error) {
+		var c fakeCheck
+		err := healthcheck.DecodeSettings(spec, &c)
+		return c, err
+	})
+}
+
+func TestNew(t *testing.T) {
+	t.Run("decodes settings", func(t *testing.T) {
+		hc, err := healthcheck.New(healthcheck.Spec{
+			Name:     "slow",
+			Kind:     "fake",
+			Settings: map[string]any{"delay": "5s", "fail": "true"},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, hc.(fakeCheck), fakeCheck{Delay: 5 * time.Second, Fail: true})
+	})
+
+	t.Run("unknown kinds fail", func(t *testing.T) {
+		_, err := healthcheck.New(healthcheck.Spec{Name: "signal", Kind: "smoke"})
+		assert.Equal(t, errors.Is(err, healthcheck.ErrUnknownKind), true)
+	})
+
+	t.Run("unknown settings fail", func(t *testing.T) {
+		_, err := healthcheck.New(healthcheck.Spec{
+			Name:     "typo",
+			Kind:     "fake",
+			Settings: map[string]any{"dealy": "5s"},
+		})
+		assert.Equal(t, errors.Is(err, healthcheck.ErrSettings), true)
+	})
+
+	t.Run("ping requires a host", func(t *testing.T) {
+		_, err := healthcheck.New(healthcheck.Spec{Name: "ping", Kind: "ping"})
+		assert.Equal(t, errors.Is(err, healthcheck.ErrSettings), true)
+	})
+
+	t.Run("kinds are listed", func(t *testing.T) {
+		kinds := healthcheck.Kinds()
+		assert.Equal(t, len(kinds) >= 2, true)
+	})
+}
+
+// countingCheck counts concurrently running checks.
+type countingCheck struct {
+	running, peak *atomic.Int32
+}
+
+func (c countingCheck) Check(ctx context.Context) error {
+	n := c.running.Add(1)
+	defer c.running.Add(-1)
+	for {
+		peak := c.peak.Load()
+		if n <= peak || c.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return nil
+}
+
+// flakyCheck fails until it has been attempted Failures times.
+type flakyCheck struct {
+	Failures int32
+	attempts *atomic.Int32
+}
+
+func (c flakyCheck) Check(ctx context.Context) error {
+	if c.attempts.Add(1) <= c.Failures {
+		return errUnhealthy
+	}
+	return nil
+}
+
+func TestRunAll(t *testing.T) {
+	t.Run("results are in check order", func(t *testing.T) {
+		checks := []healthcheck.Check{
+			{Spec: healthcheck.Spec{Name: "slow", Kind: "fake"}, HealthCheck: fakeCheck{Delay: 20 * time.Millisecond}},
+			{Spec: healthcheck.Spec{Name: "broken", Kind: "fake"}, HealthCheck: fakeCheck{Fail: true}},
+			{Spec: healthcheck.Spec{Name: "fast", Kind: "fake"}, HealthCheck: fakeCheck{}},
+		}
+
+		results := healthcheck.RunAll(context.Background(), checks, healthcheck.Options{Timeout: time.Second})
+
+		assert.Equal(t, len(results), 3)
+		assert.Equal(t, results[0].Name, "slow")
+		assert.Equal(t, results[0].Kind, "fake")
+		assert.Equal(t, results[0].Err, nil)
+		assert.Equal(t, results[0].Latency >= 20*time.Millisecond, true)
+		assert.Equal(t, errors.Is(results[1].Err, errUnhealthy), true)
+		assert.Equal(t, results[2].Err, nil)
+
+		failed := results.Failed()
+		assert.Equal(t, len(failed), 1)
+		assert.Equal(t, failed[0].Name, "broken")
+	})
+
+	t.Run("checks run concurrently", func(t *testing.T) {
+		var running, peak atomic.Int32
+		var checks []healthcheck.Check
+		for range 4 {
+			checks = append(checks, healthcheck.Check{
+				Spec:        healthcheck.Spec{Name: "counting", Kind: "fake"},
+				HealthCheck: countingCheck{running: &running, peak: &peak},
+			})
+		}
+
+		healthcheck.RunAll(context.Background(), checks, healthcheck.Options{Timeout: time.Second})
+
+		assert.Equal(t, peak.Load(), int32(4))
+	})
+
+	t.Run("checks time out", func(t *testing.T) {
+		checks := []healthcheck.Check{
+			{Spec: healthcheck.Spec{Name: "default timeout", Kind: "fake"}, HealthCheck: fakeCheck{Delay: time.Minute}},
+			{Spec: healthcheck.Spec{Name: "own timeout", Kind: "fake", Timeout: 10 * time.Millisecond}, HealthCheck: fakeCheck{Delay: time.Minute}},
+		}
+
+		start := time.Now()
+		results := healthcheck.RunAll(context.Background(), checks, healthcheck.Options{Timeout: 50 * time.Millisecond})
+
+		assert.Equal(t, time.Since(start) < time.Second, true)
+		assert.Equal(t, errors.Is(results[0].Err, healthcheck.ErrTimeout), true)
+		assert.Equal(t, errors.Is(results[1].Err, healthcheck.ErrTimeout), true)
+		assert.Equal(t, results[1].Latency < 50*time.Millisecond, true)
+	})
+
+	t.Run("failed checks are retried until they pass", func(t *testing.T) {
+		var attempts atomic.Int32
+		checks := []healthcheck.Check{
+			{Spec: healthcheck.Spec{Name: "flaky", Kind: "fake"}, HealthCheck: flakyCheck{Failures: 2, attempts: &attempts}},
+		}
+
+		results := healthcheck.RunAll(context.Background(), checks, healthcheck.Options{
+			Timeout:  time.Second,
+			Deadline: time.Second,
+			Backoff:  backoff.Backoff{Initial: time.Millisecond},
+		})
+
+		assert.Equal(t, results[0].Err, nil)
+		assert.Equal(t, results[0].Attempts, 3)
+	})
+
+	t.Run("retries stop at the deadline", func(t *testing.T) {
+		var attempts atomic.Int32
+		checks := []healthcheck.Check{
+			{Spec: healthcheck.Spec{Name: "down", Kind: "fake", Deadline: 50 * time.Millisecond}, HealthCheck: flakyCheck{Failures: 1000, attempts: &attempts}},
+		}
+
+		start := time.Now()
+		results := healthcheck.RunAll(context.Background(), checks, healthcheck.Options{
+			Timeout:  time.Second,
+			Deadline: time.Minute,
+			Backoff:  backoff.Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond},
+		})
+
+		assert.Equal(t, time.Since(start) < time.Second, true)
+		assert.Equal(t, errors.Is(results[0].Err, errUnhealthy), true)
+		assert.Equal(t, results[0].Attempts > 1, true)
+		assert.Equal(t, results[0].Attempts, int(attempts.Load()))
+	})
+
+	t.Run("checks aren't retried without a deadline", func(t *testing.T) {
+		var attempts atomic.Int32
+		checks := []healthcheck.Check{
+			{Spec: healthcheck.Spec{Name: "flaky", Kind: "fake"}, HealthCheck: flakyCheck{Failures: 1, attempts: &attempts}},
+		}
+
+		results := healthcheck.RunAll(context.Background(), checks, healthcheck.Options{Timeout: time.Second})
+
+		assert.Equal(t, errors.Is(results[0].Err, errUnhealthy), true)
+		assert.Equal(t, results[0].Attempts, 1)
+	})
+}
+
+func TestQuorums(t *testing.T) {
+	results := healthcheck.Results{
+		{Name: "ping a", Group: "canary"},
+		{Name: "gateway", Err: errUnhealthy},
+		{Name: "ping b", Group: "canary", Err: errUnhealthy},
+		{Name: "ping c", Group: "canary"},
+		{Name: "db a", Group: "db", Err: errUnhealthy},
+		{Name: "db b", Group: "db"},
+	}
+
+	t.Run("groups pass by quorum", func(t *testing.T) {
+		quorums := results.Quorums([]healthcheck.Group{{Name: "canary", MinPass: 2}})
+
+		assert.Equal(t, len(quorums), 3)
+		assert.Equal(t, quorums[0].Name(), "canary")
+		assert.Equal(t, quorums[0].Passed(), 2)
+		assert.Equal(t, quorums[0].Err(), nil)
+		assert.Equal(t, quorums[1].Name(), "gateway")
+		assert.Equal(t, quorums[1].Err(), errUnhealthy)
+		assert.Equal(t, quorums[2].Name(), "db")
+		assert.Equal(t, quorums[2].MinPass, 2)
+		assert.Equal(t, errors.Is(quorums[2].Err(), healthcheck.ErrQuorum), true)
+		assert.Equal(t, errors.Is(quorums[2].Err(), errUnhealthy), true)
+	})
+
+	t.Run("groups fail below quorum", func(t *testing.T) {
+		quorums := results.Quorums([]healthcheck.Group{{Name: "canary", MinPass: 3}, {Name: "db", MinPass: 1}})
+
+		assert.Equal(t, quorums[0].Err().Error(), "health check quorum not met: canary: 2 of 3 passed, 3 required: ping b: unhealthy")
+		assert.Equal(t, quorums[2].Err(), nil)
+	})
+}
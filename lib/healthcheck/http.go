@@ -0,0 +1,157 @@
+package healthcheck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrHTTPCheck is returned when an http check fails.
+var ErrHTTPCheck = errors.New("http check failed")
+
+// limits how much of a response body is matched
+const maxHTTPBody = 1 << 20
+
+func init() {
+	Register("http", NewHTTP)
+}
+
+// HTTPCheck requests a url, and checks the response status and body.
+type HTTPCheck struct {
+	URL string
+	// defaults to GET
+	Method  string
+	Headers map[string]string
+	// expected status codes, defaults to any 2xx
+	Status []int
+	// regular expression the body must match
+	BodyRegex string `mapstructure:"body_regex"`
+	// dotted path into a JSON body, e.g. checks.0.status, that must
+	// exist, and equal JSONValue if it's set
+	JSONPath  string `mapstructure:"json_path"`
+	JSONValue string `mapstructure:"json_value"`
+	// PEM CA certificates trusted in addition to the system roots
+	CAFile string `mapstructure:"ca_file"`
+
+	bodyRegex *regexp.Regexp
+	client    *http.Client
+}
+
+// NewHTTP creates an http check, see HTTPCheck for settings.
+func NewHTTP(spec Spec) (HealthCheck, error) {
+	var c HTTPCheck
+	err := DecodeSettings(spec, &c)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: %s: http or https url required: %q", ErrSettings, spec.Name, c.URL)
+	}
+	if c.Method == "" {
+		c.Method = http.MethodGet
+	}
+	if c.BodyRegex != "" {
+		c.bodyRegex, err = regexp.Compile(c.BodyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: body_regex: %w", ErrSettings, spec.Name, err)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig, err = tlsConfig(spec, c.CAFile, "")
+	if err != nil {
+		return nil, err
+	}
+	c.client = &http.Client{Transport: transport}
+	return c, nil
+}
+
+func (c HTTPCheck) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, c.Method, c.URL, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrHTTPCheck, c.URL, err)
+	}
+	for k, v := range c.Headers {
+		// the Host header is only honored on the request itself
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrHTTPCheck, c.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if len(c.Status) > 0 && !slices.Contains(c.Status, resp.StatusCode) ||
+		len(c.Status) == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("%w: %s: unexpected status %d", ErrHTTPCheck, c.URL, resp.StatusCode)
+	}
+	if c.bodyRegex == nil && c.JSONPath == "" {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPBody))
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrHTTPCheck, c.URL, err)
+	}
+	if c.bodyRegex != nil && !c.bodyRegex.Match(body) {
+		return fmt.Errorf("%w: %s: body doesn't match %q", ErrHTTPCheck, c.URL, c.BodyRegex)
+	}
+	if c.JSONPath != "" {
+		var v any
+		err = json.Unmarshal(body, &v)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrHTTPCheck, c.URL, err)
+		}
+		found, ok := jsonPath(v, c.JSONPath)
+		if !ok {
+			return fmt.Errorf("%w: %s: %s not found", ErrHTTPCheck, c.URL, c.JSONPath)
+		}
+		if c.JSONValue != "" && jsonString(found) != c.JSONValue {
+			return fmt.Errorf("%w: %s: %s is %s, expected %s", ErrHTTPCheck, c.URL, c.JSONPath, jsonString(found), c.JSONValue)
+		}
+	}
+	return nil
+}
+
+// jsonPath looks up a dotted path of object keys and array indices in
+// a decoded JSON value. Null values aren't found.
+func jsonPath(v any, path string) (any, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, v != nil
+}
+
+// jsonString formats a decoded JSON value for comparison. Strings are
+// unquoted, and other values are compared as JSON.
+func jsonString(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,158 @@
+package healthcheck_test
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
+)
+
+func newHTTPCheck(t *testing.T, settings map[string]any) healthcheck.HealthCheck {
+	t.Helper()
+	hc, err := healthcheck.New(healthcheck.Spec{Name: "http", Kind: "http", Settings: settings})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return hc
+}
+
+func TestHTTPCheck(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"status": "ok", "checks": [{"name": "db", "healthy": true}]}`))
+		case "/maintenance":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("down for maintenance"))
+		case "/method":
+			w.Write([]byte(r.Method))
+		}
+	}))
+	defer server.Close()
+
+	var passTests = []struct {
+		description string
+		settings    map[string]any
+	}{
+		{"headers are sent", map[string]any{
+			"url":     server.URL + "/health",
+			"headers": map[string]any{"authorization": "Bearer token"},
+		}},
+		{"expected status codes", map[string]any{
+			"url":    server.URL + "/maintenance",
+			"status": []any{200, 503},
+		}},
+		{"body regex", map[string]any{
+			"url":        server.URL + "/maintenance",
+			"status":     "503",
+			"body_regex": "^down",
+		}},
+		{"method", map[string]any{
+			"url":        server.URL + "/method",
+			"method":     "HEAD",
+			"body_regex": "^$",
+		}},
+		{"json path exists", map[string]any{
+			"url":       server.URL + "/health",
+			"headers":   map[string]any{"Authorization": "Bearer token"},
+			"json_path": "checks.0.name",
+		}},
+		{"json path value", map[string]any{
+			"url":        server.URL + "/health",
+			"headers":    map[string]any{"Authorization": "Bearer token"},
+			"json_path":  "checks.0.healthy",
+			"json_value": "true",
+		}},
+	}
+	for _, test := range passTests {
+		t.Run(test.description, func(t *testing.T) {
+			err := newHTTPCheck(t, test.settings).Check(ctx)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	var failTests = []struct {
+		description string
+		settings    map[string]any
+	}{
+		{"non 2xx status", map[string]any{"url": server.URL + "/maintenance"}},
+		{"unexpected status", map[string]any{"url": server.URL + "/health", "status": []any{200}}},
+		{"body mismatch", map[string]any{
+			"url":        server.URL + "/maintenance",
+			"status":     []any{503},
+			"body_regex": "^up",
+		}},
+		{"missing json path", map[string]any{
+			"url":       server.URL + "/health",
+			"headers":   map[string]any{"authorization": "Bearer token"},
+			"json_path": "checks.1.name",
+		}},
+		{"json path value mismatch", map[string]any{
+			"url":        server.URL + "/health",
+			"headers":    map[string]any{"authorization": "Bearer token"},
+			"json_path":  "status",
+			"json_value": "degraded",
+		}},
+		{"non json body", map[string]any{
+			"url":       server.URL + "/maintenance",
+			"status":    []any{503},
+			"json_path": "status",
+		}},
+	}
+	for _, test := range failTests {
+		t.Run(test.description, func(t *testing.T) {
+			err := newHTTPCheck(t, test.settings).Check(ctx)
+			assert.Equal(t, errors.Is(err, healthcheck.ErrHTTPCheck), true)
+		})
+	}
+
+	t.Run("invalid settings", func(t *testing.T) {
+		for _, settings := range []map[string]any{
+			{},
+			{"url": "ftp://example.com"},
+			{"url": server.URL, "body_regex": "("},
+			{"url": server.URL, "ca_file": filepath.Join(t.TempDir(), "missing.pem")},
+		} {
+			_, err := healthcheck.New(healthcheck.Spec{Name: "http", Kind: "http", Settings: settings})
+			assert.Equal(t, errors.Is(err, healthcheck.ErrSettings), true)
+		}
+	})
+}
+
+func TestHTTPCheckCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	t.Run("untrusted certificates fail", func(t *testing.T) {
+		err := newHTTPCheck(t, map[string]any{"url": server.URL}).Check(context.Background())
+		assert.Equal(t, errors.Is(err, healthcheck.ErrHTTPCheck), true)
+	})
+
+	t.Run("custom CAs are trusted", func(t *testing.T) {
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		err := os.WriteFile(caFile, certPEM, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = newHTTPCheck(t, map[string]any{"url": server.URL, "ca_file": caFile}).Check(context.Background())
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
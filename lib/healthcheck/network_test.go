@@ -0,0 +1,317 @@
+package healthcheck_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newCheck(t *testing.T, kind string, settings map[string]any) healthcheck.HealthCheck {
+	t.Helper()
+	hc, err := healthcheck.New(healthcheck.Spec{Name: kind, Kind: kind, Settings: settings})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return hc
+}
+
+// closedAddress returns an address nothing listens on.
+func closedAddress(t *testing.T, network string) string {
+	t.Helper()
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		return conn.LocalAddr().String()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+func TestTCPCheck(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	t.Run("connects", func(t *testing.T) {
+		err := newCheck(t, "tcp", map[string]any{"address": address}).Check(ctx)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("refused connections fail", func(t *testing.T) {
+		err := newCheck(t, "tcp", map[string]any{"address": closedAddress(t, "tcp")}).Check(ctx)
+		assert.Equal(t, errors.Is(err, healthcheck.ErrTCPCheck), true)
+	})
+
+	t.Run("untrusted certificates fail the handshake", func(t *testing.T) {
+		err := newCheck(t, "tcp", map[string]any{"address": address, "tls": true}).Check(ctx)
+		assert.Equal(t, errors.Is(err, healthcheck.ErrTCPCheck), true)
+	})
+
+	t.Run("completes a TLS handshake", func(t *testing.T) {
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		os.WriteFile(caFile, certPEM, 0600)
+
+		err := newCheck(t, "tcp", map[string]any{
+			"address":     address,
+			"tls":         true,
+			"server_name": "example.com",
+			"ca_file":     caFile,
+		}).Check(ctx)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("address requires a port", func(t *testing.T) {
+		_, err := healthcheck.New(healthcheck.Spec{Name: "tcp", Kind: "tcp", Settings: map[string]any{"address": "db.internal"}})
+		assert.Equal(t, errors.Is(err, healthcheck.ErrSettings), true)
+	})
+}
+
+// udpEcho replies to datagrams with their payload upper cased.
+func udpEcho(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo([]byte(strings.ToUpper(string(buf[:n]))), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestUDPCheck(t *testing.T) {
+	ctx := context.Background()
+	address := udpEcho(t)
+
+	t.Run("sends", func(t *testing.T) {
+		err := newCheck(t, "udp", map[string]any{"address": address, "send": "ping"}).Check(ctx)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("expects a response", func(t *testing.T) {
+		err := newCheck(t, "udp", map[string]any{"address": address, "send": "ping", "expect": "^PING$"}).Check(ctx)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("unexpected responses fail", func(t *testing.T) {
+		err := newCheck(t, "udp", map[string]any{"address": address, "send": "ping", "expect": "^pong$"}).Check(ctx)
+		assert.Equal(t, errors.Is(err, healthcheck.ErrUDPCheck), true)
+	})
+
+	t.Run("missing responses fail", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		err := newCheck(t, "udp", map[string]any{"address": closedAddress(t, "udp"), "send": "ping", "expect": "."}).Check(ctx)
+		assert.Equal(t, errors.Is(err, healthcheck.ErrUDPCheck), true)
+	})
+}
+
+// dnsAnswer answers A, TXT and MX queries for db.internal, and NXDOMAIN
+// for anything else. MX answers are truncated over udp.
+func dnsAnswer(query dnsmessage.Message, udp bool) dnsmessage.Message {
+	q := query.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true, RCode: dnsmessage.RCodeSuccess},
+		Questions: query.Questions,
+	}
+	header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	switch {
+	case q.Name != dnsmessage.MustNewName("db.internal."):
+		resp.RCode = dnsmessage.RCodeNameError
+	case q.Type == dnsmessage.TypeA:
+		resp.Answers = []dnsmessage.Resource{
+			{Header: header, Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 5}}},
+			{Header: header, Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 6}}},
+		}
+	case q.Type == dnsmessage.TypeTXT:
+		resp.Answers = []dnsmessage.Resource{
+			{Header: header, Body: &dnsmessage.TXTResource{TXT: []string{"v=Primary"}}},
+		}
+	case q.Type == dnsmessage.TypeMX && udp:
+		resp.Truncated = true
+	case q.Type == dnsmessage.TypeMX:
+		resp.Answers = []dnsmessage.Resource{
+			{Header: header, Body: &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mail.internal.")}},
+		}
+	}
+	return resp
+}
+
+// dnsServer serves dnsAnswer over udp and tcp.
+func dnsServer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ln, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil || len(query.Questions) != 1 {
+				continue
+			}
+			resp := dnsAnswer(query, true)
+			packed, err := resp.Pack()
+			if err == nil {
+				conn.WriteTo(packed, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 512)
+			var query dnsmessage.Message
+			_, err = io.ReadFull(c, buf[:2])
+			if err == nil {
+				n := binary.BigEndian.Uint16(buf[:2])
+				_, err = io.ReadFull(c, buf[:n])
+				err = errors.Join(err, query.Unpack(buf[:n]))
+			}
+			if err == nil && len(query.Questions) == 1 {
+				resp := dnsAnswer(query, false)
+				packed, err := resp.Pack()
+				if err == nil {
+					c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+				}
+			}
+			c.Close()
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDNSCheck(t *testing.T) {
+	ctx := context.Background()
+	server := dnsServer(t)
+
+	var passTests = []struct {
+		description string
+		settings    map[string]any
+	}{
+		{"resolves", map[string]any{"host": "db.internal", "server": server}},
+		{"resolves fully qualified hosts", map[string]any{"host": "db.internal.", "server": server}},
+		{"compares records in any order", map[string]any{
+			"host":   "db.internal",
+			"server": server,
+			"expect": []any{"10.0.0.6", "10.0.0.5"},
+		}},
+		{"compares TXT records verbatim", map[string]any{
+			"host":   "db.internal",
+			"type":   "txt",
+			"server": server,
+			"expect": []any{"v=Primary"},
+		}},
+		{"retries truncated responses over tcp", map[string]any{
+			"host":   "db.internal",
+			"type":   "MX",
+			"server": server,
+			"expect": []any{"10 mail.internal"},
+		}},
+	}
+	for _, test := range passTests {
+		t.Run(test.description, func(t *testing.T) {
+			err := newCheck(t, "dns", test.settings).Check(ctx)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	var failTests = []struct {
+		description string
+		settings    map[string]any
+	}{
+		{"unknown names fail", map[string]any{"host": "cache.internal", "server": server}},
+		{"names in /etc/hosts are only resolved by the server", map[string]any{"host": "localhost", "server": server}},
+		{"missing records fail", map[string]any{
+			"host":   "db.internal",
+			"server": server,
+			"expect": []any{"10.0.0.5"},
+		}},
+		{"different records fail", map[string]any{
+			"host":   "db.internal",
+			"server": server,
+			"expect": []any{"10.0.0.5", "10.0.0.7"},
+		}},
+	}
+	for _, test := range failTests {
+		t.Run(test.description, func(t *testing.T) {
+			err := newCheck(t, "dns", test.settings).Check(ctx)
+			assert.Equal(t, errors.Is(err, healthcheck.ErrDNSCheck), true)
+		})
+	}
+
+	t.Run("servers default to port 53", func(t *testing.T) {
+		for server, expect := range map[string]string{
+			"10.0.0.53": "10.0.0.53:53",
+			"::1":       "[::1]:53",
+			"[::1]":     "[::1]:53",
+		} {
+			check, err := healthcheck.New(healthcheck.Spec{Name: "dns", Kind: "dns", Settings: map[string]any{"host": "db.internal", "server": server}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assert.Equal(t, check.(healthcheck.DNSCheck).Server, expect)
+		}
+	})
+
+	t.Run("unsupported types are invalid", func(t *testing.T) {
+		_, err := healthcheck.New(healthcheck.Spec{Name: "dns", Kind: "dns", Settings: map[string]any{"host": "db.internal", "type": "SOA"}})
+		assert.Equal(t, errors.Is(err, healthcheck.ErrSettings), true)
+	})
+}
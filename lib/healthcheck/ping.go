@@ -1,23 +1,114 @@
 package healthcheck
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"time"
 
 	"github.com/prometheus-community/pro-bing"
 )
 
-func Ping(host string) error {
-	pinger, err := probing.NewPinger(host)
+// ErrPingFailed is returned when a canary host can't be resolved or pinged.
+var ErrPingFailed = errors.New("ping failed")
+
+func init() {
+	Register("ping", NewPing)
+}
+
+// PingCheck pings a host with ICMP.
+type PingCheck struct {
+	Host string
+	// echo requests sent, defaults to 3
+	Count int
+	// delay between echo requests, defaults to 1s
+	Interval time.Duration
+	// time to wait for replies, defaults to Count * Interval + 1s
+	Timeout time.Duration
+	// percent of echo requests that may be lost, defaults to 100. At
+	// least one reply is always required.
+	MaxLoss float64 `mapstructure:"max_loss"`
+	// maximum average round trip time, 0 disables
+	MaxRTT time.Duration `mapstructure:"max_rtt"`
+	// raw ICMP sockets, which require CAP_NET_RAW, instead of
+	// unprivileged UDP ICMP sockets, which require
+	// net.ipv4.ping_group_range to include the group
+	Privileged bool
+	// 4 or 6, 0 uses either
+	IPVersion int `mapstructure:"ip_version"`
+}
+
+// NewPing creates a ping check, see PingCheck for settings.
+func NewPing(spec Spec) (HealthCheck, error) {
+	c := PingCheck{Count: 3, Interval: time.Second, MaxLoss: 100}
+	err := DecodeSettings(spec, &c)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.Host == "":
+		return nil, fmt.Errorf("%w: %s: host required", ErrSettings, spec.Name)
+	case c.Count < 1:
+		return nil, fmt.Errorf("%w: %s: count must be at least 1", ErrSettings, spec.Name)
+	case c.Interval <= 0:
+		return nil, fmt.Errorf("%w: %s: interval must be positive", ErrSettings, spec.Name)
+	case c.Timeout < 0 || c.MaxRTT < 0:
+		return nil, fmt.Errorf("%w: %s: timeout and max_rtt can't be negative", ErrSettings, spec.Name)
+	case c.MaxLoss < 0 || c.MaxLoss > 100:
+		return nil, fmt.Errorf("%w: %s: max_loss must be between 0 and 100", ErrSettings, spec.Name)
+	case c.IPVersion != 0 && c.IPVersion != 4 && c.IPVersion != 6:
+		return nil, fmt.Errorf("%w: %s: ip_version must be 4 or 6", ErrSettings, spec.Name)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = time.Duration(c.Count)*c.Interval + time.Second
+	}
+	return c, nil
+}
+
+// network returns the resolver network for the ip version.
+func (c PingCheck) network() string {
+	switch c.IPVersion {
+	case 4:
+		return "ip4"
+	case 6:
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+func (c PingCheck) Check(ctx context.Context) error {
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, c.network(), c.Host)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("%w: %s: %w", ErrPingFailed, c.Host, err)
 	}
-	pinger.Count = 3
-	err = pinger.Run()
+	if len(ips) == 0 {
+		return fmt.Errorf("%w: %s: no addresses", ErrPingFailed, c.Host)
+	}
+
+	pinger := probing.New(c.Host)
+	pinger.SetNetwork(c.network())
+	pinger.SetIPAddr(&net.IPAddr{IP: net.IP(ips[0].Unmap().AsSlice())})
+	pinger.SetPrivileged(c.Privileged)
+	pinger.Count = c.Count
+	pinger.Interval = c.Interval
+	pinger.Timeout = c.Timeout
+	err = pinger.RunWithContext(ctx)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %s: %w", ErrPingFailed, c.Host, err)
 	}
+
 	stats := pinger.Statistics()
 	slog.Debug("ping stats:", slog.String("stats", fmt.Sprintf("%+v", stats)))
+	switch {
+	case stats.PacketsRecv == 0:
+		return fmt.Errorf("%w: %s: no replies to %d echo requests", ErrPingFailed, c.Host, stats.PacketsSent)
+	case stats.PacketLoss > c.MaxLoss:
+		return fmt.Errorf("%w: %s: %.0f%% packet loss exceeds %.0f%%", ErrPingFailed, c.Host, stats.PacketLoss, c.MaxLoss)
+	case c.MaxRTT > 0 && stats.AvgRtt > c.MaxRTT:
+		return fmt.Errorf("%w: %s: average rtt %s exceeds %s", ErrPingFailed, c.Host, stats.AvgRtt, c.MaxRTT)
+	}
 	return nil
 }
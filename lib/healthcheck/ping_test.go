@@ -0,0 +1,57 @@
+package healthcheck_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
+)
+
+func TestPingCheck(t *testing.T) {
+	t.Run("invalid settings", func(t *testing.T) {
+		for _, settings := range []map[string]any{
+			{},
+			{"host": "canary", "count": 0},
+			{"host": "canary", "interval": "0s"},
+			{"host": "canary", "max_loss": 101},
+			{"host": "canary", "max_rtt": "-1s"},
+			{"host": "canary", "ip_version": 5},
+		} {
+			_, err := healthcheck.New(healthcheck.Spec{Name: "ping", Kind: "ping", Settings: settings})
+			assert.Equal(t, errors.Is(err, healthcheck.ErrSettings), true)
+		}
+	})
+
+	t.Run("resolution failures fail the check", func(t *testing.T) {
+		err := newCheck(t, "ping", map[string]any{"host": "canary.invalid"}).Check(context.Background())
+		assert.Equal(t, errors.Is(err, healthcheck.ErrPingFailed), true)
+	})
+
+	t.Run("pings loopback", func(t *testing.T) {
+		hc := newCheck(t, "ping", map[string]any{
+			"host":       "127.0.0.1",
+			"privileged": true,
+			"ip_version": 4,
+			"interval":   "10ms",
+			"max_loss":   0,
+			"max_rtt":    "1s",
+		})
+
+		err := hc.Check(context.Background())
+		if errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EPERM) {
+			t.Skipf("raw sockets unavailable: %v", err)
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("addresses must match the ip version", func(t *testing.T) {
+		err := newCheck(t, "ping", map[string]any{"host": "127.0.0.1", "ip_version": 6}).Check(context.Background())
+		assert.Equal(t, errors.Is(err, healthcheck.ErrPingFailed), true)
+	})
+}
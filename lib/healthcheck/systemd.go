@@ -0,0 +1,74 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// ErrFailedUnits is returned when systemd units have failed.
+var ErrFailedUnits = errors.New("systemd units failed")
+
+func init() {
+	Register("systemd", NewSystemd)
+}
+
+// SystemdCheck fails if any systemd units have failed, other than
+// those ignored or still failed since before the upgrade, see
+// Upgrade.FailedUnits.
+type SystemdCheck struct {
+	Ignore []string
+}
+
+// NewSystemd creates a systemd check, see SystemdCheck for settings.
+func NewSystemd(spec Spec) (HealthCheck, error) {
+	var c SystemdCheck
+	err := DecodeSettings(spec, &c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c SystemdCheck) Check(ctx context.Context) error {
+	_, err := c.CheckReport(ctx)
+	return err
+}
+
+// CheckReport reports the number of failed and ignored units.
+func (c SystemdCheck) CheckReport(ctx context.Context) (Report, error) {
+	units, err := system.FailedUnits(ctx)
+	if err != nil {
+		return Report{}, fmt.Errorf("%w: %w", ErrFailedUnits, err)
+	}
+
+	upgrade, _ := UpgradeFrom(ctx)
+	var failed, ignored []string
+	for _, u := range units {
+		if slices.Contains(c.Ignore, u.Name) || failedBefore(upgrade.FailedUnits, u) {
+			ignored = append(ignored, u.Name)
+		} else {
+			failed = append(failed, u.Name)
+		}
+	}
+	report := Report{Metrics: map[string]any{"failed": len(failed), "ignored": len(ignored)}}
+	if len(ignored) > 0 {
+		report.Message = "ignored failed units: " + strings.Join(ignored, ", ")
+	}
+	if len(failed) > 0 {
+		return report, fmt.Errorf("%w: %s", ErrFailedUnits, strings.Join(failed, ", "))
+	}
+	return report, nil
+}
+
+// failedBefore reports whether unit has been failed since before the
+// upgrade. Baseline units failing at an unknown time match by name.
+func failedBefore(baseline []system.FailedUnit, unit system.FailedUnit) bool {
+	return slices.ContainsFunc(baseline, func(b system.FailedUnit) bool {
+		return b.Name == unit.Name && (b.Since.IsZero() || !unit.Since.After(b.Since))
+	})
+}
@@ -0,0 +1,107 @@
+package healthcheck_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/healthcheck"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// failedUnits puts a systemctl first in PATH that lists units as failed.
+func failedUnits(t *testing.T, units ...system.FailedUnit) {
+	script := "#!/bin/sh\nif [ \"$1\" = show ]; then\n"
+	for _, u := range units {
+		script += "echo 'InactiveEnterTimestamp=@" + strconv.FormatInt(u.Since.Unix(), 10) + "'\necho\n"
+	}
+	script += "exit 0\nfi\n"
+	for _, u := range units {
+		script += "echo '" + u.Name + " loaded failed failed " + u.Name + "'\n"
+	}
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "systemctl"), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestSystemdCheck(t *testing.T) {
+	since := time.Unix(1760000000, 0)
+
+	t.Run("passes without failed units", func(t *testing.T) {
+		failedUnits(t)
+		hc := newCheck(t, "systemd", nil)
+
+		err := hc.Check(context.Background())
+
+		assert.Equal(t, err, nil)
+	})
+
+	t.Run("failed units fail", func(t *testing.T) {
+		failedUnits(t, system.FailedUnit{Name: "zfs-scrub.service", Since: since}, system.FailedUnit{Name: "nginx.service", Since: since})
+		hc := newCheck(t, "systemd", nil)
+
+		err := hc.Check(context.Background())
+
+		assert.Equal(t, errors.Is(err, healthcheck.ErrFailedUnits), true)
+		assert.Equal(t, err.Error(), "systemd units failed: zfs-scrub.service, nginx.service")
+	})
+
+	t.Run("units that failed before the upgrade or are ignored pass", func(t *testing.T) {
+		failedUnits(t,
+			system.FailedUnit{Name: "zfs-scrub.service", Since: since},
+			system.FailedUnit{Name: "backup.timer", Since: since},
+			system.FailedUnit{Name: "nginx.service", Since: since})
+		hc := newCheck(t, "systemd", map[string]any{"ignore": []any{"backup.timer"}})
+		ctx := healthcheck.WithUpgrade(context.Background(), healthcheck.Upgrade{
+			FailedUnits: []system.FailedUnit{{Name: "zfs-scrub.service", Since: since}},
+		})
+
+		report, err := hc.(healthcheck.Reporter).CheckReport(ctx)
+
+		assert.Equal(t, err.Error(), "systemd units failed: nginx.service")
+		assert.Equal(t, report.Message, "ignored failed units: zfs-scrub.service, backup.timer")
+		assert.Equal(t, report.Metrics["failed"], any(1))
+		assert.Equal(t, report.Metrics["ignored"], any(2))
+	})
+
+	t.Run("units that failed again since the upgrade fail", func(t *testing.T) {
+		failedUnits(t, system.FailedUnit{Name: "zfs-scrub.service", Since: since.Add(time.Hour)})
+		hc := newCheck(t, "systemd", nil)
+		ctx := healthcheck.WithUpgrade(context.Background(), healthcheck.Upgrade{
+			FailedUnits: []system.FailedUnit{{Name: "zfs-scrub.service", Since: since}},
+		})
+
+		err := hc.Check(ctx)
+
+		assert.Equal(t, errors.Is(err, healthcheck.ErrFailedUnits), true)
+		assert.Equal(t, err.Error(), "systemd units failed: zfs-scrub.service")
+	})
+
+	t.Run("units recorded without a failure time are ignored by name", func(t *testing.T) {
+		failedUnits(t, system.FailedUnit{Name: "zfs-scrub.service", Since: since})
+		hc := newCheck(t, "systemd", nil)
+		ctx := healthcheck.WithUpgrade(context.Background(), healthcheck.Upgrade{
+			FailedUnits: []system.FailedUnit{{Name: "zfs-scrub.service"}},
+		})
+
+		assert.Equal(t, hc.Check(ctx), nil)
+	})
+
+	t.Run("systemctl failures fail", func(t *testing.T) {
+		t.Setenv("PATH", t.TempDir())
+		hc := newCheck(t, "systemd", nil)
+
+		err := hc.Check(context.Background())
+
+		assert.Equal(t, errors.Is(err, healthcheck.ErrFailedUnits), true)
+		assert.Equal(t, errors.Is(err, system.ErrSystemctl), true)
+	})
+}
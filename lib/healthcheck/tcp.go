@@ -0,0 +1,72 @@
+package healthcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrTCPCheck is returned when a tcp check fails.
+var ErrTCPCheck = errors.New("tcp check failed")
+
+func init() {
+	Register("tcp", NewTCP)
+}
+
+// TCPCheck connects to a host:port, optionally completing a TLS
+// handshake.
+type TCPCheck struct {
+	Address string
+	TLS     bool
+	// defaults to the address host
+	ServerName string `mapstructure:"server_name"`
+	// PEM CA certificates trusted in addition to the system roots
+	CAFile string `mapstructure:"ca_file"`
+
+	tlsConfig *tls.Config
+}
+
+// NewTCP creates a tcp check, see TCPCheck for settings.
+func NewTCP(spec Spec) (HealthCheck, error) {
+	var c TCPCheck
+	err := DecodeSettings(spec, &c)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: address: %w", ErrSettings, spec.Name, err)
+	}
+	if c.TLS {
+		serverName := c.ServerName
+		if serverName == "" {
+			serverName = host
+		}
+		c.tlsConfig, err = tlsConfig(spec, c.CAFile, serverName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c TCPCheck) Check(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.Address)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrTCPCheck, c.Address, err)
+	}
+	defer conn.Close()
+	if c.tlsConfig == nil {
+		return nil
+	}
+
+	tlsConn := tls.Client(conn, c.tlsConfig)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %s: tls: %w", ErrTCPCheck, c.Address, err)
+	}
+	return nil
+}
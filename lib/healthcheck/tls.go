@@ -0,0 +1,31 @@
+package healthcheck
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// tlsConfig returns a TLS config trusting the PEM CA certificates in
+// caFile in addition to the system roots. An empty caFile trusts only
+// the system roots.
+func tlsConfig(spec Spec, caFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if caFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: ca_file: %w", ErrSettings, spec.Name, err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%w: %s: ca_file: no certificates in %s", ErrSettings, spec.Name, caFile)
+	}
+	config.RootCAs = roots
+	return config, nil
+}
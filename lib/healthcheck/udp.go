@@ -0,0 +1,87 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+)
+
+// ErrUDPCheck is returned when a udp check fails.
+var ErrUDPCheck = errors.New("udp check failed")
+
+func init() {
+	Register("udp", NewUDP)
+}
+
+// UDPCheck sends a datagram to a host:port, and optionally expects a
+// response.
+type UDPCheck struct {
+	Address string
+	Send    string
+	// regular expression the response must match. Without it, the check
+	// passes once the datagram is sent.
+	Expect string
+
+	expect *regexp.Regexp
+}
+
+// NewUDP creates a udp check, see UDPCheck for settings.
+func NewUDP(spec Spec) (HealthCheck, error) {
+	var c UDPCheck
+	err := DecodeSettings(spec, &c)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = net.SplitHostPort(c.Address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: address: %w", ErrSettings, spec.Name, err)
+	}
+	if c.Send == "" {
+		return nil, fmt.Errorf("%w: %s: send required", ErrSettings, spec.Name)
+	}
+	if c.Expect != "" {
+		c.expect, err = regexp.Compile(c.Expect)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: expect: %w", ErrSettings, spec.Name, err)
+		}
+	}
+	return c, nil
+}
+
+func (c UDPCheck) Check(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", c.Address)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrUDPCheck, c.Address, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// unblock reads when ctx is cancelled without a deadline
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	_, err = conn.Write([]byte(c.Send))
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrUDPCheck, c.Address, err)
+	}
+	if c.expect == nil {
+		return nil
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrUDPCheck, c.Address, err)
+	}
+	if !c.expect.Match(buf[:n]) {
+		return fmt.Errorf("%w: %s: response doesn't match %q", ErrUDPCheck, c.Address, c.Expect)
+	}
+	return nil
+}
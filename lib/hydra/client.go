@@ -1,35 +1,109 @@
 package hydra
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/backoff"
+)
+
+var (
+	// ErrRequest is returned when a request to hydra can't be built or completed.
+	ErrRequest = errors.New("hydra request failed")
+	// ErrHTTPStatus is matched by a *StatusError when hydra responds with a non 2xx status.
+	ErrHTTPStatus = errors.New("unexpected hydra http status")
+	// ErrDecode is returned when a hydra response body isn't the expected JSON.
+	ErrDecode = errors.New("hydra response decode failed")
+	// ErrNoEval is returned when a build isn't associated with a jobset evaluation.
+	ErrNoEval = errors.New("build has no jobset evaluation")
+	// ErrBuildUnsuccessful is returned when a finished build did not succeed.
+	ErrBuildUnsuccessful = errors.New("hydra build unsuccessful")
+	// ErrNoOutput is returned when a build has no `out` output path.
+	ErrNoOutput = errors.New("build has no out output")
+	// ErrNoSuccessfulBuild is returned when no recent build succeeded.
+	ErrNoSuccessfulBuild = errors.New("no successful hydra build")
 )
 
+// StatusError describes a non 2xx hydra response.
+type StatusError struct {
+	StatusCode int
+	Url        string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v: %d %s", ErrHTTPStatus, e.StatusCode, e.Url)
+}
+
+func (e *StatusError) Is(target error) bool {
+	return target == ErrHTTPStatus
+}
+
 type HydraClient struct {
 	Instance string
 	JobSet   string
 	Job      string
 	Project  string
+	Auth     Auth
+	// optional, defaults to an empty http.Client. Share one client
+	// between requests to reuse connections and session cookies.
+	HTTPClient *http.Client
+	// per request deadline, including reading the body. Zero disables.
+	RequestTimeout time.Duration
+	// number of retries after 5xx responses and connection errors
+	Retries int
+	// delay between retries
+	Backoff backoff.Backoff
 }
 
 // see https://github.com/NixOS/hydra/blob/master/hydra-api.yaml
 // These are partial implementations, just grabbing what I need.
 
 type Build struct {
+	ID      int    `json:"id"`
+	Project string `json:"project"`
+	JobSet  string `json:"jobset"`
+	// job name within the jobset
+	Job string `json:"job"`
+	// unix timestamp the build was queued
+	Timestamp int64 `json:"timestamp"`
 	// 1 is finished, else not
 	Finished int `json:"finished"`
-	// may be nil if not finished, 1 is success, else not
-	BuildStatus int `json:"buildstatus"`
+	// may be nil if not finished, prefer Status()
+	BuildStatus BuildStatus `json:"buildstatus"`
 	// should be length 1
 	JobSetEvals []int `json:"jobsetevals"`
+	// derivation name, e.g. nixos-system-<host>-<version>
+	NixName string `json:"nixname"`
+	// store path of the build's derivation
+	DrvPath string `json:"drvpath"`
+	// output name -> store path
+	BuildOutputs map[string]BuildOutput `json:"buildoutputs"`
+}
+
+type BuildOutput struct {
+	Path string `json:"path"`
+}
+
+// OutPath returns the store path of the build's `out` output.
+func (b Build) OutPath() (string, error) {
+	out, ok := b.BuildOutputs["out"]
+	if !ok || out.Path == "" {
+		return "", fmt.Errorf("%w: build %d", ErrNoOutput, b.ID)
+	}
+	return out.Path, nil
 }
 
 type Eval struct {
+	ID int `json:"id"`
 	// flake specification for a specific git commit
 	Flake string `json:"flake"`
 }
@@ -38,80 +112,190 @@ type Eval struct {
 Gets a the latest build. These are host toplevel derivations in this
 use case.
 */
-func (client HydraClient) GetLatestBuild() Build {
-	httpClient := http.Client{}
-
-	requestUrl, err := url.JoinPath(client.Instance, "job", client.Project, client.JobSet, client.Job, "latest")
+func (client HydraClient) GetLatestBuild(ctx context.Context) (Build, error) {
+	var build Build
+	requestUrl, err := client.endpoint(nil, "job", client.Project, client.JobSet, client.Job, "latest")
 	if err != nil {
-		panic(err)
+		return build, err
 	}
-	req, err := http.NewRequest(http.MethodGet, requestUrl, nil)
+	err = client.getJSON(ctx, "GetLatestBuild", &build, requestUrl)
 	if err != nil {
-		panic(err)
+		return build, err
 	}
 
-	req.Header.Add("Accept", "application/json")
-	resp, err := httpClient.Do(req)
+	slog.Debug(fmt.Sprintf("%+v", build))
+	return build, nil
+}
+
+/*
+Gets the latest finished build, as selected by hydra's latest-finished
+endpoint.
+*/
+func (client HydraClient) GetLatestFinishedBuild(ctx context.Context) (Build, error) {
+	var build Build
+	requestUrl, err := client.endpoint(nil, "job", client.Project, client.JobSet, client.Job, "latest-finished")
 	if err != nil {
-		panic(err)
+		return build, err
+	}
+	err = client.getJSON(ctx, "GetLatestFinishedBuild", &build, requestUrl)
+	if err != nil {
+		return build, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	slog.Debug(fmt.Sprintf("%+v", build))
+	return build, nil
+}
+
+/*
+Gets up to n of the most recent finished builds of the job, newest
+first.
+*/
+func (client HydraClient) GetRecentBuilds(ctx context.Context, n int) ([]Build, error) {
+	var builds []Build
+	query := url.Values{}
+	query.Set("nr", strconv.Itoa(n))
+	query.Set("project", client.Project)
+	query.Set("jobset", client.JobSet)
+	query.Set("job", client.Job)
+	requestUrl, err := client.endpoint(query, "api", "latestbuilds")
 	if err != nil {
-		panic(err)
+		return builds, err
+	}
+	err = client.getJSON(ctx, "GetRecentBuilds", &builds, requestUrl)
+	if err != nil {
+		return builds, err
 	}
-	slog.Debug("GetLatestBuild",
-		slog.String("body", string(body)),
-		slog.String("url", requestUrl))
 
-	var build Build
-	err = json.Unmarshal(body, &build)
+	slices.SortFunc(builds, func(a, b Build) int {
+		return b.ID - a.ID
+	})
+	slog.Debug(fmt.Sprintf("%+v", builds))
+	return builds, nil
+}
+
+/*
+Gets the newest successful build out of the n most recent finished
+builds. Newer unsuccessful builds are returned as skipped.
+*/
+func (client HydraClient) GetLatestSuccessfulBuild(ctx context.Context, n int) (build Build, skipped []Build, err error) {
+	builds, err := client.GetRecentBuilds(ctx, n)
 	if err != nil {
-		panic(err)
+		return build, skipped, err
 	}
 
-	slog.Debug(fmt.Sprintf("%+v", build))
-	return build
+	for _, b := range builds {
+		if b.Status() == StatusSucceeded {
+			return b, skipped, nil
+		}
+		skipped = append(skipped, b)
+	}
+	return build, skipped, fmt.Errorf("%w: in %d most recent builds", ErrNoSuccessfulBuild, len(builds))
 }
 
 /*
 Gets a specific evaluation. This includes the flake that includes the
 job / build.
 */
-func (client HydraClient) GetEval(build Build) Eval {
-	httpClient := http.Client{}
+func (client HydraClient) GetEval(ctx context.Context, build Build) (Eval, error) {
+	var eval Eval
+	if len(build.JobSetEvals) == 0 {
+		return eval, ErrNoEval
+	}
 
-	requestUrl, err := url.JoinPath(client.Instance, "eval", strconv.Itoa(build.JobSetEvals[0]))
+	requestUrl, err := client.endpoint(nil, "eval", strconv.Itoa(build.JobSetEvals[0]))
 	if err != nil {
-		panic(err)
+		return eval, err
 	}
-	req, err := http.NewRequest(http.MethodGet, requestUrl, nil)
+	err = client.getJSON(ctx, "GetEval", &eval, requestUrl)
 	if err != nil {
-		panic(err)
+		return eval, err
+	}
+
+	slog.Debug(fmt.Sprintf("%+v", eval))
+	return eval, nil
+}
+
+// endpoint builds a url for path on the hydra instance.
+func (client HydraClient) endpoint(query url.Values, path ...string) (string, error) {
+	u, err := url.Parse(client.Instance)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrRequest, err)
+	}
+	u = u.JoinPath(path...)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// getJSON performs a GET request for requestUrl and decodes the JSON
+// response body into v. 5xx responses and connection errors are
+// retried with backoff until client.Retries is exhausted or ctx is
+// done.
+func (client HydraClient) getJSON(ctx context.Context, caller string, v any, requestUrl string) error {
+	for attempt := 1; ; attempt++ {
+		retry, err := client.getJSONOnce(ctx, caller, v, requestUrl)
+		if err == nil || !retry || attempt > client.Retries || ctx.Err() != nil {
+			return err
+		}
+
+		delay := client.Backoff.Delay(attempt)
+		slog.Warn("Hydra request failed, retrying.",
+			slog.String("caller", caller),
+			slog.String("url", requestUrl),
+			slog.Int("attempt", attempt),
+			slog.Int("retries", client.Retries),
+			slog.Duration("delay", delay),
+			slog.Any("err", err))
+		sleepErr := backoff.Sleep(ctx, delay)
+		if sleepErr != nil {
+			return fmt.Errorf("%w: %w", err, sleepErr)
+		}
+	}
+}
+
+// getJSONOnce performs a single request attempt. retry reports
+// whether the failure is transient.
+func (client HydraClient) getJSONOnce(ctx context.Context, caller string, v any, requestUrl string) (retry bool, err error) {
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	if client.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.RequestTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestUrl, nil)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrRequest, err)
 	}
 
 	req.Header.Add("Accept", "application/json")
+	client.Auth.authorize(req)
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		panic(err)
+		return true, fmt.Errorf("%w: %w", ErrRequest, err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		panic(err)
+		return true, fmt.Errorf("%w: %w", ErrRequest, err)
 	}
-	slog.Debug("GetEval",
+	slog.Debug(caller,
 		slog.String("body", string(body)),
-		slog.String("url", requestUrl))
+		slog.String("url", requestUrl),
+		slog.Int("status", resp.StatusCode))
 
-	var eval Eval
-	err = json.Unmarshal(body, &eval)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500, &StatusError{StatusCode: resp.StatusCode, Url: requestUrl}
+	}
+
+	err = json.Unmarshal(body, v)
 	if err != nil {
-		panic(err)
+		return false, fmt.Errorf("%w: %s: %w", ErrDecode, requestUrl, err)
 	}
 
-	slog.Debug(fmt.Sprintf("%+v", eval))
-	return eval
+	return false, nil
 }
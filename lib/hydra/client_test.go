@@ -0,0 +1,348 @@
+package hydra_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/backoff"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/hydra"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/hydra/hydratest"
+)
+
+const latestPath = "/job/nix-config/main/hosts.oak/latest"
+
+func build(id int, status hydra.BuildStatus, evals ...int) hydra.Build {
+	return hydra.Build{
+		ID:          id,
+		Project:     "nix-config",
+		JobSet:      "main",
+		Job:         "hosts.oak",
+		Finished:    1,
+		BuildStatus: status,
+		JobSetEvals: evals,
+	}
+}
+
+func newServer(t *testing.T) (*hydratest.Server, hydra.HydraClient) {
+	server := hydratest.NewServer(t)
+	server.AddBuild(build(1, hydra.StatusSucceeded, 10), build(2, hydra.StatusFailed, 20))
+	server.AddEval("nix-config", "main",
+		hydra.Eval{ID: 10, Flake: "github:hyperparabolic/nix-config/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		hydra.Eval{ID: 20, Flake: "github:hyperparabolic/nix-config/bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"})
+	server.SetLatest("nix-config", "main", "hosts.oak", 2)
+	server.SetLatestFinished("nix-config", "main", "hosts.oak", 1)
+
+	client := server.Client("nix-config", "main", "hosts.oak")
+	client.Retries = 2
+	client.Backoff = backoff.Backoff{Initial: time.Millisecond, Max: time.Millisecond}
+	return server, client
+}
+
+func TestGetLatestBuild(t *testing.T) {
+	t.Run("follows latest redirects", func(t *testing.T) {
+		_, client := newServer(t)
+
+		b, err := client.GetLatestBuild(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, b.ID, 2)
+		assert.Equal(t, b.Status(), hydra.StatusFailed)
+
+		b, err = client.GetLatestFinishedBuild(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, b.ID, 1)
+	})
+
+	t.Run("retries 5xx responses", func(t *testing.T) {
+		server, client := newServer(t)
+		server.InjectFault(latestPath, hydratest.Fault{Status: 502}, hydratest.Fault{Status: 503})
+
+		b, err := client.GetLatestBuild(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, b.ID, 2)
+		assert.Equal(t, server.Requests(latestPath), 3)
+	})
+
+	t.Run("returns StatusError after exhausting retries", func(t *testing.T) {
+		server, client := newServer(t)
+		server.InjectFault(latestPath, hydratest.Fault{Status: 500}, hydratest.Fault{Status: 500}, hydratest.Fault{Status: 500})
+
+		_, err := client.GetLatestBuild(context.Background())
+		var statusErr *hydra.StatusError
+		if !errors.As(err, &statusErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, statusErr.StatusCode, 500)
+		assert.Equal(t, errors.Is(err, hydra.ErrHTTPStatus), true)
+		assert.Equal(t, server.Requests(latestPath), 3)
+	})
+
+	t.Run("does not retry 4xx responses", func(t *testing.T) {
+		server, client := newServer(t)
+		server.InjectFault(latestPath, hydratest.Fault{Status: 404})
+
+		_, err := client.GetLatestBuild(context.Background())
+		assert.Equal(t, errors.Is(err, hydra.ErrHTTPStatus), true)
+		assert.Equal(t, server.Requests(latestPath), 1)
+	})
+
+	t.Run("malformed JSON is a decode error", func(t *testing.T) {
+		server, client := newServer(t)
+		server.InjectFault("/build/2", hydratest.Fault{Body: `{"id": `})
+
+		_, err := client.GetLatestBuild(context.Background())
+		assert.Equal(t, errors.Is(err, hydra.ErrDecode), true)
+	})
+
+	t.Run("slow responses are retried after the request timeout", func(t *testing.T) {
+		server, client := newServer(t)
+		client.RequestTimeout = 50 * time.Millisecond
+		server.InjectFault(latestPath, hydratest.Fault{Delay: time.Second})
+
+		b, err := client.GetLatestBuild(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, b.ID, 2)
+		assert.Equal(t, server.Requests(latestPath), 2)
+	})
+
+	t.Run("context deadline stops retries", func(t *testing.T) {
+		server, client := newServer(t)
+		client.Backoff = backoff.Backoff{Initial: time.Hour}
+		server.InjectFault(latestPath, hydratest.Fault{Status: 500})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := client.GetLatestBuild(ctx)
+		assert.Equal(t, errors.Is(err, context.DeadlineExceeded), true)
+		assert.Equal(t, server.Requests(latestPath), 1)
+	})
+}
+
+func TestGetEval(t *testing.T) {
+	t.Run("gets the build's eval", func(t *testing.T) {
+		_, client := newServer(t)
+
+		eval, err := client.GetEval(context.Background(), build(1, hydra.StatusSucceeded, 10))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, eval.Flake, "github:hyperparabolic/nix-config/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	})
+
+	t.Run("builds without evals error", func(t *testing.T) {
+		_, client := newServer(t)
+
+		_, err := client.GetEval(context.Background(), build(1, hydra.StatusSucceeded))
+		assert.Equal(t, errors.Is(err, hydra.ErrNoEval), true)
+	})
+}
+
+func TestGetLatestSuccessfulBuild(t *testing.T) {
+	t.Run("skips newer unsuccessful builds", func(t *testing.T) {
+		server, client := newServer(t)
+		server.AddBuild(build(3, hydra.StatusCancelled, 30), build(4, hydra.StatusTimedOut, 40))
+
+		b, skipped, err := client.GetLatestSuccessfulBuild(context.Background(), 10)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, b.ID, 1)
+		assert.Equal(t, len(skipped), 3)
+		assert.Equal(t, skipped[0].ID, 4)
+	})
+
+	t.Run("errors without a successful build in depth", func(t *testing.T) {
+		_, client := newServer(t)
+
+		_, _, err := client.GetLatestSuccessfulBuild(context.Background(), 1)
+		assert.Equal(t, errors.Is(err, hydra.ErrNoSuccessfulBuild), true)
+	})
+}
+
+func TestGetRequiredBuilds(t *testing.T) {
+	t.Run("gets required jobs and aggregate constituents from the same eval", func(t *testing.T) {
+		server, client := newServer(t)
+		tests := build(5, hydra.StatusSucceeded, 10)
+		tests.Job = "tests.oak"
+		release := build(6, hydra.StatusSucceeded, 10)
+		release.Job = "release"
+		constituent := build(7, hydra.StatusFailed, 10)
+		constituent.Job = "tests.vm"
+		otherEval := build(8, hydra.StatusFailed, 20)
+		otherEval.Job = "tests.oak"
+		server.AddBuild(tests, release, constituent, otherEval)
+		server.SetConstituents(6, 7)
+
+		required, err := client.GetRequiredBuilds(context.Background(), build(1, hydra.StatusSucceeded, 10), []string{"tests.oak"}, "release")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(required), 3)
+		assert.Equal(t, required[0].ID, 5)
+		assert.Equal(t, required[1].ID, 6)
+		assert.Equal(t, required[2].ID, 7)
+	})
+
+	t.Run("missing required jobs error", func(t *testing.T) {
+		_, client := newServer(t)
+
+		_, err := client.GetRequiredBuilds(context.Background(), build(1, hydra.StatusSucceeded, 10), []string{"tests.oak"}, "")
+		assert.Equal(t, errors.Is(err, hydra.ErrJobNotFound), true)
+	})
+}
+
+func TestPins(t *testing.T) {
+	t.Run("gets a build by id", func(t *testing.T) {
+		_, client := newServer(t)
+
+		b, err := client.GetBuild(context.Background(), 1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, b.ID, 1)
+	})
+
+	t.Run("gets the job build of an eval", func(t *testing.T) {
+		_, client := newServer(t)
+
+		b, err := client.GetEvalJobBuild(context.Background(), 20)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, b.ID, 2)
+	})
+
+	t.Run("finds evals by abbreviated revision", func(t *testing.T) {
+		_, client := newServer(t)
+
+		eval, err := client.GetRevEval(context.Background(), "aaaaaaa")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, eval.ID, 10)
+
+		_, err = client.GetRevEval(context.Background(), "ccccccc")
+		assert.Equal(t, errors.Is(err, hydra.ErrRevNotFound), true)
+	})
+
+	t.Run("matches only the flake revision", func(t *testing.T) {
+		server := hydratest.NewServer(t)
+		server.AddEval("nix-config", "main",
+			hydra.Eval{ID: 10, Flake: "github:hyperparabolic/nix-config/c717fb0df0c30ead2f33ab2eecf4640f57fb5517?narHash=sha256-d00dfeed1234567"},
+			hydra.Eval{ID: 11, Flake: "git+https://git.example.com/nix-config?ref=main&rev=d00dfeed00c30ead2f33ab2eecf4640f57fb5517"},
+			hydra.Eval{ID: 12, Flake: "github:hyperparabolic/nix-config/c717fb0df0c30ead2f33ab2eecf4640f57fb5517"})
+		client := server.Client("nix-config", "main", "hosts.oak")
+
+		eval, err := client.GetRevEval(context.Background(), "d00dfeed")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, eval.ID, 11)
+
+		eval, err = client.GetRevEval(context.Background(), "c717fb0df0c30ead2f33ab2eecf4640f57fb5517")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, eval.ID, 12)
+	})
+
+	t.Run("ambiguous revisions error", func(t *testing.T) {
+		server := hydratest.NewServer(t)
+		server.AddEval("nix-config", "main",
+			hydra.Eval{ID: 10, Flake: "github:hyperparabolic/nix-config/c717fb0df0c30ead2f33ab2eecf4640f57fb5517"},
+			hydra.Eval{ID: 11, Flake: "github:hyperparabolic/nix-config/c717fb0d11111111111111111111111111111111"})
+		client := server.Client("nix-config", "main", "hosts.oak")
+
+		_, err := client.GetRevEval(context.Background(), "c717fb0d")
+		assert.Equal(t, errors.Is(err, hydra.ErrRevAmbiguous), true)
+
+		_, err = client.GetRevEval(context.Background(), "c717fb")
+		assert.Equal(t, errors.Is(err, hydra.ErrRevAmbiguous), true)
+	})
+}
+
+func TestAuth(t *testing.T) {
+	var authTests = []struct {
+		description string
+		auth        hydra.Auth
+		authorize   func(r *http.Request) bool
+	}{
+		{
+			"basic",
+			hydra.Auth{Method: hydra.AuthBasic, User: "oak", Secret: "hunter2"},
+			func(r *http.Request) bool {
+				user, password, ok := r.BasicAuth()
+				return ok && user == "oak" && password == "hunter2"
+			},
+		},
+		{
+			"bearer",
+			hydra.Auth{Method: hydra.AuthBearer, Secret: "token"},
+			func(r *http.Request) bool {
+				return r.Header.Get("Authorization") == "Bearer token"
+			},
+		},
+		{
+			"header",
+			hydra.Auth{Method: hydra.AuthHeader, Header: "X-Hydra-Token", Secret: "token"},
+			func(r *http.Request) bool {
+				return r.Header.Get("X-Hydra-Token") == "token"
+			},
+		},
+	}
+
+	for _, test := range authTests {
+		t.Run(test.description, func(t *testing.T) {
+			server, client := newServer(t)
+			server.Authorize = test.authorize
+
+			_, err := client.GetLatestBuild(context.Background())
+			assert.Equal(t, errors.Is(err, hydra.ErrHTTPStatus), true)
+
+			client.Auth = test.auth
+			_, err = client.GetLatestBuild(context.Background())
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	t.Run("session", func(t *testing.T) {
+		server, client := newServer(t)
+		server.Users["oak"] = "hunter2"
+		server.Authorize = func(r *http.Request) bool {
+			cookie, err := r.Cookie(hydratest.SessionCookie)
+			return err == nil && cookie.Value == "oak"
+		}
+		client.Auth = hydra.Auth{Method: hydra.AuthSession, User: "oak", Secret: "wrong"}
+
+		err := client.Login(context.Background())
+		assert.Equal(t, errors.Is(err, hydra.ErrLogin), true)
+
+		client.HTTPClient.Jar, _ = cookiejar.New(nil)
+		err = client.Login(context.Background())
+		assert.Equal(t, errors.Is(err, hydra.ErrLogin), true)
+
+		client.Auth.Secret = "hunter2"
+		err = client.Login(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, err = client.GetLatestBuild(context.Background())
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
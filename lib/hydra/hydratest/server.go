@@ -0,0 +1,319 @@
+/*
+Package hydratest provides an httptest based stand in for a hydra
+instance. It serves scriptable build and eval fixtures from the
+endpoints used by hydra.HydraClient, and can inject faults like 5xx
+responses, slow responses, and malformed JSON.
+*/
+package hydratest
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/hydra"
+)
+
+// SessionCookie is the cookie set by a successful /login.
+const SessionCookie = "hydra_session"
+
+// Fault replaces the normal response to a single request.
+type Fault struct {
+	// respond with this status instead of the fixture, if non-zero
+	Status int
+	// wait before responding, or until the request is cancelled
+	Delay time.Duration
+	// respond with this raw body instead of the fixture, if non-empty
+	Body string
+}
+
+type jobKey struct {
+	project, jobset, job string
+}
+
+type Server struct {
+	*httptest.Server
+
+	// optional, requests are rejected with 403 unless this returns true.
+	// /login is never rejected.
+	Authorize func(r *http.Request) bool
+	// username -> password accepted by /login
+	Users map[string]string
+
+	mu             sync.Mutex
+	builds         map[int]hydra.Build
+	evals          map[int]hydra.Eval
+	evalJobSets    map[int]jobKey
+	latest         map[jobKey]int
+	latestFinished map[jobKey]int
+	constituents   map[int][]int
+	faults         map[string][]Fault
+	requests       map[string]int
+}
+
+// NewServer starts a fake hydra instance, closed when the test ends.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		Users:          map[string]string{},
+		builds:         map[int]hydra.Build{},
+		evals:          map[int]hydra.Eval{},
+		evalJobSets:    map[int]jobKey{},
+		latest:         map[jobKey]int{},
+		latestFinished: map[jobKey]int{},
+		constituents:   map[int][]int{},
+		faults:         map[string][]Fault{},
+		requests:       map[string]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Client returns a hydra.HydraClient for a job on this server.
+func (s *Server) Client(project, jobset, job string) hydra.HydraClient {
+	return hydra.HydraClient{
+		Instance:   s.URL,
+		Project:    project,
+		JobSet:     jobset,
+		Job:        job,
+		HTTPClient: s.Server.Client(),
+	}
+}
+
+// AddBuild serves a build from /build/<id>, and includes it in
+// /api/latestbuilds and the /eval/<id>/builds of its JobSetEvals.
+func (s *Server) AddBuild(builds ...hydra.Build) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range builds {
+		s.builds[b.ID] = b
+	}
+}
+
+// AddEval serves an eval of a jobset from /eval/<id> and
+// /jobset/<project>/<jobset>/evals.
+func (s *Server) AddEval(project, jobset string, evals ...hydra.Eval) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range evals {
+		s.evals[e.ID] = e
+		s.evalJobSets[e.ID] = jobKey{project, jobset, ""}
+	}
+}
+
+// SetLatest redirects /job/<project>/<jobset>/<job>/latest to a build.
+func (s *Server) SetLatest(project, jobset, job string, buildId int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest[jobKey{project, jobset, job}] = buildId
+}
+
+// SetLatestFinished redirects /job/<project>/<jobset>/<job>/latest-finished
+// to a build.
+func (s *Server) SetLatestFinished(project, jobset, job string, buildId int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latestFinished[jobKey{project, jobset, job}] = buildId
+}
+
+// SetConstituents serves builds from /build/<aggregateId>/constituents.
+func (s *Server) SetConstituents(aggregateId int, buildIds ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.constituents[aggregateId] = buildIds
+}
+
+// InjectFault queues faults for requests to path, e.g.
+// "/job/p/js/j/latest". Each fault replaces one response, in order.
+func (s *Server) InjectFault(path string, faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[path] = append(s.faults[path], faults...)
+}
+
+// Requests returns the number of requests received for path.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	var fault *Fault
+	if queued := s.faults[r.URL.Path]; len(queued) > 0 {
+		fault = &queued[0]
+		s.faults[r.URL.Path] = queued[1:]
+	}
+	s.mu.Unlock()
+
+	if fault != nil {
+		if fault.Delay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(fault.Delay):
+			}
+		}
+		if fault.Status != 0 {
+			http.Error(w, http.StatusText(fault.Status), fault.Status)
+			return
+		}
+		if fault.Body != "" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, fault.Body)
+			return
+		}
+	}
+
+	if r.URL.Path == "/login" {
+		s.login(w, r)
+		return
+	}
+	if s.Authorize != nil && !s.Authorize(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 5 && parts[0] == "job" && parts[4] == "latest":
+		s.redirectBuild(w, r, s.latest, jobKey{parts[1], parts[2], parts[3]})
+	case len(parts) == 5 && parts[0] == "job" && parts[4] == "latest-finished":
+		s.redirectBuild(w, r, s.latestFinished, jobKey{parts[1], parts[2], parts[3]})
+	case len(parts) == 2 && parts[0] == "build":
+		writeFixture(w, s.builds, parts[1])
+	case len(parts) == 3 && parts[0] == "build" && parts[2] == "constituents":
+		id, _ := strconv.Atoi(parts[1])
+		writeJSON(w, s.buildList(s.constituents[id]))
+	case len(parts) == 2 && parts[0] == "eval":
+		writeFixture(w, s.evals, parts[1])
+	case len(parts) == 3 && parts[0] == "eval" && parts[2] == "builds":
+		id, _ := strconv.Atoi(parts[1])
+		writeJSON(w, s.evalBuilds(id))
+	case len(parts) == 4 && parts[0] == "jobset" && parts[3] == "evals":
+		writeJSON(w, map[string]any{"evals": s.jobSetEvals(jobKey{parts[1], parts[2], ""})})
+	case len(parts) == 2 && parts[0] == "api" && parts[1] == "latestbuilds":
+		s.latestBuilds(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&creds)
+	if r.Method != http.MethodPost || err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	password, ok := s.Users[creds.Username]
+	s.mu.Unlock()
+	if !ok || password != creds.Password {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Value: creds.Username, Path: "/"})
+	writeJSON(w, map[string]string{"username": creds.Username})
+}
+
+// hydra redirects latest endpoints to the selected build
+func (s *Server) redirectBuild(w http.ResponseWriter, r *http.Request, selected map[jobKey]int, key jobKey) {
+	id, ok := selected[key]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/build/%d", id), http.StatusFound)
+}
+
+func (s *Server) buildList(ids []int) []hydra.Build {
+	builds := []hydra.Build{}
+	for _, id := range ids {
+		if b, ok := s.builds[id]; ok {
+			builds = append(builds, b)
+		}
+	}
+	return builds
+}
+
+func (s *Server) evalBuilds(evalId int) []hydra.Build {
+	builds := []hydra.Build{}
+	for _, b := range s.builds {
+		if slices.Contains(b.JobSetEvals, evalId) {
+			builds = append(builds, b)
+		}
+	}
+	slices.SortFunc(builds, func(a, b hydra.Build) int { return cmp.Compare(a.ID, b.ID) })
+	return builds
+}
+
+// newest first, like hydra
+func (s *Server) jobSetEvals(key jobKey) []hydra.Eval {
+	evals := []hydra.Eval{}
+	for id, e := range s.evals {
+		if s.evalJobSets[id] == key {
+			evals = append(evals, e)
+		}
+	}
+	slices.SortFunc(evals, func(a, b hydra.Eval) int { return cmp.Compare(b.ID, a.ID) })
+	return evals
+}
+
+func (s *Server) latestBuilds(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	nr, err := strconv.Atoi(query.Get("nr"))
+	if err != nil {
+		http.Error(w, "nr parameter required", http.StatusBadRequest)
+		return
+	}
+
+	builds := []hydra.Build{}
+	for _, b := range s.builds {
+		if b.Finished != 1 ||
+			(query.Has("project") && b.Project != query.Get("project")) ||
+			(query.Has("jobset") && b.JobSet != query.Get("jobset")) ||
+			(query.Has("job") && b.Job != query.Get("job")) {
+			continue
+		}
+		builds = append(builds, b)
+	}
+	slices.SortFunc(builds, func(a, b hydra.Build) int { return cmp.Compare(b.ID, a.ID) })
+	writeJSON(w, builds[:min(nr, len(builds))])
+}
+
+func writeFixture[T any](w http.ResponseWriter, fixtures map[int]T, rawId string) {
+	id, err := strconv.Atoi(rawId)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	v, ok := fixtures[id]
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, v)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
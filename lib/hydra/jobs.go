@@ -0,0 +1,92 @@
+package hydra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+// ErrJobNotFound is returned when a job isn't part of a jobset evaluation.
+var ErrJobNotFound = errors.New("job not found in evaluation")
+
+/*
+Gets every build in a jobset evaluation.
+*/
+func (client HydraClient) GetEvalBuilds(ctx context.Context, evalId int) ([]Build, error) {
+	var builds []Build
+	requestUrl, err := client.endpoint(nil, "eval", strconv.Itoa(evalId), "builds")
+	if err != nil {
+		return builds, err
+	}
+	err = client.getJSON(ctx, "GetEvalBuilds", &builds, requestUrl)
+	if err != nil {
+		return builds, err
+	}
+
+	slog.Debug(fmt.Sprintf("%+v", builds))
+	return builds, nil
+}
+
+/*
+Gets the constituent builds of an aggregate build.
+*/
+func (client HydraClient) GetConstituents(ctx context.Context, build Build) ([]Build, error) {
+	var builds []Build
+	requestUrl, err := client.endpoint(nil, "build", strconv.Itoa(build.ID), "constituents")
+	if err != nil {
+		return builds, err
+	}
+	err = client.getJSON(ctx, "GetConstituents", &builds, requestUrl)
+	if err != nil {
+		return builds, err
+	}
+
+	slog.Debug(fmt.Sprintf("%+v", builds))
+	return builds, nil
+}
+
+/*
+Gets the builds of required jobs from the same jobset evaluation as
+build. The aggregate job, if any, is returned along with each of its
+constituents.
+*/
+func (client HydraClient) GetRequiredBuilds(ctx context.Context, build Build, jobs []string, aggregate string) ([]Build, error) {
+	if len(build.JobSetEvals) == 0 {
+		return nil, ErrNoEval
+	}
+	evalBuilds, err := client.GetEvalBuilds(ctx, build.JobSetEvals[0])
+	if err != nil {
+		return nil, err
+	}
+
+	byJob := make(map[string]Build, len(evalBuilds))
+	for _, b := range evalBuilds {
+		byJob[b.Job] = b
+	}
+
+	required := []Build{}
+	for _, job := range jobs {
+		b, ok := byJob[job]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s eval %d", ErrJobNotFound, job, build.JobSetEvals[0])
+		}
+		required = append(required, b)
+	}
+
+	if aggregate != "" {
+		b, ok := byJob[aggregate]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s eval %d", ErrJobNotFound, aggregate, build.JobSetEvals[0])
+		}
+		constituents, err := client.GetConstituents(ctx, b)
+		if err != nil {
+			return nil, err
+		}
+		required = append(required, b)
+		required = append(required, constituents...)
+	}
+
+	return required, nil
+}
@@ -0,0 +1,143 @@
+package hydra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrJobMismatch is returned when a pinned build belongs to a different job.
+	ErrJobMismatch = errors.New("build belongs to a different job")
+	// ErrRevNotFound is returned when no recent evaluation matches a revision.
+	ErrRevNotFound = errors.New("no evaluation found for revision")
+	// ErrRevAmbiguous is returned when an abbreviated revision is too
+	// short, or matches evaluations of different revisions.
+	ErrRevAmbiguous = errors.New("ambiguous revision")
+)
+
+// maximum number of jobset evaluation pages searched for a revision
+const maxEvalPages = 10
+
+// MinRevLength is the shortest abbreviated revision accepted, like git's
+// default abbreviation.
+const MinRevLength = 7
+
+// full length of a git sha1 revision
+const fullRevLength = 40
+
+type evalPage struct {
+	Evals []Eval `json:"evals"`
+	// query string of the next page, empty on the last page
+	Next string `json:"next"`
+}
+
+/*
+Gets a specific build by id.
+*/
+func (client HydraClient) GetBuild(ctx context.Context, id int) (Build, error) {
+	var build Build
+	requestUrl, err := client.endpoint(nil, "build", strconv.Itoa(id))
+	if err != nil {
+		return build, err
+	}
+	err = client.getJSON(ctx, "GetBuild", &build, requestUrl)
+	if err != nil {
+		return build, err
+	}
+
+	slog.Debug(fmt.Sprintf("%+v", build))
+	return build, nil
+}
+
+/*
+Gets the client's job build from a specific jobset evaluation.
+*/
+func (client HydraClient) GetEvalJobBuild(ctx context.Context, evalId int) (Build, error) {
+	builds, err := client.GetEvalBuilds(ctx, evalId)
+	if err != nil {
+		return Build{}, err
+	}
+	for _, b := range builds {
+		if b.Job == client.Job {
+			return b, nil
+		}
+	}
+	return Build{}, fmt.Errorf("%w: %s eval %d", ErrJobNotFound, client.Job, evalId)
+}
+
+/*
+Gets the newest jobset evaluation whose flake is at revision rev. rev
+may be abbreviated to MinRevLength characters, but must not match
+evaluations of different revisions.
+*/
+func (client HydraClient) GetRevEval(ctx context.Context, rev string) (Eval, error) {
+	if len(rev) < MinRevLength {
+		return Eval{}, fmt.Errorf("%w: %s: at least %d characters required", ErrRevAmbiguous, rev, MinRevLength)
+	}
+
+	var found Eval
+	var foundRev string
+	query := url.Values{}
+	for page := 1; page <= maxEvalPages; page++ {
+		query.Set("page", strconv.Itoa(page))
+		requestUrl, err := client.endpoint(query, "jobset", client.Project, client.JobSet, "evals")
+		if err != nil {
+			return Eval{}, err
+		}
+
+		var evals evalPage
+		err = client.getJSON(ctx, "GetRevEval", &evals, requestUrl)
+		if err != nil {
+			return Eval{}, err
+		}
+		for _, eval := range evals.Evals {
+			evalRev := flakeRev(eval.Flake)
+			if !strings.HasPrefix(evalRev, rev) {
+				continue
+			}
+			if foundRev == "" {
+				// newest first, older evals of the same revision are skipped
+				found, foundRev = eval, evalRev
+				slog.Debug(fmt.Sprintf("%+v", eval))
+				if len(rev) == fullRevLength {
+					return found, nil
+				}
+			} else if evalRev != foundRev {
+				return Eval{}, fmt.Errorf("%w: %s matches %s and %s", ErrRevAmbiguous, rev, foundRev, evalRev)
+			}
+		}
+		if evals.Next == "" {
+			break
+		}
+	}
+	if foundRev == "" {
+		return Eval{}, fmt.Errorf("%w: %s", ErrRevNotFound, rev)
+	}
+	return found, nil
+}
+
+// flakeRev returns the git revision a locked flake reference is at, ""
+// if it has none. e.g. github:owner/repo/<rev>?narHash=... or
+// git+https://host/repo?rev=<rev>
+func flakeRev(flake string) string {
+	u, err := url.Parse(flake)
+	if err != nil {
+		return ""
+	}
+	if rev := u.Query().Get("rev"); rev != "" {
+		return rev
+	}
+	switch u.Scheme {
+	case "github", "gitlab", "sourcehut":
+		parts := strings.Split(u.Opaque, "/")
+		if len(parts) >= 3 {
+			return parts[2]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+package hydra
+
+import (
+	"fmt"
+)
+
+// BuildStatus is hydra's `buildstatus`. See BuildStatus in hydra's
+// src/hydra-queue-runner/build-result.hh for the source of these
+// values.
+type BuildStatus int
+
+const (
+	// pseudo-status for builds that haven't finished, hydra reports
+	// these with a null buildstatus
+	StatusUnfinished          BuildStatus = -1
+	StatusSucceeded           BuildStatus = 0
+	StatusFailed              BuildStatus = 1
+	StatusDependencyFailed    BuildStatus = 2
+	StatusAborted             BuildStatus = 3
+	StatusCancelled           BuildStatus = 4
+	StatusFailedWithOutput    BuildStatus = 6
+	StatusTimedOut            BuildStatus = 7
+	StatusCachedFailure       BuildStatus = 8
+	StatusUnsupportedSystem   BuildStatus = 9
+	StatusLogLimitExceeded    BuildStatus = 10
+	StatusOutputLimitExceeded BuildStatus = 11
+	StatusNonDeterministic    BuildStatus = 12
+)
+
+var statusNames = map[BuildStatus]string{
+	StatusUnfinished:          "unfinished",
+	StatusSucceeded:           "succeeded",
+	StatusFailed:              "failed",
+	StatusDependencyFailed:    "dependency-failed",
+	StatusAborted:             "aborted",
+	StatusCancelled:           "cancelled",
+	StatusFailedWithOutput:    "failed-with-output",
+	StatusTimedOut:            "timed-out",
+	StatusCachedFailure:       "cached-failure",
+	StatusUnsupportedSystem:   "unsupported-system",
+	StatusLogLimitExceeded:    "log-limit-exceeded",
+	StatusOutputLimitExceeded: "output-limit-exceeded",
+	StatusNonDeterministic:    "non-deterministic",
+}
+
+func (s BuildStatus) String() string {
+	name, ok := statusNames[s]
+	if !ok {
+		return fmt.Sprintf("unknown-%d", int(s))
+	}
+	return name
+}
+
+// Status returns the build's status, or StatusUnfinished if the build
+// hasn't finished.
+func (b Build) Status() BuildStatus {
+	if b.Finished != 1 {
+		return StatusUnfinished
+	}
+	return b.BuildStatus
+}
@@ -0,0 +1,34 @@
+package hydra_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/hydra"
+)
+
+func TestStatus(t *testing.T) {
+	var statusTests = []struct {
+		body     string
+		expected string
+	}{
+		{`{"finished": 0, "buildstatus": null}`, "unfinished"},
+		{`{"finished": 1, "buildstatus": 0}`, "succeeded"},
+		{`{"finished": 1, "buildstatus": 2}`, "dependency-failed"},
+		{`{"finished": 1, "buildstatus": 4}`, "cancelled"},
+		{`{"finished": 1, "buildstatus": 11}`, "output-limit-exceeded"},
+		{`{"finished": 1, "buildstatus": 99}`, "unknown-99"},
+	}
+
+	for _, test := range statusTests {
+		t.Run(test.expected, func(t *testing.T) {
+			var build hydra.Build
+			err := json.Unmarshal([]byte(test.body), &build)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assert.Equal(t, build.Status().String(), test.expected)
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileLock is a Lock backed by slot files in a directory on a shared
+// mount. Each slot file is created exclusively, and contains its
+// holder. Expired slots are moved aside before they're taken, so only
+// one host can take each.
+type FileLock struct {
+	Dir   string
+	Slots int
+	// optional, slots held longer than this are expired. Zero never
+	// expires slots.
+	TTL time.Duration
+	// optional, the clock, defaults to time.Now
+	Now func() time.Time
+}
+
+func (l FileLock) clock() func() time.Time {
+	if l.Now == nil {
+		return time.Now
+	}
+	return l.Now
+}
+
+func (l FileLock) slot(i int) string {
+	return filepath.Join(l.Dir, fmt.Sprintf("slot-%d", i))
+}
+
+func (l FileLock) Acquire(ctx context.Context, holder string) error {
+	err := os.MkdirAll(l.Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLock, err)
+	}
+
+	// already held
+	for i := range l.Slots {
+		h, _, err := l.read(i)
+		if err != nil {
+			return err
+		}
+		if h == holder {
+			return nil
+		}
+	}
+
+	var holders []string
+	for i := range l.Slots {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %w", ErrLock, ctx.Err())
+		}
+		err := l.create(i, holder)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%w: %w", ErrLock, err)
+		}
+
+		h, info, err := l.read(i)
+		if err != nil {
+			return err
+		}
+		if info != nil && l.TTL > 0 && l.clock()().Sub(info.ModTime()) > l.TTL {
+			taken, err := l.takeOver(i, holder, info)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return nil
+			}
+		}
+		holders = append(holders, h)
+	}
+	return fmt.Errorf("%w: %d slots held by %s", ErrLocked, l.Slots, strings.Join(holders, ", "))
+}
+
+func (l FileLock) Release(ctx context.Context, holder string) error {
+	for i := range l.Slots {
+		h, _, err := l.read(i)
+		if err != nil {
+			return err
+		}
+		if h != holder {
+			continue
+		}
+		err = os.Remove(l.slot(i))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %w", ErrLock, err)
+		}
+	}
+	return nil
+}
+
+// takeOver takes expired slot i for holder. The expired slot file is
+// renamed aside first, which only one host can do. A host that moved a
+// slot taken over since it was found expired restores it instead.
+func (l FileLock) takeOver(i int, holder string, expired fs.FileInfo) (bool, error) {
+	aside := fmt.Sprintf("%s.expired-%s", l.slot(i), rand.Text())
+	err := os.Rename(l.slot(i), aside)
+	if errors.Is(err, fs.ErrNotExist) {
+		// released or taken over since it was read
+		return l.claim(i, holder)
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrLock, err)
+	}
+
+	moved, err := os.Stat(aside)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrLock, err)
+	}
+	if !os.SameFile(expired, moved) {
+		// links fail if the slot was created since, unlike renames
+		err = os.Link(aside, l.slot(i))
+		os.Remove(aside)
+		if err != nil {
+			return false, fmt.Errorf("%w: restoring %s: %w", ErrLock, l.slot(i), err)
+		}
+		return false, nil
+	}
+	os.Remove(aside)
+	return l.claim(i, holder)
+}
+
+// claim creates slot i for holder, and confirms holder holds it.
+func (l FileLock) claim(i int, holder string) (bool, error) {
+	err := l.create(i, holder)
+	if errors.Is(err, fs.ErrExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrLock, err)
+	}
+	h, _, err := l.read(i)
+	if err != nil {
+		return false, err
+	}
+	return h == holder, nil
+}
+
+// create exclusively creates slot i for holder.
+func (l FileLock) create(i int, holder string) error {
+	f, err := os.OpenFile(l.slot(i), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(holder)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(l.slot(i))
+	}
+	return err
+}
+
+// read returns the holder of slot i and its file, modified when it was
+// acquired. Free slots have no holder or file.
+func (l FileLock) read(i int) (holder string, info fs.FileInfo, err error) {
+	info, err = os.Stat(l.slot(i))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrLock, err)
+	}
+	contents, err := os.ReadFile(l.slot(i))
+	if errors.Is(err, fs.ErrNotExist) {
+		// released between reads
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrLock, err)
+	}
+	return string(contents), info, nil
+}
@@ -0,0 +1,95 @@
+package lock_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/lock"
+)
+
+func readSlot(t *testing.T, dir string, slot string) string {
+	t.Helper()
+	holder, err := os.ReadFile(filepath.Join(dir, slot))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(holder)
+}
+
+func TestFileLock(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("grants up to Slots holders", func(t *testing.T) {
+		l := lock.FileLock{Dir: filepath.Join(t.TempDir(), "locks"), Slots: 2}
+
+		for _, holder := range []string{"oak", "oak", "elm"} {
+			err := l.Acquire(ctx, holder)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		err := l.Acquire(ctx, "ash")
+		assert.Equal(t, errors.Is(err, lock.ErrLocked), true)
+
+		assert.Equal(t, l.Release(ctx, "oak"), nil)
+		assert.Equal(t, l.Release(ctx, "oak"), nil)
+		assert.Equal(t, l.Acquire(ctx, "ash"), nil)
+		assert.Equal(t, readSlot(t, l.Dir, "slot-0"), "ash")
+		assert.Equal(t, readSlot(t, l.Dir, "slot-1"), "elm")
+	})
+
+	t.Run("expired slots are taken", func(t *testing.T) {
+		clock := time.Now()
+		l := lock.FileLock{
+			Dir:   t.TempDir(),
+			Slots: 1,
+			TTL:   time.Hour,
+			Now:   func() time.Time { return clock.Add(2 * time.Hour) },
+		}
+
+		assert.Equal(t, l.Acquire(ctx, "oak"), nil)
+		assert.Equal(t, l.Acquire(ctx, "elm"), nil)
+		assert.Equal(t, readSlot(t, l.Dir, "slot-0"), "elm")
+	})
+
+	t.Run("expired slots are taken by one holder", func(t *testing.T) {
+		l := lock.FileLock{Dir: t.TempDir(), Slots: 1, TTL: time.Hour}
+		assert.Equal(t, l.Acquire(ctx, "oak"), nil)
+		expired := time.Now().Add(-2 * time.Hour)
+		assert.Equal(t, os.Chtimes(filepath.Join(l.Dir, "slot-0"), expired, expired), nil)
+
+		holders := []string{"elm", "ash", "fir", "yew", "box", "bay"}
+		errs := make(chan error, len(holders))
+		for _, holder := range holders {
+			go func() { errs <- l.Acquire(ctx, holder) }()
+		}
+		acquired := 0
+		for range holders {
+			err := <-errs
+			if err == nil {
+				acquired++
+			} else {
+				assert.Equal(t, errors.Is(err, lock.ErrLocked), true)
+			}
+		}
+		assert.Equal(t, acquired, 1)
+
+		entries, err := os.ReadDir(l.Dir)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, len(entries), 1)
+	})
+
+	t.Run("unexpired slots are kept", func(t *testing.T) {
+		l := lock.FileLock{Dir: t.TempDir(), Slots: 1, TTL: time.Hour}
+
+		assert.Equal(t, l.Acquire(ctx, "oak"), nil)
+		err := l.Acquire(ctx, "elm")
+		assert.Equal(t, errors.Is(err, lock.ErrLocked), true)
+		assert.Equal(t, readSlot(t, l.Dir, "slot-0"), "oak")
+	})
+}
@@ -0,0 +1,79 @@
+package lock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// HTTPLock is a Lock backed by a lease server, see Server.
+type HTTPLock struct {
+	// lease server url
+	URL string
+	// optional secret sent with requests, leases acquired with a token
+	// are only released with the same token
+	Token string
+	// optional, defaults to an empty http.Client
+	HTTPClient *http.Client
+}
+
+// leaseRequest is the body of acquire and release requests.
+type leaseRequest struct {
+	Holder string `json:"holder"`
+	Token  string `json:"token,omitempty"`
+}
+
+func (l HTTPLock) Acquire(ctx context.Context, holder string) error {
+	return l.post(ctx, "acquire", holder)
+}
+
+func (l HTTPLock) Release(ctx context.Context, holder string) error {
+	return l.post(ctx, "release", holder)
+}
+
+func (l HTTPLock) post(ctx context.Context, action, holder string) error {
+	httpClient := l.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLock, err)
+	}
+	requestUrl := u.JoinPath("v1", action).String()
+	body, err := json.Marshal(leaseRequest{Holder: holder, Token: l.Token})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLock, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, requestUrl, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLock, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLock, err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		var reason string
+		json.Unmarshal(respBody, &reason)
+		return fmt.Errorf("%w: %s", ErrLocked, reason)
+	case resp.StatusCode == http.StatusForbidden:
+		var reason string
+		json.Unmarshal(respBody, &reason)
+		return fmt.Errorf("%w: %s", ErrLock, reason)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("%w: %d %s", ErrLock, resp.StatusCode, requestUrl)
+	}
+	return nil
+}
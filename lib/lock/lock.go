@@ -0,0 +1,27 @@
+/*
+Package lock coordinates reboots across a fleet with a counting
+semaphore. Each host must hold one of a fixed number of slots while it
+reboots, and releases it once the rebooted system is verified.
+*/
+package lock
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrLocked is returned when every slot is held by another holder.
+	ErrLocked = errors.New("all reboot lock slots are held")
+	// ErrLock is returned when a lock backend fails.
+	ErrLock = errors.New("reboot lock failed")
+)
+
+// Lock is a counting semaphore shared by a fleet of hosts.
+type Lock interface {
+	// Acquire takes a slot for holder, returning ErrLocked if none are
+	// free. Acquiring a slot holder already holds succeeds.
+	Acquire(ctx context.Context, holder string) error
+	// Release frees holder's slot. Releasing an unheld slot succeeds.
+	Release(ctx context.Context, holder string) error
+}
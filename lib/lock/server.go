@@ -0,0 +1,189 @@
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// serverState is the lease server state file.
+const serverState = "leases.json"
+
+// Lease is a slot held by a holder.
+type Lease struct {
+	Holder string `json:"holder"`
+	// token the lease was acquired with, only requests with it may
+	// release the lease. Never listed.
+	Token    string    `json:"token,omitempty"`
+	Acquired time.Time `json:"acquired"`
+	// zero if the lease never expires
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+/*
+Server is a lease server, an http.Handler granting up to Slots leases.
+
+	POST /v1/acquire {"holder": "...", "token": "..."}  200, or 409 if every slot is held
+	POST /v1/release {"holder": "...", "token": "..."}  200, or 403 with another token
+	GET  /v1/leases                                     200, the held leases
+
+The server is unauthenticated. Leases acquired with a token may only be
+released with the same token, a secret each host keeps across reboots,
+but any client may acquire slots, so it should only be reachable by the
+fleet.
+*/
+type Server struct {
+	Slots int
+	// leases expire after this long, zero never expires them
+	TTL time.Duration
+	// optional, leases are persisted here to survive restarts
+	StateDir string
+
+	// the clock, defaults to time.Now
+	Now func() time.Time
+
+	mu     sync.Mutex
+	leases []Lease
+}
+
+// NewServer creates a lease server, loading leases from stateDir if
+// set.
+func NewServer(slots int, ttl time.Duration, stateDir string) (*Server, error) {
+	s := &Server{Slots: slots, TTL: ttl, StateDir: stateDir, Now: time.Now}
+	if stateDir != "" {
+		_, err := system.ReadState(stateDir, serverState, &s.leases)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrLock, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/acquire":
+		s.handle(w, r, s.acquire)
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/release":
+		s.handle(w, r, s.release)
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/leases":
+		s.mu.Lock()
+		s.expire()
+		leases := slices.Clone(s.leases)
+		s.mu.Unlock()
+		for i := range leases {
+			leases[i].Token = ""
+		}
+		writeJSON(w, http.StatusOK, leases)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handle decodes a lease request and applies action to it. Changes
+// that can't be persisted are rolled back.
+func (s *Server) handle(w http.ResponseWriter, r *http.Request, action func(req leaseRequest) (int, any)) {
+	var req leaseRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req)
+	if err != nil || req.Holder == "" {
+		http.Error(w, "holder required", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	previous := slices.Clone(s.leases)
+	status, body := action(req)
+	if s.StateDir != "" && status == http.StatusOK {
+		err = system.WriteState(s.StateDir, serverState, s.leases)
+		if err != nil {
+			s.leases = previous
+			slog.Error("Unable to persist leases.", slog.Any("err", err))
+			http.Error(w, "unable to persist leases", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, status, body)
+}
+
+func (s *Server) acquire(req leaseRequest) (int, any) {
+	holder := req.Holder
+	for _, lease := range s.leases {
+		if lease.Holder == holder {
+			if !lease.heldWith(req.Token) {
+				return forbidden(lease)
+			}
+			lease.Token = ""
+			return http.StatusOK, lease
+		}
+	}
+	if len(s.leases) >= s.Slots {
+		holders := make([]string, len(s.leases))
+		for i, lease := range s.leases {
+			holders[i] = lease.Holder
+		}
+		slog.Info("Lease denied.", slog.String("holder", holder), slog.Any("holders", holders))
+		return http.StatusConflict, fmt.Sprintf("%d slots held by %s", s.Slots, strings.Join(holders, ", "))
+	}
+
+	lease := Lease{Holder: holder, Token: req.Token, Acquired: s.Now()}
+	if s.TTL > 0 {
+		lease.Expires = lease.Acquired.Add(s.TTL)
+	}
+	s.leases = append(s.leases, lease)
+	slog.Info("Lease acquired.", slog.String("holder", holder))
+	lease.Token = ""
+	return http.StatusOK, lease
+}
+
+func (s *Server) release(req leaseRequest) (int, any) {
+	i := slices.IndexFunc(s.leases, func(lease Lease) bool {
+		return lease.Holder == req.Holder
+	})
+	if i < 0 {
+		return http.StatusOK, struct{}{}
+	}
+	if !s.leases[i].heldWith(req.Token) {
+		return forbidden(s.leases[i])
+	}
+	s.leases = slices.Delete(s.leases, i, i+1)
+	slog.Info("Lease released.", slog.String("holder", req.Holder))
+	return http.StatusOK, struct{}{}
+}
+
+// heldWith reports whether the lease was acquired with token. Leases
+// acquired without a token match any request.
+func (l Lease) heldWith(token string) bool {
+	return l.Token == "" || l.Token == token
+}
+
+// forbidden refuses a request for lease with a different token.
+func forbidden(lease Lease) (int, any) {
+	slog.Warn("Lease request with another token denied.", slog.String("holder", lease.Holder))
+	return http.StatusForbidden, fmt.Sprintf("%s is held with another token", lease.Holder)
+}
+
+// expire drops expired leases. s.mu must be held.
+func (s *Server) expire() {
+	now := s.Now()
+	s.leases = slices.DeleteFunc(s.leases, func(lease Lease) bool {
+		if lease.Expires.IsZero() || now.Before(lease.Expires) {
+			return false
+		}
+		slog.Info("Lease expired.", slog.String("holder", lease.Holder), slog.Time("acquired", lease.Acquired))
+		return true
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
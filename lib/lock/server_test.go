@@ -0,0 +1,140 @@
+package lock_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/lock"
+)
+
+func newLeaseServer(t *testing.T, slots int, ttl time.Duration, stateDir string) (*lock.Server, lock.HTTPLock) {
+	t.Helper()
+	s, err := lock.NewServer(slots, ttl, stateDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, lock.HTTPLock{URL: ts.URL, Token: "oak-token", HTTPClient: ts.Client()}
+}
+
+func TestHTTPLock(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("grants up to Slots holders", func(t *testing.T) {
+		_, l := newLeaseServer(t, 1, 0, "")
+
+		assert.Equal(t, l.Acquire(ctx, "oak"), nil)
+		assert.Equal(t, l.Acquire(ctx, "oak"), nil)
+
+		err := l.Acquire(ctx, "elm")
+		assert.Equal(t, errors.Is(err, lock.ErrLocked), true)
+		assert.Equal(t, err.Error(), "all reboot lock slots are held: 1 slots held by oak")
+
+		assert.Equal(t, l.Release(ctx, "oak"), nil)
+		assert.Equal(t, l.Acquire(ctx, "elm"), nil)
+	})
+
+	t.Run("server errors are not ErrLocked", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer ts.Close()
+
+		err := lock.HTTPLock{URL: ts.URL}.Acquire(ctx, "oak")
+		assert.Equal(t, errors.Is(err, lock.ErrLock), true)
+		assert.Equal(t, errors.Is(err, lock.ErrLocked), false)
+	})
+
+	t.Run("leases expire after TTL", func(t *testing.T) {
+		s, l := newLeaseServer(t, 1, time.Hour, "")
+		clock := time.Now()
+		s.Now = func() time.Time { return clock }
+
+		assert.Equal(t, l.Acquire(ctx, "oak"), nil)
+		err := l.Acquire(ctx, "elm")
+		assert.Equal(t, errors.Is(err, lock.ErrLocked), true)
+
+		clock = clock.Add(2 * time.Hour)
+		assert.Equal(t, l.Acquire(ctx, "elm"), nil)
+
+		resp, err := l.HTTPClient.Get(l.URL + "/v1/leases")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		var leases []lock.Lease
+		assert.Equal(t, json.NewDecoder(resp.Body).Decode(&leases), nil)
+		assert.Equal(t, len(leases), 1)
+		assert.Equal(t, leases[0].Holder, "elm")
+		assert.Equal(t, leases[0].Expires.Equal(clock.Add(time.Hour)), true)
+	})
+
+	t.Run("leases survive restarts", func(t *testing.T) {
+		stateDir := t.TempDir()
+		_, l := newLeaseServer(t, 1, 0, stateDir)
+		assert.Equal(t, l.Acquire(ctx, "oak"), nil)
+
+		_, restarted := newLeaseServer(t, 1, 0, stateDir)
+		err := restarted.Acquire(ctx, "elm")
+		assert.Equal(t, errors.Is(err, lock.ErrLocked), true)
+		assert.Equal(t, restarted.Release(ctx, "oak"), nil)
+		assert.Equal(t, restarted.Acquire(ctx, "elm"), nil)
+	})
+
+	t.Run("leases that can't be persisted are rolled back", func(t *testing.T) {
+		stateDir := filepath.Join(t.TempDir(), "state")
+		_, l := newLeaseServer(t, 1, 0, stateDir)
+		assert.Equal(t, os.WriteFile(stateDir, nil, 0644), nil)
+
+		err := l.Acquire(ctx, "oak")
+		assert.Equal(t, errors.Is(err, lock.ErrLock), true)
+
+		assert.Equal(t, os.Remove(stateDir), nil)
+		assert.Equal(t, l.Acquire(ctx, "elm"), nil)
+	})
+
+	t.Run("leases are only released with the token they were acquired with", func(t *testing.T) {
+		s, l := newLeaseServer(t, 1, 0, "")
+		assert.Equal(t, l.Acquire(ctx, "oak"), nil)
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/release", strings.NewReader(`{"holder":"oak"}`)))
+		assert.Equal(t, w.Code, http.StatusForbidden)
+		other := l
+		other.Token = "elm-token"
+		assert.Equal(t, errors.Is(other.Release(ctx, "oak"), lock.ErrLock), true)
+
+		err := l.Acquire(ctx, "elm")
+		assert.Equal(t, errors.Is(err, lock.ErrLocked), true)
+		// from any address
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/release", strings.NewReader(`{"holder":"oak","token":"oak-token"}`)))
+		assert.Equal(t, w.Code, http.StatusOK)
+		assert.Equal(t, l.Acquire(ctx, "elm"), nil)
+	})
+
+	t.Run("tokens aren't listed", func(t *testing.T) {
+		_, l := newLeaseServer(t, 1, 0, "")
+		assert.Equal(t, l.Acquire(ctx, "oak"), nil)
+
+		resp, err := l.HTTPClient.Get(l.URL + "/v1/leases")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		var leases []lock.Lease
+		assert.Equal(t, json.NewDecoder(resp.Body).Decode(&leases), nil)
+		assert.Equal(t, len(leases), 1)
+		assert.Equal(t, leases[0].Token, "")
+	})
+}
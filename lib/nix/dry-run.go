@@ -0,0 +1,60 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// DryRunReport lists what realising an installable would do.
+type DryRunReport struct {
+	// derivations that would be built locally
+	Build []string
+	// store paths that would be substituted
+	Fetch []string
+}
+
+// NixDryRun performs a `nix build --dry-run` of the provided
+// installable without building or fetching anything.
+func NixDryRun(runner Runner, installable string, args []string) (DryRunReport, error) {
+	fullArgs := append([]string{"build", installable, "--dry-run", "--no-link"}, args...)
+
+	var stderr bytes.Buffer
+	err := runner.Run(Command{Name: "nix", Args: fullArgs, Stderr: &stderr})
+	if err != nil {
+		return DryRunReport{}, fmt.Errorf("%w: %s: %w: %s", ErrBuildFailed, installable, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return parseDryRun(stderr.String()), nil
+}
+
+// parseDryRun parses the human readable dry run summary nix prints to
+// stderr, e.g.:
+//
+//	these 2 derivations will be built:
+//	  /nix/store/...-a.drv
+//	  /nix/store/...-b.drv
+//	this path will be fetched (0.01 MiB download, 0.05 MiB unpacked):
+//	  /nix/store/...-c
+func parseDryRun(output string) DryRunReport {
+	var report DryRunReport
+	var section *[]string
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.Contains(line, "will be built"):
+			section = &report.Build
+		case strings.Contains(line, "will be fetched"):
+			section = &report.Fetch
+		case section != nil && strings.HasPrefix(line, " ") && strings.HasPrefix(trimmed, "/"):
+			*section = append(*section, trimmed)
+		default:
+			section = nil
+		}
+	}
+	return report
+}
@@ -0,0 +1,41 @@
+package nix
+
+import (
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+)
+
+func TestParseDryRun(t *testing.T) {
+	t.Run("parses derivations to build and paths to fetch", func(t *testing.T) {
+		report := parseDryRun(`these 2 derivations will be built:
+  /nix/store/aaaa-etc.drv
+  /nix/store/bbbb-nixos-system-oak.drv
+this path will be fetched (0.01 MiB download, 0.05 MiB unpacked):
+  /nix/store/cccc-hello-2.12
+`)
+
+		assert.ArrayEqual(t, report.Build, []string{"/nix/store/aaaa-etc.drv", "/nix/store/bbbb-nixos-system-oak.drv"})
+		assert.ArrayEqual(t, report.Fetch, []string{"/nix/store/cccc-hello-2.12"})
+	})
+
+	t.Run("ignores unrelated output", func(t *testing.T) {
+		report := parseDryRun(`warning: Git tree '/etc/nixos' is dirty
+these 3 paths will be fetched (1.00 MiB download, 4.00 MiB unpacked):
+  /nix/store/aaaa-a
+  /nix/store/bbbb-b
+  /nix/store/cccc-c
+warning: ignoring untrusted substituter
+`)
+
+		assert.Equal(t, len(report.Build), 0)
+		assert.Equal(t, len(report.Fetch), 3)
+	})
+
+	t.Run("empty output has nothing to do", func(t *testing.T) {
+		report := parseDryRun("")
+
+		assert.Equal(t, len(report.Build), 0)
+		assert.Equal(t, len(report.Fetch), 0)
+	})
+}
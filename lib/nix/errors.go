@@ -0,0 +1,24 @@
+package nix
+
+import "errors"
+
+var (
+	// ErrInvalidFlakeSpec is returned when a flake spec isn't in `<repo>#<host>` form.
+	ErrInvalidFlakeSpec = errors.New("invalid flake spec")
+	// ErrMetadataFailed is returned when `nix flake metadata` fails.
+	ErrMetadataFailed = errors.New("nix flake metadata failed")
+	// ErrBuildFailed is returned when `nix build` fails.
+	ErrBuildFailed = errors.New("nix build failed")
+	// ErrActivationFailed is returned when switch-to-configuration is missing or fails.
+	ErrActivationFailed = errors.New("switch-to-configuration failed")
+	// ErrWouldBuild is returned when substitute only realisation would build locally.
+	ErrWouldBuild = errors.New("derivations would be built locally")
+	// ErrOutputMismatch is returned when a local build differs from the expected store path.
+	ErrOutputMismatch = errors.New("build output mismatch")
+	// ErrRollbackFailed is returned when a profile can't be rolled back.
+	ErrRollbackFailed = errors.New("profile rollback failed")
+	// ErrQueryFailed is returned when a store path or profile query fails.
+	ErrQueryFailed = errors.New("nix query failed")
+	// ErrDecode is returned when nix command output isn't the expected JSON.
+	ErrDecode = errors.New("nix output decode failed")
+)
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"os/exec"
 )
 
 type FlakeMetadata struct {
@@ -14,20 +13,19 @@ type FlakeMetadata struct {
 	OriginalUrl string `json:"originalUrl"`
 }
 
-func GetFlakeMetadata(flake string) FlakeMetadata {
-	cmd := exec.Command("nix", "flake", "metadata", flake, "--json")
+func GetFlakeMetadata(runner Runner, flake string) (FlakeMetadata, error) {
+	var metadata FlakeMetadata
 
-	output, err := cmd.Output()
+	out, err := output(runner, "nix", "flake", "metadata", flake, "--json")
 	if err != nil {
-		panic(err)
+		return metadata, fmt.Errorf("%w: %s: %w", ErrMetadataFailed, flake, err)
 	}
 
-	var metadata FlakeMetadata
-	err = json.Unmarshal(output, &metadata)
+	err = json.Unmarshal(out, &metadata)
 	if err != nil {
-		panic(err)
+		return metadata, fmt.Errorf("%w: %w", ErrDecode, err)
 	}
 
 	slog.Debug(fmt.Sprintf("%+v", metadata))
-	return metadata
+	return metadata, nil
 }
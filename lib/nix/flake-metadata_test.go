@@ -0,0 +1,42 @@
+package nix_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix/nixtest"
+)
+
+func TestGetFlakeMetadata(t *testing.T) {
+	t.Run("decodes flake metadata", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix flake metadata self --json", nixtest.Result{Stdout: `{"lastModified":1700000000,"originalUrl":"github:hyperparabolic/nix-config"}`})
+
+		metadata, err := nix.GetFlakeMetadata(runner, "self")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, metadata.LastModified, int64(1700000000))
+		assert.Equal(t, metadata.OriginalUrl, "github:hyperparabolic/nix-config")
+	})
+
+	t.Run("errors if nix flake metadata fails", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix flake metadata", nixtest.Result{ExitCode: 1})
+
+		_, err := nix.GetFlakeMetadata(runner, "self")
+
+		assert.Equal(t, errors.Is(err, nix.ErrMetadataFailed), true)
+	})
+
+	t.Run("errors on malformed output", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix flake metadata", nixtest.Result{Stdout: `{"lastModified":`})
+
+		_, err := nix.GetFlakeMetadata(runner, "self")
+
+		assert.Equal(t, errors.Is(err, nix.ErrDecode), true)
+	})
+}
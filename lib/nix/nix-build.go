@@ -1,74 +1,106 @@
 package nix
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
 )
 
-type BuildResult []struct {
+// BuildResult is an entry of `nix build --json` output. Derivations
+// report their outputs, while opaque store paths report their path,
+// either as {"path": ...} or as a bare string in newer nix versions.
+type BuildResult struct {
+	Path    string `json:"path"`
 	Outputs struct {
 		Out string `json:"out"`
 	} `json:"outputs"`
 }
 
+func (r *BuildResult) UnmarshalJSON(data []byte) error {
+	var path string
+	if json.Unmarshal(data, &path) == nil {
+		r.Path = path
+		return nil
+	}
+	type plain BuildResult
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// StorePath returns the built store path, "" if nix didn't report one.
+func (r BuildResult) StorePath() string {
+	if r.Outputs.Out != "" {
+		return r.Outputs.Out
+	}
+	return r.Path
+}
+
 // NixBuild performs a `nix build` of the provided toplevel derivation
 //
 // returns:
 // result is the nix store directory containing the nix build result
-func NixBuild(toplevel string, args []string) (result string) {
+func NixBuild(runner Runner, toplevel string, args []string) (result string, err error) {
 	fullArgs := append([]string{"build", toplevel, "--no-link", "--json"}, args...)
 
-	cmd := exec.Command("nix", fullArgs...)
-	cmd.Stderr = os.Stderr
-
-	out, err := cmd.Output()
+	var stdout bytes.Buffer
+	err = runner.Run(Command{Name: "nix", Args: fullArgs, Stdout: &stdout, Stderr: os.Stderr})
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("%w: %s: %w", ErrBuildFailed, toplevel, err)
 	}
 
-	var results BuildResult
-	err = json.Unmarshal(out, &results)
+	var results []BuildResult
+	err = json.Unmarshal(stdout.Bytes(), &results)
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	if len(results) == 0 {
+		return "", fmt.Errorf("%w: no build results for %s", ErrDecode, toplevel)
+	}
+	result = results[0].StorePath()
+	if result == "" {
+		return "", fmt.Errorf("%w: no store path in build results for %s", ErrDecode, toplevel)
 	}
-	result = results[0].Outputs.Out
 
 	return
 }
 
+// Realise substitutes an existing store path, such as a hydra build
+// output, from the configured binary caches. No nix expressions are
+// evaluated.
+//
+// returns:
+// result is the realised store path
+func Realise(runner Runner, storePath string, args []string) (result string, err error) {
+	return NixBuild(runner, storePath, args)
+}
+
 // SwitchToConfiguration calls a toplevel derivation's switch-to-configuration
-// binary with the provided operation
-func SwitchToConfiguration(result string, operation string) {
+// binary with the provided operation. A missing binary fails to start
+// and is reported as ErrActivationFailed.
+func SwitchToConfiguration(runner Runner, result string, operation string) error {
 	switchBin := fmt.Sprintf("%s/bin/switch-to-configuration", result)
 
-	// ensure switch script exists
-	_, err := os.Stat(switchBin)
-	if err != nil {
-		panic(err)
-	}
-
-	cmd := exec.Command(switchBin, operation)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err = cmd.Run()
+	err := runner.Run(Command{
+		Name:   switchBin,
+		Args:   []string{operation},
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("%w: %s %s: %w", ErrActivationFailed, switchBin, operation, err)
 	}
+	return nil
 }
 
 // FlakeToToplevel transforms a flake spec suitable for `nixos-rebuild`
 // to an equivalent toplevel derivation to build with `nix build`.
-func FlakeToToplevel(flake string) (toplevel string) {
+func FlakeToToplevel(flake string) (toplevel string, err error) {
 	var s = strings.Split(flake, "#")
 
 	// shouldn't really happen, but will save me a headache if it somehow does
 	if len(s) != 2 {
-		// no reasonable recovery
-		panic("bad flake spec")
+		return "", fmt.Errorf("%w: %s", ErrInvalidFlakeSpec, flake)
 	}
 	var repo = s[0]
 	var host = s[1]
@@ -76,3 +108,18 @@ func FlakeToToplevel(flake string) (toplevel string) {
 	toplevel = fmt.Sprintf("%s#nixosConfigurations.%s.config.system.build.toplevel", repo, host)
 	return
 }
+
+// Rollback switches a profile to its previous generation. The profile's
+// switch-to-configuration binary then activates that generation.
+func Rollback(runner Runner, profile string) error {
+	err := runner.Run(Command{
+		Name:   "nix-env",
+		Args:   []string{"--profile", profile, "--rollback"},
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrRollbackFailed, profile, err)
+	}
+	return nil
+}
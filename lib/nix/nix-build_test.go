@@ -1,36 +1,135 @@
 package nix_test
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
 	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix/nixtest"
 )
 
 func TestFlakeToToplevel(t *testing.T) {
 	t.Run("transforms expected flake spec format", func(t *testing.T) {
 		var valid = "github:hyperparabolic/nix-config/c717fb0df0c30ead2f33ab2eecf4640f57fb5517?narHash=sha256-IHF5vCw4NLqRDdsNPInm3Xfs06MS37ZkLaUcNl74J40%3D#oak"
-		var toplevel = nix.FlakeToToplevel(valid)
+		toplevel, err := nix.FlakeToToplevel(valid)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
 		assert.Equal(t, toplevel, "github:hyperparabolic/nix-config/c717fb0df0c30ead2f33ab2eecf4640f57fb5517?narHash=sha256-IHF5vCw4NLqRDdsNPInm3Xfs06MS37ZkLaUcNl74J40%3D#nixosConfigurations.oak.config.system.build.toplevel")
 	})
 
-	t.Run("panics if unexpected number of # delimiters 0", func(t *testing.T) {
+	t.Run("errors if unexpected number of # delimiters 0", func(t *testing.T) {
 		var no_delimiters = "repohost"
 
-		defer func() { _ = recover() }()
+		_, err := nix.FlakeToToplevel(no_delimiters)
 
-		nix.FlakeToToplevel(no_delimiters)
-
-		t.Errorf("should panic")
+		assert.Equal(t, errors.Is(err, nix.ErrInvalidFlakeSpec), true)
 	})
 
-	t.Run("panics if unexpected number of # delimiters 2", func(t *testing.T) {
+	t.Run("errors if unexpected number of # delimiters 2", func(t *testing.T) {
 		var too_many_delimiters = "repo#host#????"
 
-		defer func() { _ = recover() }()
+		_, err := nix.FlakeToToplevel(too_many_delimiters)
+
+		assert.Equal(t, errors.Is(err, nix.ErrInvalidFlakeSpec), true)
+	})
+}
+
+func TestNixBuild(t *testing.T) {
+	t.Run("returns the build output path", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix build", nixtest.Result{Stdout: `[{"drvPath":"/nix/store/aaaa-nixos-system-oak.drv","outputs":{"out":"/nix/store/bbbb-nixos-system-oak"}}]`})
+
+		result, err := nix.NixBuild(runner, "/nix/store/bbbb-nixos-system-oak", []string{"--max-jobs", "0"})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, result, "/nix/store/bbbb-nixos-system-oak")
+		assert.ArrayEqual(t, runner.Commands(), []string{"nix build /nix/store/bbbb-nixos-system-oak --no-link --json --max-jobs 0"})
+	})
+
+	t.Run("returns realised store paths", func(t *testing.T) {
+		for _, stdout := range []string{
+			`[{"path":"/nix/store/bbbb-nixos-system-oak"}]`,
+			`["/nix/store/bbbb-nixos-system-oak"]`,
+		} {
+			runner := nixtest.NewRunner()
+			runner.Handle("nix build", nixtest.Result{Stdout: stdout})
+
+			result, err := nix.Realise(runner, "/nix/store/bbbb-nixos-system-oak", nil)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			assert.Equal(t, result, "/nix/store/bbbb-nixos-system-oak")
+		}
+	})
+
+	t.Run("errors without a store path", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix build", nixtest.Result{Stdout: `[{"outputs":{}}]`})
+
+		_, err := nix.Realise(runner, "/nix/store/bbbb-nixos-system-oak", nil)
+
+		assert.Equal(t, errors.Is(err, nix.ErrDecode), true)
+	})
+
+	t.Run("errors if nix build fails", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix build", nixtest.Result{Stderr: "error: build failed", ExitCode: 1})
+
+		_, err := nix.NixBuild(runner, "/nix/store/bbbb-nixos-system-oak", nil)
+
+		assert.Equal(t, errors.Is(err, nix.ErrBuildFailed), true)
+	})
+
+	t.Run("errors without build results", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix build", nixtest.Result{Stdout: `[]`})
+
+		_, err := nix.NixBuild(runner, "/nix/store/bbbb-nixos-system-oak", nil)
+
+		assert.Equal(t, errors.Is(err, nix.ErrDecode), true)
+	})
+}
+
+func TestSwitchToConfiguration(t *testing.T) {
+	t.Run("runs the operation", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("/nix/store/bbbb-nixos-system-oak/bin/switch-to-configuration")
+
+		err := nix.SwitchToConfiguration(runner, "/nix/store/bbbb-nixos-system-oak", "boot")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, runner.Commands(), []string{"/nix/store/bbbb-nixos-system-oak/bin/switch-to-configuration boot"})
+	})
+
+	t.Run("errors if switch-to-configuration is missing", func(t *testing.T) {
+		err := nix.SwitchToConfiguration(nixtest.NewRunner(), "/nix/store/bbbb-nixos-system-oak", "boot")
+
+		assert.Equal(t, errors.Is(err, nix.ErrActivationFailed), true)
+	})
+}
+
+func TestRollback(t *testing.T) {
+	t.Run("rolls back the profile", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix-env")
+
+		err := nix.Rollback(runner, "/nix/var/nix/profiles/system")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, runner.Commands(), []string{"nix-env --profile /nix/var/nix/profiles/system --rollback"})
+	})
+
+	t.Run("errors without a previous generation", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix-env", nixtest.Result{Stderr: "error: no generation older than the current (1) exists", ExitCode: 1})
 
-		nix.FlakeToToplevel(too_many_delimiters)
+		err := nix.Rollback(runner, "/nix/var/nix/profiles/system")
 
-		t.Errorf("should panic")
+		assert.Equal(t, errors.Is(err, nix.ErrRollbackFailed), true)
 	})
 }
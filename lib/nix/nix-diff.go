@@ -3,7 +3,6 @@ package nix
 import (
 	"log/slog"
 	"os"
-	"os/exec"
 )
 
 // NixDiff outputs a `dix` diff between toplevel derivations to stdout.
@@ -11,13 +10,14 @@ import (
 // The output of this tool is really only intended for human reading.
 // No affect on the running program, just pipes program output to
 // stdout unformatted for observability breadcrumbs.
-func NixDiff(old_derivation string, new_derivation string) {
+func NixDiff(runner Runner, old_derivation string, new_derivation string) {
 	slog.Info("dix diff:")
-	cmd := exec.Command("dix", old_derivation, new_derivation)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err := cmd.Run()
+	err := runner.Run(Command{
+		Name:   "dix",
+		Args:   []string{old_derivation, new_derivation},
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
 	if err != nil {
 		slog.Info("unexpected diff error", slog.Any("err", err))
 	}
@@ -0,0 +1,108 @@
+/*
+Package nixtest provides a fake nix.Runner that returns canned output
+and exit codes, and records the commands it was asked to run.
+*/
+package nixtest
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix"
+)
+
+// Result is the canned outcome of a command.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// ExitError is returned for results with a non-zero ExitCode.
+type ExitError struct {
+	Command  string
+	ExitCode int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s: exit status %d", e.Command, e.ExitCode)
+}
+
+type handler struct {
+	prefix  string
+	results []Result
+}
+
+// Runner is a fake nix.Runner. Commands are matched against handlers
+// by command line prefix, in the order handlers were added. Commands
+// without a handler fail with exit code 127, like a missing binary.
+type Runner struct {
+	mu       sync.Mutex
+	handlers []*handler
+	commands []string
+}
+
+// NewRunner returns a Runner without any handlers.
+func NewRunner() *Runner {
+	return &Runner{}
+}
+
+// Handle responds to commands whose command line starts with prefix,
+// e.g. "nix flake metadata self". Results are returned in order, and
+// the last result repeats.
+func (r *Runner) Handle(prefix string, results ...Result) {
+	if len(results) == 0 {
+		results = []Result{{}}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers = append(r.handlers, &handler{prefix: prefix, results: results})
+}
+
+// Commands returns the command lines run so far, in order.
+func (r *Runner) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.commands...)
+}
+
+// Ran reports whether any command line run so far starts with prefix.
+func (r *Runner) Ran(prefix string) bool {
+	for _, c := range r.Commands() {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Runner) Run(cmd nix.Command) error {
+	line := cmd.String()
+
+	r.mu.Lock()
+	r.commands = append(r.commands, line)
+	result := Result{Stderr: fmt.Sprintf("%s: command not found\n", cmd.Name), ExitCode: 127}
+	for _, h := range r.handlers {
+		if strings.HasPrefix(line, h.prefix) {
+			result = h.results[0]
+			if len(h.results) > 1 {
+				h.results = h.results[1:]
+			}
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if cmd.Stdout != nil {
+		io.WriteString(cmd.Stdout, result.Stdout)
+	}
+	if cmd.Stderr != nil {
+		io.WriteString(cmd.Stderr, result.Stderr)
+	}
+	if result.ExitCode != 0 {
+		return &ExitError{Command: line, ExitCode: result.ExitCode}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CurrentGeneration returns the current generation number of a
+// profile.
+func CurrentGeneration(runner Runner, profile string) (int, error) {
+	out, err := output(runner, "nix-env", "--profile", profile, "--list-generations")
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %w", ErrQueryFailed, profile, err)
+	}
+
+	// e.g. "  42   2024-05-02 04:40:12   (current)"
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[len(fields)-1] != "(current)" {
+			continue
+		}
+		generation, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s generation %q: %w", ErrDecode, profile, fields[0], err)
+		}
+		return generation, nil
+	}
+	return 0, fmt.Errorf("%w: %s has no current generation", ErrDecode, profile)
+}
+
+// GenerationLink returns the path of a profile generation, e.g.
+// /nix/var/nix/profiles/system-42-link.
+func GenerationLink(profile string, generation int) string {
+	return fmt.Sprintf("%s-%d-link", profile, generation)
+}
+
+// SwitchGeneration makes generation the current generation of a
+// profile.
+func SwitchGeneration(runner Runner, profile string, generation int) error {
+	err := runner.Run(Command{
+		Name:   "nix-env",
+		Args:   []string{"--profile", profile, "--switch-generation", strconv.Itoa(generation)},
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %s generation %d: %w", ErrRollbackFailed, profile, generation, err)
+	}
+	return nil
+}
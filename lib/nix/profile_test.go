@@ -0,0 +1,60 @@
+package nix_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/nix/nixtest"
+)
+
+func TestCurrentGeneration(t *testing.T) {
+	t.Run("finds the current generation", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix-env --profile /nix/var/nix/profiles/system --list-generations", nixtest.Result{Stdout: `  41   2024-05-01 04:40:12
+  42   2024-05-02 04:40:12   (current)
+  43   2024-05-03 04:40:12
+`})
+
+		generation, err := nix.CurrentGeneration(runner, "/nix/var/nix/profiles/system")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, generation, 42)
+	})
+
+	t.Run("errors without a current generation", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix-env", nixtest.Result{Stdout: ""})
+
+		_, err := nix.CurrentGeneration(runner, "/nix/var/nix/profiles/system")
+
+		assert.Equal(t, errors.Is(err, nix.ErrDecode), true)
+	})
+
+	t.Run("errors if nix-env fails", func(t *testing.T) {
+		_, err := nix.CurrentGeneration(nixtest.NewRunner(), "/nix/var/nix/profiles/system")
+
+		assert.Equal(t, errors.Is(err, nix.ErrQueryFailed), true)
+	})
+}
+
+func TestSwitchGeneration(t *testing.T) {
+	t.Run("switches the profile generation", func(t *testing.T) {
+		runner := nixtest.NewRunner()
+		runner.Handle("nix-env")
+
+		err := nix.SwitchGeneration(runner, "/nix/var/nix/profiles/system", 41)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, runner.Commands(), []string{"nix-env --profile /nix/var/nix/profiles/system --switch-generation 41"})
+	})
+
+	t.Run("errors if nix-env fails", func(t *testing.T) {
+		err := nix.SwitchGeneration(nixtest.NewRunner(), "/nix/var/nix/profiles/system", 41)
+
+		assert.Equal(t, errors.Is(err, nix.ErrRollbackFailed), true)
+	})
+}
@@ -0,0 +1,47 @@
+package nix
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Command is a process for a Runner to execute.
+type Command struct {
+	Name string
+	Args []string
+	// optional, output is discarded when nil
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// String returns the space separated command line.
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Runner executes the commands nix functions shell out to. ExecRunner
+// runs real processes, nixtest.Runner fakes them for tests.
+type Runner interface {
+	// Run executes cmd, returning an error if it can't be started or
+	// exits non-zero.
+	Run(cmd Command) error
+}
+
+// ExecRunner runs commands with os/exec.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(c Command) error {
+	cmd := exec.Command(c.Name, c.Args...)
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
+	return cmd.Run()
+}
+
+// output runs a command, returning its stdout.
+func output(runner Runner, name string, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	err := runner.Run(Command{Name: name, Args: args, Stdout: &stdout})
+	return stdout.Bytes(), err
+}
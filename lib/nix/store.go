@@ -0,0 +1,16 @@
+package nix
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Deriver returns the derivation that produced a store path. Paths
+// substituted without deriver information return "unknown-deriver".
+func Deriver(runner Runner, storePath string) (string, error) {
+	out, err := output(runner, "nix-store", "--query", "--deriver", storePath)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %w", ErrQueryFailed, storePath, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,42 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// ErrBootloader is returned when the boot loader's entries can't be
+// changed.
+var ErrBootloader = errors.New("boot loader update failed")
+
+// SystemdBootEntry returns the systemd-boot entry id of a NixOS system
+// profile generation.
+func SystemdBootEntry(generation int) string {
+	return fmt.Sprintf("nixos-generation-%d.conf", generation)
+}
+
+// ClearDefaultBootEntry removes any default entry set with bootctl, so
+// the default entry in loader.conf applies again.
+func ClearDefaultBootEntry() error {
+	return bootctl("set-default", "")
+}
+
+// SetOneShotBootEntry boots a systemd-boot entry on the next boot only.
+// Later boots use the default entry again.
+func SetOneShotBootEntry(entry string) error {
+	return bootctl("set-oneshot", entry)
+}
+
+func bootctl(args ...string) error {
+	cmd := exec.Command("bootctl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%w: bootctl %v: %w", ErrBootloader, args, err)
+	}
+	return nil
+}
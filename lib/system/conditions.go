@@ -0,0 +1,214 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrCondition is returned when the state of the system can't be
+// determined.
+var ErrCondition = errors.New("system condition unavailable")
+
+// PowerSupplyDir is where the kernel lists power supplies.
+const PowerSupplyDir = "/sys/class/power_supply"
+
+// LoadAvgFile is where the kernel reports load averages.
+const LoadAvgFile = "/proc/loadavg"
+
+// readAttr reads a sysfs attribute, without its trailing newline.
+func readAttr(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// OnACPower reports whether the system runs on mains power, with power
+// supplies listed in dir, usually PowerSupplyDir. Systems without a
+// battery are always on mains power.
+func OnACPower(dir string) (bool, error) {
+	supplies, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrCondition, err)
+	}
+
+	battery := false
+	for _, s := range supplies {
+		kind, err := readAttr(filepath.Join(dir, s.Name(), "type"))
+		if err != nil {
+			return false, fmt.Errorf("%w: %w", ErrCondition, err)
+		}
+		switch kind {
+		case "Mains":
+			online, err := readAttr(filepath.Join(dir, s.Name(), "online"))
+			if err != nil {
+				return false, fmt.Errorf("%w: %w", ErrCondition, err)
+			}
+			if online == "1" {
+				return true, nil
+			}
+		case "Battery":
+			// peripherals like mice report their batteries too
+			scope, _ := readAttr(filepath.Join(dir, s.Name(), "scope"))
+			if scope != "Device" {
+				battery = true
+			}
+		}
+	}
+	return !battery, nil
+}
+
+// LoadAverage returns the 1 minute load average from path, usually
+// LoadAvgFile.
+func LoadAverage(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrCondition, err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("%w: %s: empty", ErrCondition, path)
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %w", ErrCondition, path, err)
+	}
+	return load, nil
+}
+
+// Session is a logind session.
+type Session struct {
+	ID      string
+	User    string
+	Type    string
+	Class   string
+	Service string
+	State   string
+	Remote  bool
+}
+
+// Interactive reports whether someone is using the session, either a
+// graphical session or a remote login like ssh. Sessions that are
+// closing, e.g. lingering processes after logout, aren't.
+func (s Session) Interactive() bool {
+	if s.Class != "user" || s.State == "closing" {
+		return false
+	}
+	switch s.Type {
+	case "x11", "wayland", "mir":
+		return true
+	}
+	return s.Remote || s.Service == "sshd"
+}
+
+// loginctl runs loginctl, returning its stdout.
+func loginctl(ctx context.Context, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "loginctl", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%w: loginctl: %w: %s", ErrCondition, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Sessions returns the sessions logind tracks.
+func Sessions(ctx context.Context) ([]Session, error) {
+	out, err := loginctl(ctx, "list-sessions", "--no-legend", "--no-pager")
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []Session{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		props, err := loginctl(ctx, "show-session", fields[0], "--no-pager",
+			"--property=Name", "--property=Type", "--property=Class",
+			"--property=Service", "--property=State", "--property=Remote")
+		if err != nil {
+			return nil, err
+		}
+		s := Session{ID: fields[0]}
+		for line := range strings.Lines(string(props)) {
+			key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+			switch key {
+			case "Name":
+				s.User = value
+			case "Type":
+				s.Type = value
+			case "Class":
+				s.Class = value
+			case "Service":
+				s.Service = value
+			case "State":
+				s.State = value
+			case "Remote":
+				s.Remote = value == "yes"
+			}
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// busctl errors meaning NetworkManager isn't on the bus. busctl prints
+// D-Bus error messages, which only sometimes include the error name.
+var busServiceMissing = []string{
+	"org.freedesktop.DBus.Error.ServiceUnknown",
+	"org.freedesktop.DBus.Error.NameHasNoOwner",
+	"was not provided by any .service files",
+	"not activatable",
+	"has no owner",
+	"Unit dbus-org.freedesktop.NetworkManager.service not found",
+}
+
+// Metered reports whether NetworkManager considers the network
+// connection metered, including its guesses. Without NetworkManager
+// the connection is assumed unmetered. Other busctl failures are
+// errors.
+func Metered(ctx context.Context) (bool, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "busctl", "--system", "get-property",
+		"org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager",
+		"org.freedesktop.NetworkManager", "Metered")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		for _, missing := range busServiceMissing {
+			if strings.Contains(stderr.String(), missing) {
+				return false, nil
+			}
+		}
+		return false, fmt.Errorf("%w: busctl: %w: %s", ErrCondition, err, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: busctl: %w", ErrCondition, err)
+	}
+
+	// "u 1", NMMetered: 0 unknown, 1 yes, 2 no, 3 guess yes, 4 guess no
+	fields := strings.Fields(stdout.String())
+	if len(fields) != 2 {
+		return false, fmt.Errorf("%w: busctl: unexpected output %q", ErrCondition, stdout.String())
+	}
+	return fields[1] == "1" || fields[1] == "3", nil
+}
@@ -0,0 +1,202 @@
+package system_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// powerSupply adds a power supply with sysfs attrs to dir.
+func powerSupply(t *testing.T, dir, name string, attrs map[string]string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Join(dir, name), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attr, value := range attrs {
+		err = os.WriteFile(filepath.Join(dir, name, attr), []byte(value+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOnACPower(t *testing.T) {
+	t.Run("systems without power supplies are on mains power", func(t *testing.T) {
+		ac, err := system.OnACPower(filepath.Join(t.TempDir(), "missing"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, ac, true)
+	})
+
+	t.Run("online mains supplies are on mains power", func(t *testing.T) {
+		dir := t.TempDir()
+		powerSupply(t, dir, "AC", map[string]string{"type": "Mains", "online": "1"})
+		powerSupply(t, dir, "BAT0", map[string]string{"type": "Battery"})
+
+		ac, err := system.OnACPower(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, ac, true)
+	})
+
+	t.Run("batteries without online mains supplies are on battery", func(t *testing.T) {
+		dir := t.TempDir()
+		powerSupply(t, dir, "AC", map[string]string{"type": "Mains", "online": "0"})
+		powerSupply(t, dir, "BAT0", map[string]string{"type": "Battery"})
+
+		ac, err := system.OnACPower(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, ac, false)
+	})
+
+	t.Run("device batteries are ignored", func(t *testing.T) {
+		dir := t.TempDir()
+		powerSupply(t, dir, "hidpp_battery_0", map[string]string{"type": "Battery", "scope": "Device"})
+
+		ac, err := system.OnACPower(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, ac, true)
+	})
+}
+
+func TestLoadAverage(t *testing.T) {
+	t.Run("reads the 1 minute load average", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "loadavg")
+		err := os.WriteFile(path, []byte("2.50 1.75 0.90 3/412 12345\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		load, err := system.LoadAverage(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, load, 2.5)
+	})
+
+	t.Run("missing files fail", func(t *testing.T) {
+		_, err := system.LoadAverage(filepath.Join(t.TempDir(), "loadavg"))
+		assert.Equal(t, errors.Is(err, system.ErrCondition), true)
+	})
+}
+
+func TestSessions(t *testing.T) {
+	t.Run("lists sessions with their properties", func(t *testing.T) {
+		fakeCommand(t, "loginctl", `case "$1 $2" in
+"list-sessions "*)
+	echo '2 1000 alice seat0 tty2'
+	echo '5 1001 bob - pts/0'
+	echo 'c1 982 gdm seat0 tty1'
+	;;
+"show-session 2") printf 'Name=alice\nType=wayland\nClass=user\nService=gdm-password\nState=active\nRemote=no\n' ;;
+"show-session 5") printf 'Name=bob\nType=tty\nClass=user\nService=sshd\nState=active\nRemote=yes\n' ;;
+"show-session c1") printf 'Name=gdm\nType=wayland\nClass=greeter\nService=gdm-launch-environment\nState=online\nRemote=no\n' ;;
+*) exit 1 ;;
+esac
+`)
+
+		sessions, err := system.Sessions(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(sessions), 3)
+		assert.Equal(t, sessions[0], system.Session{
+			ID: "2", User: "alice", Type: "wayland", Class: "user", Service: "gdm-password", State: "active",
+		})
+		assert.Equal(t, sessions[1].Remote, true)
+		assert.Equal(t, sessions[0].Interactive(), true)
+		assert.Equal(t, sessions[1].Interactive(), true)
+		assert.Equal(t, sessions[2].Interactive(), false)
+	})
+
+	t.Run("no sessions", func(t *testing.T) {
+		fakeCommand(t, "loginctl", "exit 0\n")
+
+		sessions, err := system.Sessions(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(sessions), 0)
+	})
+
+	t.Run("loginctl failures fail", func(t *testing.T) {
+		fakeCommand(t, "loginctl", "echo 'Failed to connect to bus' >&2\nexit 1\n")
+
+		_, err := system.Sessions(context.Background())
+		assert.Equal(t, errors.Is(err, system.ErrCondition), true)
+	})
+}
+
+func TestSessionInteractive(t *testing.T) {
+	tests := []struct {
+		name    string
+		session system.Session
+		want    bool
+	}{
+		{"graphical", system.Session{Type: "x11", Class: "user", State: "online"}, true},
+		{"ssh", system.Session{Type: "tty", Class: "user", Service: "sshd", State: "active"}, true},
+		{"local console", system.Session{Type: "tty", Class: "user", Service: "login", State: "active"}, false},
+		{"closing", system.Session{Type: "wayland", Class: "user", State: "closing"}, false},
+		{"background", system.Session{Type: "unspecified", Class: "background", State: "active"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.session.Interactive(), tt.want)
+		})
+	}
+}
+
+func TestMetered(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{"metered", "u 1", true},
+		{"guessed metered", "u 3", true},
+		{"unmetered", "u 2", false},
+		{"guessed unmetered", "u 4", false},
+		{"unknown", "u 0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeCommand(t, "busctl", "echo '"+tt.output+"'\n")
+
+			metered, err := system.Metered(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assert.Equal(t, metered, tt.want)
+		})
+	}
+
+	t.Run("without NetworkManager the network is unmetered", func(t *testing.T) {
+		fakeCommand(t, "busctl", "echo 'Failed to get property Metered: Unit dbus-org.freedesktop.NetworkManager.service not found.' >&2\nexit 1\n")
+
+		metered, err := system.Metered(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, metered, false)
+	})
+
+	t.Run("other busctl failures fail", func(t *testing.T) {
+		fakeCommand(t, "busctl", "echo 'Failed to get property Metered: Access denied' >&2\nexit 1\n")
+
+		_, err := system.Metered(context.Background())
+
+		assert.Equal(t, errors.Is(err, system.ErrCondition), true)
+	})
+}
@@ -0,0 +1,31 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrCredential is returned when a secret file or systemd credential can't be read.
+var ErrCredential = errors.New("credential unavailable")
+
+// ReadSecretFile reads a secret from a file, trimming surrounding whitespace.
+func ReadSecretFile(path string) (string, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrCredential, err)
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// ReadCredential reads a systemd credential (see `LoadCredential=` in
+// systemd.exec(5)) from $CREDENTIALS_DIRECTORY.
+func ReadCredential(name string) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", fmt.Errorf("%w: %s: CREDENTIALS_DIRECTORY is not set", ErrCredential, name)
+	}
+	return ReadSecretFile(filepath.Join(dir, name))
+}
@@ -0,0 +1,81 @@
+package system
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrRebootCheck is returned when systems can't be compared to decide
+// whether a reboot is required.
+var ErrRebootCheck = errors.New("reboot requirement check failed")
+
+// bootComponents are the parts of a NixOS toplevel that only take
+// effect after a reboot.
+var bootComponents = []string{
+	"kernel",
+	"initrd",
+	"kernel-modules",
+	"kernel-params",
+	"systemd",
+}
+
+// RebootRequired compares the boot components of two NixOS toplevels,
+// e.g. /run/booted-system and a new generation, returning the names of
+// any that differ.
+func RebootRequired(booted, toplevel string) (changed []string, err error) {
+	for _, component := range bootComponents {
+		a, err := componentIdentity(filepath.Join(booted, component))
+		if err != nil {
+			return changed, err
+		}
+		b, err := componentIdentity(filepath.Join(toplevel, component))
+		if err != nil {
+			return changed, err
+		}
+		if !bytes.Equal(a, b) {
+			changed = append(changed, component)
+		}
+	}
+	return changed, nil
+}
+
+// componentIdentity is the resolved store path of a symlinked
+// component, or the contents of a regular file like kernel-params.
+// Missing components are nil.
+func componentIdentity(path string) ([]byte, error) {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRebootCheck, err)
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrRebootCheck, err)
+		}
+		return []byte(resolved), nil
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRebootCheck, err)
+	}
+	return contents, nil
+}
+
+// WriteRebootRequired writes a reboot required marker listing the
+// reasons a reboot is required, one per line.
+func WriteRebootRequired(path string, reasons []string) error {
+	err := os.WriteFile(path, []byte(strings.Join(reasons, "\n")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrState, err)
+	}
+	return nil
+}
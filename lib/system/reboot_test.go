@@ -0,0 +1,102 @@
+package system_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// toplevel creates a fake NixOS toplevel, linking components to store
+// paths created under dir. kernel-params is written as a file.
+func toplevel(t *testing.T, dir, name string, components map[string]string) string {
+	path := filepath.Join(dir, name)
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for component, target := range components {
+		if component == "kernel-params" {
+			os.WriteFile(filepath.Join(path, component), []byte(target), 0644)
+			continue
+		}
+		storePath := filepath.Join(dir, target)
+		os.MkdirAll(storePath, 0755)
+		err = os.Symlink(storePath, filepath.Join(path, component))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestRebootRequired(t *testing.T) {
+	components := map[string]string{
+		"kernel":         "aaaa-linux-6.6",
+		"initrd":         "aaaa-initrd",
+		"kernel-modules": "aaaa-modules",
+		"kernel-params":  "loglevel=4",
+		"systemd":        "aaaa-systemd-256",
+	}
+
+	t.Run("identical boot components don't require a reboot", func(t *testing.T) {
+		dir := t.TempDir()
+		booted := filepath.Join(dir, "booted-system")
+		os.Symlink(toplevel(t, dir, "booted", components), booted)
+		next := toplevel(t, dir, "next", components)
+
+		changed, err := system.RebootRequired(booted, next)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(changed), 0)
+	})
+
+	t.Run("lists changed boot components", func(t *testing.T) {
+		dir := t.TempDir()
+		booted := toplevel(t, dir, "booted", components)
+		nextComponents := map[string]string{}
+		for k, v := range components {
+			nextComponents[k] = v
+		}
+		nextComponents["kernel"] = "bbbb-linux-6.12"
+		nextComponents["kernel-params"] = "loglevel=7"
+		next := toplevel(t, dir, "next", nextComponents)
+
+		changed, err := system.RebootRequired(booted, next)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, changed, []string{"kernel", "kernel-params"})
+	})
+
+	t.Run("added or removed components require a reboot", func(t *testing.T) {
+		dir := t.TempDir()
+		booted := toplevel(t, dir, "booted", components)
+		nextComponents := map[string]string{}
+		for k, v := range components {
+			nextComponents[k] = v
+		}
+		delete(nextComponents, "initrd")
+		next := toplevel(t, dir, "next", nextComponents)
+
+		changed, err := system.RebootRequired(booted, next)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, changed, []string{"initrd"})
+	})
+}
+
+func TestWriteRebootRequired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reboot-required")
+
+	err := system.WriteRebootRequired(path, []string{"kernel", "initrd"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	contents, _ := os.ReadFile(path)
+	assert.Equal(t, string(contents), "kernel\ninitrd\n")
+}
@@ -0,0 +1,70 @@
+package system
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrState is returned when a state file can't be read or written.
+var ErrState = errors.New("state file unavailable")
+
+// WriteState atomically writes v as JSON to dir/name, creating dir if
+// needed.
+func WriteState(dir, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrState, name, err)
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrState, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, name+".*")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrState, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("%w: %w", ErrState, err)
+	}
+	return nil
+}
+
+// ReadState decodes JSON from dir/name into v. ok is false if the
+// state file doesn't exist.
+func ReadState(dir, name string, v any) (ok bool, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrState, err)
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s: %w", ErrState, name, err)
+	}
+	return true, nil
+}
+
+// RemoveState removes dir/name. Missing state files are not an error.
+func RemoveState(dir, name string) error {
+	err := os.Remove(filepath.Join(dir, name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrState, err)
+	}
+	return nil
+}
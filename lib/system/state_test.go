@@ -0,0 +1,77 @@
+package system_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+type testState struct {
+	Generation int
+	Toplevel   string
+}
+
+func TestState(t *testing.T) {
+	t.Run("round trips state", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "state")
+
+		err := system.WriteState(dir, "test.json", testState{Generation: 42, Toplevel: "/nix/store/bbbb-nixos-system-oak"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var s testState
+		ok, err := system.ReadState(dir, "test.json", &s)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, ok, true)
+		assert.Equal(t, s.Generation, 42)
+		assert.Equal(t, s.Toplevel, "/nix/store/bbbb-nixos-system-oak")
+
+		entries, _ := os.ReadDir(dir)
+		assert.Equal(t, len(entries), 1)
+	})
+
+	t.Run("missing state is not an error", func(t *testing.T) {
+		dir := t.TempDir()
+
+		var s testState
+		ok, err := system.ReadState(dir, "test.json", &s)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assert.Equal(t, ok, false)
+
+		err = system.RemoveState(dir, "test.json")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("removes state", func(t *testing.T) {
+		dir := t.TempDir()
+		system.WriteState(dir, "test.json", testState{})
+
+		err := system.RemoveState(dir, "test.json")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		ok, _ := system.ReadState(dir, "test.json", &testState{})
+		assert.Equal(t, ok, false)
+	})
+
+	t.Run("corrupt state errors", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "test.json"), []byte("{"), 0600)
+
+		_, err := system.ReadState(dir, "test.json", &testState{})
+
+		assert.Equal(t, errors.Is(err, system.ErrState), true)
+	})
+}
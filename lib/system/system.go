@@ -1,17 +1,54 @@
 package system
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"os"
 	"os/exec"
+	"time"
 )
 
-func Reboot() {
+// ErrRebootFailed is returned when a reboot can't be started, scheduled,
+// or cancelled.
+var ErrRebootFailed = errors.New("reboot failed")
+
+func Reboot() error {
 	cmd := exec.Command("systemctl", "reboot")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
 	err := cmd.Run()
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("%w: %w", ErrRebootFailed, err)
+	}
+	return nil
+}
+
+// ScheduleReboot schedules a reboot with `shutdown`, broadcasting
+// message to logged in users. delay is rounded up to whole minutes.
+func ScheduleReboot(delay time.Duration, message string) error {
+	minutes := int(math.Ceil(delay.Minutes()))
+	cmd := exec.Command("shutdown", "-r", fmt.Sprintf("+%d", minutes), message)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRebootFailed, err)
+	}
+	return nil
+}
+
+// CancelReboot cancels a reboot scheduled with ScheduleReboot.
+func CancelReboot() error {
+	cmd := exec.Command("shutdown", "-c")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRebootFailed, err)
 	}
+	return nil
 }
@@ -0,0 +1,109 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrSystemctl is returned when systemd can't be queried.
+var ErrSystemctl = errors.New("systemctl failed")
+
+// FailedUnit is a unit systemd reports as failed.
+type FailedUnit struct {
+	Name string `json:"name"`
+	// when the unit failed, from its InactiveEnterTimestamp. Zero when
+	// unknown.
+	Since time.Time `json:"since"`
+}
+
+// UnmarshalJSON also accepts bare unit names, as recorded before
+// failure times were.
+func (u *FailedUnit) UnmarshalJSON(data []byte) error {
+	var name string
+	if json.Unmarshal(data, &name) == nil {
+		*u = FailedUnit{Name: name}
+		return nil
+	}
+	type failedUnit FailedUnit
+	return json.Unmarshal(data, (*failedUnit)(u))
+}
+
+// FailedUnits returns the units systemd reports as failed, e.g. while
+// `systemctl is-system-running` reports degraded, and when they failed.
+func FailedUnits(ctx context.Context) ([]FailedUnit, error) {
+	stdout, err := systemctl(ctx, "list-units", "--state=failed", "--all", "--plain", "--no-legend", "--no-pager")
+	if err != nil {
+		return nil, err
+	}
+
+	// unit load active sub description
+	units := []FailedUnit{}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			units = append(units, FailedUnit{Name: fields[0]})
+		}
+	}
+	if len(units) == 0 {
+		return units, nil
+	}
+
+	args := []string{"show", "--timestamp=unix", "--property=InactiveEnterTimestamp", "--"}
+	for _, u := range units {
+		args = append(args, u.Name)
+	}
+	stdout, err = systemctl(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// one InactiveEnterTimestamp=@<seconds> per unit, in order
+	i := 0
+	scanner = bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "InactiveEnterTimestamp=")
+		if !ok {
+			continue
+		}
+		if i >= len(units) {
+			break
+		}
+		seconds, err := strconv.ParseInt(strings.TrimPrefix(value, "@"), 10, 64)
+		if err == nil && seconds > 0 {
+			units[i].Since = time.Unix(seconds, 0)
+		}
+		i++
+	}
+	return units, nil
+}
+
+// UnitNames returns the names of units.
+func UnitNames(units []FailedUnit) []string {
+	names := make([]string, len(units))
+	for i, u := range units {
+		names[i] = u.Name
+	}
+	return names
+}
+
+func systemctl(ctx context.Context, args ...string) (*bytes.Buffer, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "systemctl", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w: %s", ErrSystemctl, err, strings.TrimSpace(stderr.String()))
+	}
+	return &stdout, nil
+}
@@ -0,0 +1,80 @@
+package system_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+// fakeCommand puts a name script running body first in PATH.
+func fakeCommand(t *testing.T, name, body string) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// fakeSystemctl puts a systemctl script running body first in PATH.
+func fakeSystemctl(t *testing.T, body string) {
+	fakeCommand(t, "systemctl", body)
+}
+
+func TestFailedUnits(t *testing.T) {
+	t.Run("lists failed units", func(t *testing.T) {
+		fakeSystemctl(t, `if [ "$1" = show ]; then
+  [ "$*" = 'show --timestamp=unix --property=InactiveEnterTimestamp -- zfs-scrub.service backup@home.timer' ] || exit 1
+  printf 'InactiveEnterTimestamp=@1760000000\n\nInactiveEnterTimestamp=\n'
+  exit 0
+fi
+echo 'zfs-scrub.service      loaded failed failed ZFS pool scrub'
+echo 'backup@home.timer      loaded failed failed Backup home'
+`)
+
+		units, err := system.FailedUnits(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.ArrayEqual(t, units, []system.FailedUnit{
+			{Name: "zfs-scrub.service", Since: time.Unix(1760000000, 0)},
+			{Name: "backup@home.timer"},
+		})
+		assert.ArrayEqual(t, system.UnitNames(units), []string{"zfs-scrub.service", "backup@home.timer"})
+	})
+
+	t.Run("decodes failed units recorded by name", func(t *testing.T) {
+		var units []system.FailedUnit
+		err := json.Unmarshal([]byte(`["zfs-scrub.service",{"name":"nginx.service","since":"2025-10-09T08:53:20Z"}]`), &units)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, units[0], system.FailedUnit{Name: "zfs-scrub.service"})
+		assert.Equal(t, units[1].Name, "nginx.service")
+		assert.Equal(t, units[1].Since.Equal(time.Unix(1760000000, 0)), true)
+	})
+
+	t.Run("no failed units", func(t *testing.T) {
+		fakeSystemctl(t, "exit 0\n")
+
+		units, err := system.FailedUnits(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assert.Equal(t, len(units), 0)
+	})
+
+	t.Run("systemctl failures fail", func(t *testing.T) {
+		fakeSystemctl(t, "echo 'Failed to connect to bus' >&2\nexit 1\n")
+
+		_, err := system.FailedUnits(context.Background())
+		assert.Equal(t, errors.Is(err, system.ErrSystemctl), true)
+	})
+}
@@ -0,0 +1,62 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrWindow is returned for a malformed maintenance window.
+var ErrWindow = errors.New("invalid maintenance window")
+
+// Window is a daily local time maintenance window. Windows ending
+// before they start wrap past midnight. The zero Window is always open.
+type Window struct {
+	// minutes after midnight
+	start, end int
+	set        bool
+}
+
+// ParseWindow parses a window from HH:MM start and end times. Empty
+// start and end return an always open window. Equal start and end
+// times are an error, the window would never open.
+func ParseWindow(start, end string) (Window, error) {
+	if start == "" && end == "" {
+		return Window{}, nil
+	}
+	s, err := time.Parse("15:04", start)
+	if err != nil {
+		return Window{}, fmt.Errorf("%w: start %q: %w", ErrWindow, start, err)
+	}
+	e, err := time.Parse("15:04", end)
+	if err != nil {
+		return Window{}, fmt.Errorf("%w: end %q: %w", ErrWindow, end, err)
+	}
+	if s.Equal(e) {
+		return Window{}, fmt.Errorf("%w: %s-%s never opens", ErrWindow, start, end)
+	}
+	return Window{
+		start: s.Hour()*60 + s.Minute(),
+		end:   e.Hour()*60 + e.Minute(),
+		set:   true,
+	}, nil
+}
+
+// Contains reports whether t is within the window, in t's location.
+func (w Window) Contains(t time.Time) bool {
+	if !w.set {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+func (w Window) String() string {
+	if !w.set {
+		return "always"
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
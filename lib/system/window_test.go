@@ -0,0 +1,54 @@
+package system_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/assert"
+	"github.com/hyperparabolic/nixos-hydra-upgrade/lib/system"
+)
+
+func at(hour, minute int) time.Time {
+	return time.Date(2024, 5, 2, hour, minute, 0, 0, time.Local)
+}
+
+func TestWindow(t *testing.T) {
+	var windowTests = []struct {
+		description string
+		start, end  string
+		t           time.Time
+		contains    bool
+	}{
+		{"no window is always open", "", "", at(13, 0), true},
+		{"inside a window", "02:00", "05:00", at(4, 40), true},
+		{"window start is inclusive", "02:00", "05:00", at(2, 0), true},
+		{"window end is exclusive", "02:00", "05:00", at(5, 0), false},
+		{"before a window", "02:00", "05:00", at(1, 59), false},
+		{"inside a window wrapping midnight", "22:00", "04:00", at(23, 30), true},
+		{"inside a window wrapping midnight after midnight", "22:00", "04:00", at(3, 0), true},
+		{"outside a window wrapping midnight", "22:00", "04:00", at(12, 0), false},
+	}
+
+	for _, test := range windowTests {
+		t.Run(test.description, func(t *testing.T) {
+			w, err := system.ParseWindow(test.start, test.end)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assert.Equal(t, w.Contains(test.t), test.contains)
+		})
+	}
+
+	t.Run("malformed times error", func(t *testing.T) {
+		_, err := system.ParseWindow("2am", "05:00")
+
+		assert.Equal(t, errors.Is(err, system.ErrWindow), true)
+	})
+
+	t.Run("empty windows error", func(t *testing.T) {
+		_, err := system.ParseWindow("03:00", "03:00")
+
+		assert.Equal(t, errors.Is(err, system.ErrWindow), true)
+	})
+}
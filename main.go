@@ -8,5 +8,11 @@ func main() {
 	rootCmd := cmd.NewRootCmd()
 	docsCmd := cmd.NewDocsCommand(rootCmd)
 	rootCmd.AddCommand(docsCmd)
+	verifyCmd := cmd.NewVerifyCommand(rootCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rebootPendingCmd := cmd.NewRebootPendingCommand(rootCmd)
+	rootCmd.AddCommand(rebootPendingCmd)
+	leaseServerCmd := cmd.NewLeaseServerCommand(rootCmd)
+	rootCmd.AddCommand(leaseServerCmd)
 	rootCmd.Execute()
 }
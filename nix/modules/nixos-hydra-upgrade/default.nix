@@ -8,6 +8,8 @@
   cfg = config.system.autoUpgradeHydra;
   nixosHydraUpgradePackages = inputs.nixos-hydra-upgrade.packages.${pkgs.stdenv.hostPlatform.system};
   settingsFormat = pkgs.formats.yaml {};
+  rebootWindowStart = (cfg.settings.reboot_policy or {}).window_start or null;
+  rebootLockBackend = (cfg.settings.reboot_lock or {}).backend or "none";
 in {
   options = {
     system.autoUpgradeHydra = {
@@ -26,6 +28,19 @@ in {
         '';
       };
 
+      credentials = lib.mkOption {
+        type = lib.types.attrsOf lib.types.path;
+        default = {};
+        example = {
+          hydra-token = "/run/secrets/hydra-token";
+        };
+        description = ''
+          systemd credentials (see {manpage}`systemd.exec(5)` "LoadCredential=" section)
+          made available to the service, keyed by credential name. Reference these by
+          name with `settings.hydra.auth.credential` to keep secrets out of the nix store.
+        '';
+      };
+
       dates = lib.mkOption {
         type = lib.types.str;
         default = "04:40";
@@ -38,6 +53,41 @@ in {
         '';
       };
 
+      retryDelay = lib.mkOption {
+        type = lib.types.str;
+        default = "30min";
+        example = "1h";
+        description = ''
+          Delay before the service is restarted after exiting with the "retry"
+          build status policy exit code (75). The exit code counts as success,
+          so the unit doesn't fail. The format is described in
+          {manpage}`systemd.time(7)`.
+        '';
+      };
+
+      leaseServer = {
+        enable = lib.mkEnableOption ''
+          a reboot lock lease server on this host, for hosts configured with
+          `settings.reboot_lock.backend = "http"`
+        '';
+        listen = lib.mkOption {
+          type = lib.types.str;
+          default = ":8080";
+          description = "Address the lease server listens on";
+        };
+        slots = lib.mkOption {
+          type = lib.types.ints.positive;
+          default = 1;
+          description = "Number of hosts that may reboot at once";
+        };
+        ttl = lib.mkOption {
+          type = lib.types.str;
+          default = "0s";
+          example = "6h";
+          description = "Expire leases held longer than this, `0s` never expires them";
+        };
+      };
+
       settings = lib.mkOption {
         description = ''
           Configuration for nixos-hydra-upgrade, see [usage](https://github.com/hyperparabolic/nixos-hydra-upgrade/blob/${nixosHydraUpgradePackages.default.version}/README.md#usage)
@@ -95,6 +145,55 @@ in {
                     type = lib.types.str;
                     description = "hydra job";
                   };
+                  auth = lib.mkOption {
+                    description = ''
+                      Options to authenticate with a private hydra instance.
+                    '';
+                    default = {};
+                    type = lib.types.submodule {
+                      freeformType = settingsFormat.type;
+                      options = {
+                        method = lib.mkOption {
+                          type = lib.types.enum [
+                            "none"
+                            "basic"
+                            "bearer"
+                            "header"
+                            "session"
+                          ];
+                          default = "none";
+                          description = "hydra authentication method";
+                        };
+                        user = lib.mkOption {
+                          type = lib.types.nullOr lib.types.str;
+                          default = null;
+                          description = "hydra user, required for `basic` and `session` auth";
+                        };
+                        header = lib.mkOption {
+                          type = lib.types.nullOr lib.types.str;
+                          default = null;
+                          example = "X-Hydra-Token";
+                          description = "header name carrying the secret for `header` auth";
+                        };
+                        secret_file = lib.mkOption {
+                          type = lib.types.nullOr lib.types.str;
+                          default = null;
+                          description = ''
+                            File containing the password or token. This should not be a
+                            nix store path.
+                          '';
+                        };
+                        credential = lib.mkOption {
+                          type = lib.types.nullOr lib.types.str;
+                          default = null;
+                          description = ''
+                            Name of a systemd credential, see `credentials`, containing
+                            the password or token.
+                          '';
+                        };
+                      };
+                    };
+                  };
                 };
               };
             };
@@ -118,6 +217,18 @@ in {
                     default = "boot";
                     description = "{command}`switch-to-configuration` operation to execute";
                   };
+                  mode = lib.mkOption {
+                    type = lib.types.enum [
+                      "eval"
+                      "substitute"
+                    ];
+                    default = "eval";
+                    description = ''
+                      `eval` evaluates and builds the flake toplevel locally. `substitute`
+                      realises the hydra build output from the binary cache without any
+                      local evaluation.
+                    '';
+                  };
                   host = lib.mkOption {
                     type = lib.types.str;
                     description = "system hostname";
@@ -134,11 +245,41 @@ in {
                 };
               };
             };
+            rollback = lib.mkOption {
+              description = ''
+                Post-activation health checks for the `switch` and `test` operations. If
+                any health check fails within the window, the system profile is rolled
+                back to the previous generation and reactivated.
+              '';
+              type = lib.types.submodule {
+                freeformType = settingsFormat.type;
+                options = {
+                  enable = lib.mkEnableOption "rollback when post-activation health checks fail";
+                  window = lib.mkOption {
+                    type = lib.types.str;
+                    default = "1m";
+                    description = "Repeat health checks for this long after activation, `0s` checks once";
+                  };
+                };
+              };
+              default = {};
+            };
             reboot = lib.mkOption {
               default = false;
               type = lib.types.bool;
               description = ''
-                Wether to reboot the system after changing profiles.
+                Wether to reboot the system after changing profiles. Only reboots when the
+                new generation changes boot components, unless `reboot_policy.when = "always"`.
+              '';
+            };
+            trial_boot = lib.mkOption {
+              default = false;
+              type = lib.types.bool;
+              description = ''
+                Boot the new generation once with a systemd-boot oneshot entry, and reboot.
+                The `nixos-hydra-upgrade-verify` unit runs health checks on the next boot,
+                and only then makes the new generation the boot default. Requires
+                `nix_build.operation = "boot"` and systemd-boot.
               '';
             };
           };
@@ -148,42 +289,120 @@ in {
     };
   };
 
-  config = lib.mkIf cfg.enable {
-    environment.etc."nixos-hydra-upgrade" = {
-      mode = "0440";
-      source = settingsFormat.generate "nixos-hydra-upgrade.yaml" cfg.settings;
-      target = "nixos-hydra-upgrade/config.yaml";
-    };
-    systemd.services.nixos-hydra-upgrade =
-      {
-        description = "NixOS Upgrade with hydra build validation and health check support.";
+  config = lib.mkMerge [
+    (lib.mkIf cfg.enable {
+      environment.etc."nixos-hydra-upgrade" = {
+        mode = "0440";
+        source = settingsFormat.generate "nixos-hydra-upgrade.yaml" cfg.settings;
+        target = "nixos-hydra-upgrade/config.yaml";
+      };
+      systemd.services.nixos-hydra-upgrade =
+        {
+          description = "NixOS Upgrade with hydra build validation and health check support.";
+
+          restartIfChanged = false;
+          unitConfig.X-StopOnRemoval = false;
+          serviceConfig.Type = "oneshot";
+          # deferred upgrades are retried without failing the unit, so
+          # OnFailure= alerting isn't triggered
+          serviceConfig.SuccessExitStatus = "75";
+          serviceConfig.RestartForceExitStatus = "75";
+          serviceConfig.RestartSec = cfg.retryDelay;
+          serviceConfig.LoadCredential = lib.mapAttrsToList (name: path: "${name}:${path}") cfg.credentials;
+          serviceConfig.StateDirectory = "nixos-hydra-upgrade";
+
+          environment =
+            config.nix.envVars
+            // {
+              inherit (config.environment.sessionVariables) NIX_PATH;
+              HOME = "/root";
+            }
+            // config.networking.proxy.envVars;
+
+          path = with pkgs; [
+            config.nix.package
+            config.systemd.package
+            dix
+          ];
+
+          script = "${lib.getExe nixosHydraUpgradePackages.default} -c /etc/nixos-hydra-upgrade/config.yaml";
+
+          startAt = cfg.dates;
+
+          after = ["network-online.target"];
+          wants = ["network-online.target"];
+        }
+        // lib.optionalAttrs (cfg.environmentFile != null) {
+          EnvironmentFile = cfg.environmentFile;
+        };
+      # verifies trial boots, and releases reboot locks held since the reboot
+      systemd.services.nixos-hydra-upgrade-verify = lib.mkIf (cfg.settings.trial_boot || rebootLockBackend != "none") {
+        description = "Verify a nixos-hydra-upgrade reboot with health checks.";
 
         restartIfChanged = false;
         unitConfig.X-StopOnRemoval = false;
         serviceConfig.Type = "oneshot";
+        serviceConfig.RemainAfterExit = true;
+        serviceConfig.StateDirectory = "nixos-hydra-upgrade";
+        serviceConfig.EnvironmentFile = lib.mkIf (cfg.environmentFile != null) cfg.environmentFile;
 
-        environment =
-          config.nix.envVars
-          // {
-            inherit (config.environment.sessionVariables) NIX_PATH;
-            HOME = "/root";
-          }
-          // config.networking.proxy.envVars;
-
-        path = with pkgs; [
-          config.nix.package
-          dix
+        path = [
+          config.systemd.package
         ];
 
-        script = "${lib.getExe nixosHydraUpgradePackages.default} -c /etc/nixos-hydra-upgrade/config.yaml";
-
-        startAt = cfg.dates;
+        script = "${lib.getExe nixosHydraUpgradePackages.default} verify -c /etc/nixos-hydra-upgrade/config.yaml";
 
+        wantedBy = ["multi-user.target"];
         after = ["network-online.target"];
         wants = ["network-online.target"];
-      }
-      // lib.optionalAttrs (cfg.environmentFile != null) {
-        EnvironmentFile = cfg.environmentFile;
       };
-  };
+      # performs reboots deferred until the reboot window opens
+      systemd.services.nixos-hydra-upgrade-reboot-pending = lib.mkIf ((cfg.settings.reboot || cfg.settings.trial_boot) && rebootWindowStart != null) {
+        description = "Perform a nixos-hydra-upgrade reboot deferred until the reboot window.";
+
+        restartIfChanged = false;
+        unitConfig.X-StopOnRemoval = false;
+        serviceConfig.Type = "oneshot";
+        # retries reboots waiting for a reboot lock slot, without failing
+        serviceConfig.SuccessExitStatus = "75";
+        serviceConfig.RestartForceExitStatus = "75";
+        serviceConfig.RestartSec = cfg.retryDelay;
+        serviceConfig.StateDirectory = "nixos-hydra-upgrade";
+        serviceConfig.EnvironmentFile = lib.mkIf (cfg.environmentFile != null) cfg.environmentFile;
+
+        path = [
+          config.systemd.package
+        ];
+
+        script = "${lib.getExe nixosHydraUpgradePackages.default} reboot-pending -c /etc/nixos-hydra-upgrade/config.yaml";
+
+        startAt = "*-*-* ${rebootWindowStart}:00";
+      };
+    })
+    (lib.mkIf cfg.leaseServer.enable {
+      systemd.services.nixos-hydra-upgrade-lease-server = {
+        description = "nixos-hydra-upgrade reboot lock lease server.";
+
+        serviceConfig.DynamicUser = true;
+        serviceConfig.StateDirectory = "nixos-hydra-upgrade-lease-server";
+        serviceConfig.Restart = "on-failure";
+
+        script = lib.escapeShellArgs [
+          (lib.getExe nixosHydraUpgradePackages.default)
+          "lease-server"
+          "--listen"
+          cfg.leaseServer.listen
+          "--slots"
+          (toString cfg.leaseServer.slots)
+          "--ttl"
+          cfg.leaseServer.ttl
+          "--state-dir"
+          "/var/lib/nixos-hydra-upgrade-lease-server"
+        ];
+
+        wantedBy = ["multi-user.target"];
+        after = ["network.target"];
+      };
+    })
+  ];
 }